@@ -0,0 +1,168 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Number is a number given out by a namespace
+type Number struct {
+	Namespace string // the namespace of the period for a namespace that resets, i.e: pub/invoices@2026
+	Number    uint64
+	ID        string // the number as it's given out, i.e: INV-000042, which is the number when the namespace has no format
+}
+
+// Batch is a range of numbers claimed together, the numbers of the range are
+// Step apart
+type Batch struct {
+	Namespace       string
+	First, Last     uint64
+	FirstID, LastID string // the first and last numbers as they're given out
+	Step            uint64
+	ServerID        string
+	Timestamp       time.Time
+}
+
+// nsResponse is the JSON body of a claimed namespace
+type nsResponse struct {
+	Namespace string `json:"namespace"`
+	Number    string `json:"number"`
+	Last      string `json:"last"`
+	ID        string `json:"id"`
+	LastID    string `json:"last_id"`
+	ServerID  string `json:"server_id"`
+	Timestamp string `json:"timestamp"`
+}
+
+// batch returns the response as a batch of count numbers
+func (r nsResponse) batch(count uint64) (b Batch, err error) {
+	b.Namespace, b.ServerID = r.Namespace, r.ServerID
+	if b.First, err = strconv.ParseUint(r.Number, 10, 64); err != nil {
+		return b, fmt.Errorf("incrr number: %v", err)
+	}
+	b.Last = b.First
+	if len(r.Last) > 0 {
+		if b.Last, err = strconv.ParseUint(r.Last, 10, 64); err != nil {
+			return b, fmt.Errorf("incrr last number: %v", err)
+		}
+	}
+
+	b.FirstID, b.LastID = r.ID, r.LastID
+	if len(b.FirstID) == 0 {
+		b.FirstID = r.Number
+	}
+	if len(b.LastID) == 0 {
+		b.LastID = b.FirstID
+		if b.Last != b.First {
+			b.LastID = strconv.FormatUint(b.Last, 10)
+		}
+	}
+
+	b.Step = 1
+	if count > 1 && b.Last > b.First {
+		b.Step = (b.Last - b.First) / (count - 1)
+	}
+	if len(r.Timestamp) > 0 {
+		b.Timestamp, _ = time.Parse(time.RFC3339Nano, r.Timestamp)
+	}
+	return b, nil
+}
+
+// Next claims the next number of the namespace, i.e: pub/orders.
+//
+// When the client has a Prefetch, the numbers are claimed that many at a time
+// and given out from memory, and the next block is claimed in the background
+// once half of them are used. Numbers that are never given out, i.e: when the
+// program stops, are left as a gap in the namespace. A gapless namespace is
+// turned away, its numbers are given out with Reserve. A namespace that can't
+// claim batches, or that formats its numbers, is claimed one number at a time.
+func (c *Client) Next(ctx context.Context, ns string) (Number, error) {
+	if c.config.Prefetch > 1 {
+		return c.prefetched(ctx, ns)
+	}
+	return c.next(ctx, ns)
+}
+
+// next claims a single number from the servers
+func (c *Client) next(ctx context.Context, ns string) (Number, error) {
+	b, err := c.Batch(ctx, ns, 1)
+	if err != nil {
+		return Number{}, err
+	}
+	return Number{Namespace: b.Namespace, Number: b.First, ID: b.FirstID}, nil
+}
+
+// Batch claims count contiguous numbers of the namespace. The claim is sent
+// with an idempotency key, so it's safe to retry on another server.
+func (c *Client) Batch(ctx context.Context, ns string, count uint64) (Batch, error) {
+	key, err := newIdempotencyKey()
+	if err != nil {
+		return Batch{}, err
+	}
+
+	var query url.Values
+	if count > 1 {
+		query = url.Values{"count": {strconv.FormatUint(count, 10)}}
+	}
+
+	var resp nsResponse
+	if err := c.do(ctx, call{method: http.MethodGet, ns: ns, query: query, idemKey: key, safe: true}, &resp); err != nil {
+		return Batch{}, err
+	}
+	return resp.batch(count)
+}
+
+// Peek returns the highest number given out by the namespace without
+// claiming a new one
+func (c *Client) Peek(ctx context.Context, ns string) (Number, error) {
+	var resp nsResponse
+	if err := c.do(ctx, call{method: http.MethodGet, ns: ns, query: url.Values{"peek": {""}}, safe: true}, &resp); err != nil {
+		return Number{}, err
+	}
+
+	b, err := resp.batch(1)
+	if err != nil {
+		return Number{}, err
+	}
+	return Number{Namespace: b.Namespace, Number: b.First, ID: b.FirstID}, nil
+}
+
+// Validation is the result of validating an id given out by a namespace
+type Validation struct {
+	Namespace string
+	ID        string
+	Number    uint64 // only set when the id is valid
+	Valid     bool   // if the id is in the format of the namespace, with a matching check digit
+	Issued    bool   // if the number has been given out by the namespace
+}
+
+// nsValidateResponse is the JSON body of a validated number
+type nsValidateResponse struct {
+	Namespace string `json:"namespace"`
+	ID        string `json:"id"`
+	Number    string `json:"number"`
+	Valid     bool   `json:"valid"`
+	Issued    bool   `json:"issued"`
+}
+
+// Validate checks an id given out by the namespace, i.e: one typed in by a person
+func (c *Client) Validate(ctx context.Context, ns, id string) (Validation, error) {
+	var resp nsValidateResponse
+	if err := c.do(ctx, call{method: http.MethodGet, ns: ns, query: url.Values{"validate": {id}}, safe: true}, &resp); err != nil {
+		return Validation{}, err
+	}
+
+	v := Validation{Namespace: resp.Namespace, ID: resp.ID, Valid: resp.Valid, Issued: resp.Issued}
+	if len(resp.Number) > 0 {
+		n, err := strconv.ParseUint(resp.Number, 10, 64)
+		if err != nil {
+			return v, fmt.Errorf("incrr number: %v", err)
+		}
+		v.Number = n
+	}
+	return v, nil
+}
@@ -0,0 +1,252 @@
+// Package client is a Go client for the incrr HTTP API. A Client claims
+// numbers from any of a list of incrr servers, moving on to the next server
+// when one can't be reached, and retries a claim with an idempotency key so a
+// retry never gives out more numbers than were asked for.
+//
+//	c, err := client.New(client.Config{Endpoints: []string{"https://incrr-1", "https://incrr-2"}})
+//	if err != nil {
+//		...
+//	}
+//	n, err := c.Next(ctx, "pub/orders")
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTimeout = 5 * time.Second
+	defaultRetries = 3
+	defaultBackoff = 100 * time.Millisecond
+	maxBackoff     = 5 * time.Second
+
+	idempotencyHeader = "Idempotency-Key"
+)
+
+// ErrNoEndpoints is returned by New when there are no endpoints to use
+var ErrNoEndpoints = errors.New("no endpoints")
+
+// StatusError is returned when a server answers with an HTTP error status,
+// i.e: 409 Conflict once a namespace has reached its max
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Endpoint   string
+	RetryAfter time.Duration // from the Retry-After header, if there was one
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("incrr %s: %s", e.Endpoint, e.Status)
+}
+
+// Config is the configuration of a Client, only the endpoints are needed
+type Config struct {
+	Endpoints []string      // the base URLs of the servers, i.e: https://incrr-1:443
+	APIKey    string        // sent as a bearer token, it's needed for priv/ namespaces
+	Timeout   time.Duration // how long a single request to a server can take, the default is 5s
+	Retries   int           // how many times a request is tried again, the default is 3 and -1 turns it off
+	Backoff   time.Duration // the wait before the first retry, it doubles after each one, the default is 100ms
+
+	// Prefetch is how many numbers Next claims at a time and keeps for
+	// later calls, zero or one turns it off. See Next.
+	Prefetch uint64
+
+	HTTPClient *http.Client // the default is http.DefaultClient
+}
+
+// Client claims numbers from incrr servers. It's safe to use from more than
+// one goroutine.
+type Client struct {
+	config    Config
+	endpoints []string
+	http      *http.Client
+
+	mu        sync.Mutex
+	preferred int                // the endpoint that's tried first, it's the last one that answered
+	buffers   map[string]*buffer // the prefetched numbers of each namespace
+}
+
+// New returns a client for the servers of the config
+func New(config Config) (*Client, error) {
+	if len(config.Endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+
+	c := &Client{config: config, http: config.HTTPClient, buffers: make(map[string]*buffer)}
+	for _, ep := range config.Endpoints {
+		u, err := url.Parse(ep)
+		if err != nil {
+			return nil, fmt.Errorf("endpoint %q: %v", ep, err)
+		}
+		if len(u.Scheme) == 0 || len(u.Host) == 0 {
+			return nil, fmt.Errorf("endpoint %q: needs a scheme and host", ep)
+		}
+		c.endpoints = append(c.endpoints, strings.TrimSuffix(ep, "/"))
+	}
+
+	if c.config.Timeout <= 0 {
+		c.config.Timeout = defaultTimeout
+	}
+	if c.config.Retries < 0 {
+		c.config.Retries = 0
+	} else if c.config.Retries == 0 {
+		c.config.Retries = defaultRetries
+	}
+	if c.config.Backoff <= 0 {
+		c.config.Backoff = defaultBackoff
+	}
+	if c.http == nil {
+		c.http = http.DefaultClient
+	}
+	return c, nil
+}
+
+// call is a single API request, it may be sent more than once
+type call struct {
+	method  string
+	ns      string // the namespace, i.e: pub/orders
+	query   url.Values
+	idemKey string // sent with a claim so a retry gets back the same numbers
+
+	// safe is if the request can be sent again after it may have reached a
+	// server, otherwise it's only sent again when a server turned it away
+	safe bool
+}
+
+// do sends the call to the servers, starting with the preferred one, until
+// one of them answers or the retries run out. The JSON body is decoded into v.
+func (c *Client) do(ctx context.Context, cl call, v interface{}) error {
+	c.mu.Lock()
+	start := c.preferred
+	c.mu.Unlock()
+
+	var err error
+	for attempt := 0; attempt <= c.config.Retries; attempt++ {
+		if attempt > 0 {
+			if werr := wait(ctx, c.backoff(attempt, err)); werr != nil {
+				return err // the last error is more useful than the context's
+			}
+		}
+
+		idx := (start + attempt) % len(c.endpoints)
+		var retry bool
+		if retry, err = c.send(ctx, c.endpoints[idx], cl, v); err == nil {
+			c.mu.Lock()
+			c.preferred = idx
+			c.mu.Unlock()
+			return nil
+		}
+		if !retry || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// send sends the call to a single endpoint, and returns if the call can be
+// tried again when it fails
+func (c *Client) send(ctx context.Context, endpoint string, cl call, v interface{}) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.config.Timeout)
+	defer cancel()
+
+	u := endpoint + "/" + strings.TrimPrefix(cl.ns, "/") + ".json"
+	if len(cl.query) > 0 {
+		u += "?" + cl.query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, cl.method, u, nil)
+	if err != nil {
+		return false, fmt.Errorf("incrr request: %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if len(c.config.APIKey) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.config.APIKey)
+	}
+	if len(cl.idemKey) > 0 {
+		req.Header.Set(idempotencyHeader, cl.idemKey)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return cl.safe || notSent(err), fmt.Errorf("incrr %s: %v", endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body) // so the connection can be used again
+		err := &StatusError{StatusCode: resp.StatusCode, Status: resp.Status, Endpoint: endpoint}
+		if ra, perr := strconv.Atoi(resp.Header.Get("Retry-After")); perr == nil && ra > 0 {
+			err.RetryAfter = time.Duration(ra) * time.Second
+		}
+
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable: // turned away before anything was done
+			return true, err
+		case http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+			return cl.safe, err
+		}
+		return false, err
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return false, fmt.Errorf("incrr %s: json decode: %v", endpoint, err)
+	}
+	return false, nil
+}
+
+// notSent returns if the error is from connecting to the server, so the
+// request was never sent
+func notSent(err error) bool {
+	var oerr *net.OpError
+	return errors.As(err, &oerr) && oerr.Op == "dial"
+}
+
+// backoff returns how long to wait before the retry, a server that asked for
+// a longer wait with a Retry-After header gets it
+func (c *Client) backoff(attempt int, err error) time.Duration {
+	d := c.config.Backoff << uint(attempt-1)
+	if d > maxBackoff || d <= 0 {
+		d = maxBackoff
+	}
+
+	var serr *StatusError
+	if errors.As(err, &serr) && serr.RetryAfter > d {
+		d = serr.RetryAfter
+	}
+	return d
+}
+
+// wait waits for d, or until the context is done
+func wait(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// newIdempotencyKey returns a random idempotency key
+func newIdempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("idempotency key: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
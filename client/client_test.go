@@ -0,0 +1,188 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer is a fake incrr server that gives out numbers in order, the
+// requests it gets are kept so the tests can check what the client sent
+type testServer struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	next   uint64
+	reqs   []*http.Request
+	status []int // the status of each request before numbers are given out
+}
+
+// newTestServer starts a fake server that answers with each status in turn
+// and then gives out numbers
+func newTestServer(t *testing.T, status ...int) *testServer {
+	ts := &testServer{status: status}
+	ts.Server = httptest.NewServer(http.HandlerFunc(ts.serve))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func (ts *testServer) serve(w http.ResponseWriter, r *http.Request) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.reqs = append(ts.reqs, r)
+	if len(ts.status) > 0 {
+		status := ts.status[0]
+		ts.status = ts.status[1:]
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	count := uint64(1)
+	if cnt := r.URL.Query().Get("count"); len(cnt) > 0 {
+		count, _ = strconv.ParseUint(cnt, 10, 64)
+	}
+	first := ts.next
+	ts.next += count
+
+	json.NewEncoder(w).Encode(nsResponse{
+		Namespace: r.URL.Path[1 : len(r.URL.Path)-len(".json")],
+		Number:    strconv.FormatUint(first, 10),
+		Last:      strconv.FormatUint(first+count-1, 10),
+	})
+}
+
+// requests returns the requests the fake server has had
+func (ts *testServer) requests() []*http.Request {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return append([]*http.Request(nil), ts.reqs...)
+}
+
+// testClient returns a client for the endpoints that retries without waiting long
+func testClient(t *testing.T, config Config, endpoints ...string) *Client {
+	t.Helper()
+	config.Endpoints, config.Backoff = endpoints, time.Millisecond
+	c, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(Config{}); err != ErrNoEndpoints {
+		t.Errorf("no endpoints: got %v, want %v", err, ErrNoEndpoints)
+	}
+	if _, err := New(Config{Endpoints: []string{"incrr-1"}}); err == nil {
+		t.Error("an endpoint without a scheme was allowed")
+	}
+}
+
+func TestFailover(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close() // nothing is listening, so the request is never sent
+	up := newTestServer(t)
+
+	c := testClient(t, Config{}, down.URL, up.URL)
+	n, err := c.Next(context.Background(), "pub/orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Namespace != "pub/orders" || n.Number != 0 {
+		t.Errorf("got %+v, want pub/orders 0", n)
+	}
+
+	// the server that answered is tried first from then on
+	if _, err := c.Next(context.Background(), "pub/orders"); err != nil {
+		t.Fatal(err)
+	}
+	if reqs := up.requests(); len(reqs) != 2 {
+		t.Errorf("requests: got %d, want 2", len(reqs))
+	}
+	if c.preferred != 1 {
+		t.Errorf("preferred: got %d, want 1", c.preferred)
+	}
+}
+
+func TestIdempotentRetry(t *testing.T) {
+	ts := newTestServer(t, http.StatusInternalServerError, http.StatusServiceUnavailable)
+
+	c := testClient(t, Config{}, ts.URL)
+	b, err := c.Batch(context.Background(), "pub/orders", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.First != 0 || b.Last != 4 || b.Step != 1 {
+		t.Errorf("got %d-%d step %d, want 0-4 step 1", b.First, b.Last, b.Step)
+	}
+
+	// every try of the claim has the same key, so the server gives back the
+	// numbers of a try that it saw but didn't answer
+	reqs := ts.requests()
+	if len(reqs) != 3 {
+		t.Fatalf("requests: got %d, want 3", len(reqs))
+	}
+	key := reqs[0].Header.Get(idempotencyHeader)
+	for i, r := range reqs {
+		if len(key) == 0 || r.Header.Get(idempotencyHeader) != key {
+			t.Errorf("request %d: got key %q, want %q", i, r.Header.Get(idempotencyHeader), key)
+		}
+	}
+
+	// a new claim has a new key
+	if _, err := c.Next(context.Background(), "pub/orders"); err != nil {
+		t.Fatal(err)
+	}
+	if reqs = ts.requests(); reqs[3].Header.Get(idempotencyHeader) == key {
+		t.Error("the key was used again for a new claim")
+	}
+}
+
+func TestNoRetry(t *testing.T) {
+	ts := newTestServer(t, http.StatusConflict)
+
+	c := testClient(t, Config{}, ts.URL)
+	_, err := c.Next(context.Background(), "pub/orders")
+
+	var serr *StatusError
+	if !errors.As(err, &serr) || serr.StatusCode != http.StatusConflict {
+		t.Fatalf("got %v, want a 409 StatusError", err)
+	}
+	if reqs := ts.requests(); len(reqs) != 1 {
+		t.Errorf("requests: got %d, want 1", len(reqs))
+	}
+}
+
+func TestRetriesRunOut(t *testing.T) {
+	ts := newTestServer(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+
+	c := testClient(t, Config{Retries: 2}, ts.URL)
+	_, err := c.Next(context.Background(), "pub/orders")
+
+	var serr *StatusError
+	if !errors.As(err, &serr) || serr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got %v, want a 503 StatusError", err)
+	}
+	if reqs := ts.requests(); len(reqs) != 3 {
+		t.Errorf("requests: got %d, want 3", len(reqs))
+	}
+}
+
+func TestAPIKey(t *testing.T) {
+	ts := newTestServer(t)
+
+	c := testClient(t, Config{APIKey: "key-1"}, ts.URL)
+	if _, err := c.Next(context.Background(), "priv/acme/orders"); err != nil {
+		t.Fatal(err)
+	}
+	if auth := ts.requests()[0].Header.Get("Authorization"); auth != "Bearer key-1" {
+		t.Errorf("got %q, want the bearer token", auth)
+	}
+}
@@ -0,0 +1,90 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// the states of a lease
+const (
+	StateReserved  = "reserved"
+	StateCommitted = "committed"
+	StateAborted   = "aborted"
+	StateAcquired  = "acquired"
+	StateReleased  = "released"
+)
+
+// Lease is a number of a gapless namespace that is reserved, committed or
+// aborted, or a number of an allocator namespace that is acquired or released
+type Lease struct {
+	Namespace string
+	Number    uint64
+	ID        string // the number as it's given out
+	Token     string // only set when the number is reserved or acquired
+	State     string
+	Expires   time.Time // when a reserved number goes back to the namespace if it isn't committed
+}
+
+// nsLeaseResponse is the JSON body of a lease
+type nsLeaseResponse struct {
+	Namespace string `json:"namespace"`
+	Number    string `json:"number"`
+	ID        string `json:"id"`
+	Token     string `json:"token"`
+	State     string `json:"state"`
+	Expires   string `json:"expires"`
+}
+
+// lease sends a lease action to the servers. Only the actions that give back
+// the same number when they're sent again are safe to retry.
+func (c *Client) lease(ctx context.Context, ns string, query url.Values, safe bool) (l Lease, err error) {
+	var resp nsLeaseResponse
+	if err := c.do(ctx, call{method: http.MethodPost, ns: ns, query: query, safe: safe}, &resp); err != nil {
+		return l, err
+	}
+
+	l = Lease{Namespace: resp.Namespace, ID: resp.ID, Token: resp.Token, State: resp.State}
+	if l.Number, err = strconv.ParseUint(resp.Number, 10, 64); err != nil {
+		return l, fmt.Errorf("incrr number: %v", err)
+	}
+	if len(l.ID) == 0 {
+		l.ID = resp.Number
+	}
+	if len(resp.Expires) > 0 {
+		if l.Expires, err = time.Parse(time.RFC3339, resp.Expires); err != nil {
+			return l, fmt.Errorf("incrr expires: %v", err)
+		}
+	}
+	return l, nil
+}
+
+// Reserve reserves a number of a gapless namespace, which has to be committed
+// or aborted with the token of the lease before it expires
+func (c *Client) Reserve(ctx context.Context, ns string) (Lease, error) {
+	return c.lease(ctx, ns, url.Values{"reserve": {""}}, false)
+}
+
+// Commit commits the reserved number of the token
+func (c *Client) Commit(ctx context.Context, ns, token string) (Lease, error) {
+	return c.lease(ctx, ns, url.Values{"commit": {token}}, true)
+}
+
+// Abort aborts the reserved number of the token, so it's given out again
+func (c *Client) Abort(ctx context.Context, ns, token string) (Lease, error) {
+	return c.lease(ctx, ns, url.Values{"abort": {token}}, true)
+}
+
+// Acquire acquires the lowest free number of an allocator namespace, which
+// is released with the token of the lease
+func (c *Client) Acquire(ctx context.Context, ns string) (Lease, error) {
+	return c.lease(ctx, ns, url.Values{"acquire": {""}}, false)
+}
+
+// Release releases the number acquired with the token so it can be acquired again
+func (c *Client) Release(ctx context.Context, ns, token string) (Lease, error) {
+	return c.lease(ctx, ns, url.Values{"release": {token}}, false)
+}
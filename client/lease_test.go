@@ -0,0 +1,126 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testLeaseServer is a fake incrr server for the lease actions, it fails the
+// first request with the status when it's set
+func testLeaseServer(t *testing.T, status int) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var queries []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queries = append(queries, r.URL.RawQuery)
+		fail := status > 0 && len(queries) == 1
+		mu.Unlock()
+
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		if fail {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+
+		resp := nsLeaseResponse{Namespace: "pub/seats", Number: "42"}
+		switch q := r.URL.Query(); {
+		case q.Has("reserve"):
+			resp.Token, resp.State, resp.Expires = "token-1", StateReserved, "2026-01-02T03:04:05Z"
+		case q.Has("commit"):
+			resp.State = StateCommitted
+		case q.Has("abort"):
+			resp.State = StateAborted
+		case q.Has("acquire"):
+			resp.Token, resp.State = "token-2", StateAcquired
+		case q.Has("release"):
+			resp.State = StateReleased
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), queries...)
+	}
+}
+
+func TestReserveCommit(t *testing.T) {
+	srv, queries := testLeaseServer(t, 0)
+	c := testClient(t, Config{}, srv.URL)
+
+	l, err := c.Reserve(context.Background(), "pub/seats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Number != 42 || l.ID != "42" || l.Token != "token-1" || l.State != StateReserved ||
+		!l.Expires.Equal(time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("reserve: got %+v", l)
+	}
+
+	if l, err = c.Commit(context.Background(), "pub/seats", l.Token); err != nil || l.State != StateCommitted {
+		t.Errorf("commit: got %+v %v", l, err)
+	}
+	if q := queries(); len(q) != 2 || q[1] != "commit=token-1" {
+		t.Errorf("queries: got %q", q)
+	}
+}
+
+func TestAcquireRelease(t *testing.T) {
+	srv, queries := testLeaseServer(t, 0)
+	c := testClient(t, Config{}, srv.URL)
+
+	l, err := c.Acquire(context.Background(), "pub/seats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Token != "token-2" || l.State != StateAcquired || !l.Expires.IsZero() {
+		t.Errorf("acquire: got %+v", l)
+	}
+
+	if l, err = c.Release(context.Background(), "pub/seats", l.Token); err != nil || l.State != StateReleased {
+		t.Errorf("release: got %+v %v", l, err)
+	}
+	if q := queries(); len(q) != 2 || q[1] != "release=token-2" {
+		t.Errorf("queries: got %q", q)
+	}
+}
+
+func TestLeaseRetries(t *testing.T) {
+	// a reserve that may have reached the server isn't sent again, as it
+	// could reserve a second number
+	srv, queries := testLeaseServer(t, http.StatusInternalServerError)
+	c := testClient(t, Config{}, srv.URL)
+	if _, err := c.Reserve(context.Background(), "pub/seats"); err == nil {
+		t.Error("reserve: a 500 was retried")
+	}
+	if q := queries(); len(q) != 1 {
+		t.Errorf("reserve: got %d requests, want 1", len(q))
+	}
+
+	// but one that was turned away is
+	srv, queries = testLeaseServer(t, http.StatusServiceUnavailable)
+	c = testClient(t, Config{}, srv.URL)
+	if _, err := c.Reserve(context.Background(), "pub/seats"); err != nil {
+		t.Errorf("reserve: %v", err)
+	}
+
+	// a commit gives back the same number when it's sent again
+	srv, queries = testLeaseServer(t, http.StatusInternalServerError)
+	c = testClient(t, Config{}, srv.URL)
+	if _, err := c.Commit(context.Background(), "pub/seats", "token-1"); err != nil {
+		t.Errorf("commit: %v", err)
+	}
+	if q := queries(); len(q) != 2 {
+		t.Errorf("commit: got %d requests, want 2", len(q))
+	}
+}
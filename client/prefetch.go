@@ -0,0 +1,150 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// buffer holds the prefetched numbers of a namespace
+type buffer struct {
+	mu      sync.Mutex
+	blocks  []Batch // the claimed blocks, numbers are given out from the first one
+	filling bool    // if a block is being claimed in the background
+	single  bool    // if the namespace is claimed one number at a time
+}
+
+// take gives out the next number of the buffer
+func (b *buffer) take() (Number, bool) {
+	for len(b.blocks) > 0 {
+		blk := &b.blocks[0]
+		if blk.First > blk.Last {
+			b.blocks = b.blocks[1:]
+			continue
+		}
+
+		n := Number{Namespace: blk.Namespace, Number: blk.First, ID: strconv.FormatUint(blk.First, 10)}
+		if blk.First == blk.Last {
+			n.ID = blk.LastID // a single number keeps its format
+			b.blocks = b.blocks[1:]
+		} else {
+			blk.First += blk.Step
+		}
+		return n, true
+	}
+	return Number{}, false
+}
+
+// remaining returns how many numbers are left in the buffer
+func (b *buffer) remaining() (n uint64) {
+	for _, blk := range b.blocks {
+		if blk.First <= blk.Last {
+			n += (blk.Last-blk.First)/blk.Step + 1
+		}
+	}
+	return n
+}
+
+// buffer returns the buffer of the namespace
+func (c *Client) buffer(ns string) *buffer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, ok := c.buffers[ns]
+	if !ok {
+		b = new(buffer)
+		c.buffers[ns] = b
+	}
+	return b
+}
+
+// prefetched gives out the next number of the namespace from its buffer,
+// claiming a block when the buffer is empty
+func (c *Client) prefetched(ctx context.Context, ns string) (Number, error) {
+	b := c.buffer(ns)
+	for {
+		b.mu.Lock()
+		if n, ok := b.take(); ok {
+			refill := !b.filling && b.remaining() < c.config.Prefetch/2
+			if refill {
+				b.filling = true
+			}
+			b.mu.Unlock()
+
+			if refill {
+				go c.refill(ns, b)
+			}
+			return n, nil
+		}
+		single := b.single
+		b.mu.Unlock()
+
+		if single {
+			return c.next(ctx, ns)
+		}
+
+		n, ok, err := c.fill(ctx, ns, b)
+		if err != nil || ok {
+			return n, err
+		}
+	}
+}
+
+// fill claims a block for the buffer. When the namespace can't be buffered it
+// falls back to claiming one number at a time, and gives back that number.
+func (c *Client) fill(ctx context.Context, ns string, b *buffer) (Number, bool, error) {
+	blk, err := c.Batch(ctx, ns, c.config.Prefetch)
+
+	var serr *StatusError
+	if errors.As(err, &serr) && serr.StatusCode == http.StatusBadRequest {
+		// the namespace may not take batches, i.e: an obfuscated namespace,
+		// so it's only claimed one at a time if a single claim works
+		n, err := c.next(ctx, ns)
+		if err != nil {
+			return n, true, err
+		}
+		b.mu.Lock()
+		b.single = true
+		b.mu.Unlock()
+		return n, true, nil
+	}
+	if err != nil {
+		return Number{}, true, err
+	}
+
+	// the numbers between the first and last can't be written out without
+	// the format of the namespace, so the rest of the block is left as a gap
+	if blk.FirstID != strconv.FormatUint(blk.First, 10) {
+		b.mu.Lock()
+		b.single = true
+		b.mu.Unlock()
+		return Number{Namespace: blk.Namespace, Number: blk.First, ID: blk.FirstID}, true, nil
+	}
+
+	b.mu.Lock()
+	b.blocks = append(b.blocks, blk)
+	b.mu.Unlock()
+	return Number{}, false, nil
+}
+
+// refill claims the next block of the buffer in the background, an error is
+// left for the next claim that finds the buffer empty
+func (c *Client) refill(ns string, b *buffer) {
+	defer func() {
+		b.mu.Lock()
+		b.filling = false
+		b.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.config.Retries+1)*(c.config.Timeout+maxBackoff))
+	defer cancel()
+
+	if n, ok, err := c.fill(ctx, ns, b); ok && err == nil {
+		b.mu.Lock()
+		b.blocks = append(b.blocks, Batch{Namespace: n.Namespace, First: n.Number, Last: n.Number, FirstID: n.ID, LastID: n.ID, Step: 1})
+		b.mu.Unlock()
+	}
+}
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPrefetch(t *testing.T) {
+	ts := newTestServer(t)
+
+	c := testClient(t, Config{Prefetch: 4}, ts.URL)
+	seen := make(map[uint64]bool)
+	for i := 0; i < 10; i++ {
+		n, err := c.Next(context.Background(), "pub/orders")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[n.Number] {
+			t.Fatalf("%d was given out twice", n.Number)
+		}
+		seen[n.Number] = true
+	}
+
+	// the numbers come from blocks, not a claim each
+	reqs := ts.requests()
+	if len(reqs) > 4 {
+		t.Errorf("requests: got %d for 10 numbers in blocks of 4", len(reqs))
+	}
+	for _, r := range reqs {
+		if cnt := r.URL.Query().Get("count"); cnt != "4" {
+			t.Errorf("count: got %q, want 4", cnt)
+		}
+	}
+}
+
+func TestPrefetchRefill(t *testing.T) {
+	ts := newTestServer(t)
+
+	c := testClient(t, Config{Prefetch: 4}, ts.URL)
+	for i := 0; i < 3; i++ { // the last one leaves less than half of the block
+		if _, err := c.Next(context.Background(), "pub/orders"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the next block is claimed in the background
+	b := c.buffer("pub/orders")
+	var left uint64
+	for deadline := time.Now().Add(5 * time.Second); left < 5 && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+		b.mu.Lock()
+		left = b.remaining()
+		b.mu.Unlock()
+	}
+	if left != 5 {
+		t.Errorf("remaining: got %d, want 5", left)
+	}
+}
+
+func TestPrefetchSingle(t *testing.T) {
+	var counts []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counts = append(counts, r.URL.Query().Get("count"))
+		if len(r.URL.Query().Get("count")) > 0 { // i.e: an obfuscated namespace
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(nsResponse{Namespace: "pub/orders", Number: "7"})
+	}))
+	defer srv.Close()
+
+	c := testClient(t, Config{Prefetch: 4}, srv.URL)
+	for i := 0; i < 2; i++ {
+		n, err := c.Next(context.Background(), "pub/orders")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.Number != 7 {
+			t.Errorf("got %d, want 7", n.Number)
+		}
+	}
+
+	// a batch is only asked for once, then numbers are claimed one at a time
+	if len(counts) != 3 || counts[0] != "4" || counts[1] != "" || counts[2] != "" {
+		t.Errorf("counts: got %q, want [4 \"\" \"\"]", counts)
+	}
+}
+
+func TestPrefetchFormatted(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(nsResponse{Namespace: "pub/invoices", Number: "0", Last: "3", ID: "INV-0", LastID: "INV-3"})
+	}))
+	defer srv.Close()
+
+	c := testClient(t, Config{Prefetch: 4}, srv.URL)
+	n, err := c.Next(context.Background(), "pub/invoices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.ID != "INV-0" {
+		t.Errorf("got %q, want INV-0", n.ID)
+	}
+	if b := c.buffer("pub/invoices"); !b.single || b.remaining() != 0 {
+		t.Error("a formatted block was kept, its numbers can't be written out")
+	}
+}
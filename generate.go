@@ -1,3 +1,4 @@
+//go:generate protoc -I server --go_out=server --go_opt=paths=source_relative --go-grpc_out=server --go-grpc_opt=paths=source_relative server/incrr.proto
 //go:generate go run generate.go
 //go:generate go fmt server/build.go
 //go:generate go fmt server/build_internal.go
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminSource uses the admin API of a server, which sends the changes on to
+// every other server in the pool
+type adminSource struct {
+	url    string // the admin URL of the server, i.e: https://incrr-1/admin
+	key    string
+	client *http.Client
+}
+
+// adminResponse is the JSON body sent back from the admin API
+type adminResponse struct {
+	Namespace string            `json:"namespace"`
+	Number    string            `json:"number"`
+	Options   map[string]string `json:"options"`
+	Peers     map[string]string `json:"peers"`
+}
+
+// adminNamespacesResponse is the JSON body sent back from the admin namespace listing
+type adminNamespacesResponse struct {
+	Namespaces []nsValue `json:"namespaces"`
+	NextCursor string    `json:"next_cursor"`
+}
+
+// newAdminSource returns the admin API source of the server. The key is
+// looked up in the environment, then the config, when it isn't passed in.
+func newAdminSource(config *configuration, server, key string) (*adminSource, error) {
+	if len(key) == 0 {
+		key = os.Getenv(adminKeyEnv)
+	}
+	if len(key) == 0 && len(config.Server.Admin.Keys) > 0 {
+		key = config.Server.Admin.Keys[0]
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("no admin key, use -key or $%s", adminKeyEnv)
+	}
+
+	u, err := url.Parse(server)
+	if err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+		return nil, fmt.Errorf("server %q is not a URL", server)
+	}
+
+	return &adminSource{
+		url:    strings.TrimRight(server, "/") + "/" + strings.Trim(config.Server.Admin.URL, "/"),
+		key:    key,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// do sends an admin request and decodes the JSON response into v
+func (a *adminSource) do(method, path string, form url.Values, v interface{}) error {
+	uri := a.url + path
+	var body io.Reader
+	if len(form) > 0 {
+		body = strings.NewReader(form.Encode())
+	}
+
+	req, err := http.NewRequest(method, uri, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.key)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// a change that didn't reach every server is sent back as a 502, with
+	// the result of each server in the body
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusBadGateway {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s", method, path, strings.TrimSpace(string(msg)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%s %s: json decode: %v", method, path, err)
+	}
+	return nil
+}
+
+// peers returns an error that lists the servers that didn't get a change
+func peers(results map[string]string) error {
+	var failed []string
+	for peer, result := range results {
+		if result != "ok" {
+			failed = append(failed, peer+" ("+result+")")
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("the change didn't reach %s, run it again", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// Namespaces returns a page of the namespaces from the admin listing
+func (a *adminSource) Namespaces(prefix, cursor string, limit int) ([]nsValue, string, error) {
+	query := url.Values{"prefix": {prefix}, "limit": {strconv.Itoa(limit)}}
+	if len(cursor) > 0 {
+		query.Set("cursor", cursor)
+	}
+
+	var body adminNamespacesResponse
+	if err := a.do(http.MethodGet, "/namespaces?"+query.Encode(), nil, &body); err != nil {
+		return nil, "", err
+	}
+	return body.Namespaces, body.NextCursor, nil
+}
+
+// Options returns the options set for a namespace
+func (a *adminSource) Options(ns string) (map[string]string, error) {
+	var body adminResponse
+	if err := a.do(http.MethodGet, "/options/"+ns, nil, &body); err != nil {
+		return nil, err
+	}
+	return body.Options, nil
+}
+
+// Forward moves a namespace forward to a value
+func (a *adminSource) Forward(ns string, to uint64) error {
+	var body adminResponse
+	if err := a.do(http.MethodPost, "/forward/"+ns, url.Values{"to": {strconv.FormatUint(to, 10)}}, &body); err != nil {
+		return err
+	}
+	return peers(body.Peers)
+}
+
+// Retire retires a namespace, and returns its highest value
+func (a *adminSource) Retire(ns string, recreate bool) (uint64, error) {
+	var body adminResponse
+	if err := a.do(http.MethodPost, "/retire/"+ns, url.Values{"recreate": {strconv.FormatBool(recreate)}}, &body); err != nil {
+		return 0, err
+	}
+
+	max, err := strconv.ParseUint(body.Number, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("retire %s: %v", ns, err)
+	}
+	return max, peers(body.Peers)
+}
+
+// SetOptions sets the options of a namespace
+func (a *adminSource) SetOptions(ns string, opts map[string]string) error {
+	var form = make(url.Values)
+	for name, val := range opts {
+		form.Set(name, val)
+	}
+
+	var body adminResponse
+	if err := a.do(http.MethodPost, "/options/"+ns, form, &body); err != nil {
+		return err
+	}
+	return peers(body.Peers)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// export writes each namespace that starts with the prefix, with its value
+// and options, as a line of JSON
+func export(src source, prefix string, out io.Writer) error {
+	enc := json.NewEncoder(out)
+	return eachNamespace(src, prefix, true, func(nv nsValue) error {
+		return enc.Encode(nv)
+	})
+}
+
+// importNamespaces reads the lines of an export, and sets the options then
+// forwards each namespace. A namespace that fails doesn't stop the others,
+// the failures are written out and counted in the error.
+func importNamespaces(src source, in io.Reader, out io.Writer) error {
+	var line, failed int
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		if err := importNamespace(src, scanner.Bytes()); err != nil {
+			fmt.Fprintf(out, "line %d: %v\n", line, err)
+			failed++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("import read: %v", err)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of the namespaces were not imported", failed)
+	}
+	return nil
+}
+
+// importNamespace imports a single line of an export
+func importNamespace(src source, b []byte) error {
+	var nv nsValue
+	if err := json.Unmarshal(b, &nv); err != nil {
+		return fmt.Errorf("json: %v", err)
+	}
+	if len(nv.Namespace) == 0 {
+		return fmt.Errorf("no namespace")
+	}
+
+	to, err := strconv.ParseUint(nv.Number, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%s: number is not a number & %v", nv.Namespace, err)
+	}
+
+	// the options go first, so the value is forwarded within them
+	if len(nv.Options) > 0 {
+		if err := src.SetOptions(nv.Namespace, nv.Options); err != nil {
+			return fmt.Errorf("%s: options: %v", nv.Namespace, err)
+		}
+	}
+	if err := src.Forward(nv.Namespace, to); err != nil {
+		return fmt.Errorf("%s: forward: %v", nv.Namespace, err)
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// dumpLocalDB writes each key and value of the local datastore bucket. The
+// file is the one in the config when it isn't passed in, it's opened read
+// only and can't be opened while the server has it open.
+func dumpLocalDB(config *configuration, filename string, out io.Writer) error {
+	local := config.Datastore.LocalDB.BoltDBConfig
+	if len(filename) == 0 {
+		if len(local.DSN) == 0 {
+			return fmt.Errorf("localdb needs a file, there is no local dsn in the config")
+		}
+		uri, err := url.Parse(local.DSN)
+		if err != nil {
+			return fmt.Errorf("localdb dsn: %v", err)
+		}
+		if uri.Scheme != "file" {
+			return fmt.Errorf("localdb dsn must use the file:// scheme")
+		}
+		filename = uri.Path
+	}
+
+	db, err := bolt.Open(filename, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		return fmt.Errorf("localdb %s is open, stop its server first", filename)
+	}
+	if err != nil {
+		return fmt.Errorf("localdb %s: %v", filename, err)
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(local.BucketName))
+		if b == nil {
+			return fmt.Errorf("localdb has no bucket %q", local.BucketName)
+		}
+		return b.ForEach(func(k, v []byte) error {
+			_, err := fmt.Fprintf(out, "%s\t%s\n", k, v)
+			return err
+		})
+	})
+}
@@ -0,0 +1,265 @@
+// The incrr command looks at and changes the namespaces of an incrr cluster.
+// It talks to the admin API of a server, or reads the remote datastore
+// directly using the server's TOML config file.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+const (
+	defaultAdminURL   = "/admin"
+	defaultBucketName = "incrr"
+	defaultPageLimit  = 1000
+
+	adminKeyEnv = "INCRR_ADMIN_KEY"
+)
+
+const usage = `usage: incrr [flags] <command> [arguments]
+
+The commands are:
+
+    namespaces [prefix]            lists the namespaces and their current values
+    current <namespace>            shows the current value of a namespace
+    forward <namespace> <to>       moves a namespace forward to a value
+    retire [-recreate] <namespace> retires a namespace
+    export [prefix]                writes the namespaces and their options as JSON lines
+    import [file]                  forwards the namespaces, and sets their options, from an export
+    localdb [file]                 dumps the local datastore of a stopped server
+
+The admin API is used when -server is set, otherwise the remote datastore of
+the -config file is read directly, which can't change any namespaces.
+
+The flags are:
+
+`
+
+// configuration is the part of the server config that the command uses
+type configuration struct {
+	Server struct {
+		Admin struct {
+			URL  string   `toml:"prefix"`
+			Keys []string `toml:"keys"`
+		} `toml:"admin"`
+	} `toml:"server"`
+
+	Datastore struct {
+		LocalDB struct {
+			BoltDBConfig struct {
+				DSN        string `toml:"dsn"`
+				BucketName string `toml:"bucket"`
+			} `toml:"bolt"`
+		} `toml:"local"`
+
+		UseRemoteDB   string                            `toml:"use_remote_db"`
+		RemoteOptions map[string]map[string]interface{} `toml:"remote"`
+	} `toml:"datastore"`
+}
+
+// nsValue is a namespace, its current value and its options
+type nsValue struct {
+	Namespace string            `json:"namespace"`
+	Number    string            `json:"number"`
+	Options   map[string]string `json:"options,omitempty"`
+}
+
+// source is where the namespaces are read from and changed
+type source interface {
+	// Namespaces returns a page of the namespaces that start with the prefix
+	// and come after the cursor, and the cursor of the next page
+	Namespaces(prefix, cursor string, limit int) ([]nsValue, string, error)
+	Options(ns string) (map[string]string, error)
+
+	Forward(ns string, to uint64) error
+	Retire(ns string, recreate bool) (uint64, error)
+	SetOptions(ns string, opts map[string]string) error
+}
+
+func main() {
+	var (
+		configfile = flag.String("config", "config.toml", "the server config toml location")
+		server     = flag.String("server", "", "the URL of a server to use the admin API of, i.e: https://incrr-1")
+		key        = flag.String("key", "", "the admin key, the default is $"+adminKeyEnv+" then the first key of the config")
+	)
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(*configfile, *server, *key, flag.Args(), os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "incrr: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run runs the command of the args
+func run(configfile, server, key string, args []string, in io.Reader, out io.Writer) error {
+	cmd, args := args[0], args[1:]
+
+	// the config is only needed for the remote datastore, or the file of the local one
+	config, err := loadConfiguration(configfile, len(server) > 0 || (cmd == "localdb" && len(args) > 0))
+	if err != nil {
+		return err
+	}
+
+	if cmd == "localdb" { // the local datastore is read the same way for both sources
+		if len(args) > 1 {
+			return fmt.Errorf("localdb takes at most one file")
+		}
+		return dumpLocalDB(config, first(args), out)
+	}
+
+	var src source
+	if len(server) > 0 {
+		src, err = newAdminSource(config, server, key)
+	} else {
+		src, err = newRemoteSource(config)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch cmd {
+	case "namespaces", "ls":
+		return eachNamespace(src, first(args), false, func(nv nsValue) error {
+			_, err := fmt.Fprintf(out, "%s\t%s\n", nv.Namespace, nv.Number)
+			return err
+		})
+	case "current":
+		if len(args) != 1 {
+			return fmt.Errorf("current needs a namespace")
+		}
+		nv, err := current(src, args[0])
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(out, nv.Number)
+		return err
+	case "forward":
+		if len(args) != 2 {
+			return fmt.Errorf("forward needs a namespace and a value")
+		}
+		to, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("forward value is not a number & %v", err)
+		}
+		if err := src.Forward(args[0], to); err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(out, to)
+		return err
+	case "retire":
+		fs := flag.NewFlagSet("retire", flag.ContinueOnError)
+		recreate := fs.Bool("recreate", false, "lets the namespace be claimed again, starting above its current value")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return fmt.Errorf("retire needs a namespace")
+		}
+		max, err := src.Retire(fs.Arg(0), *recreate)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(out, max)
+		return err
+	case "export":
+		return export(src, first(args), out)
+	case "import":
+		if len(args) > 1 {
+			return fmt.Errorf("import takes at most one file")
+		}
+		if len(args) == 1 && args[0] != "-" {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+		return importNamespaces(src, in, out)
+	}
+	return fmt.Errorf("unknown command %q, see incrr -h", cmd)
+}
+
+// loadConfiguration reads the server config file, when the file is optional a
+// missing file is left empty
+func loadConfiguration(filename string, optional bool) (*configuration, error) {
+	config := new(configuration)
+	if _, err := toml.DecodeFile(filename, config); err != nil {
+		if !optional || !os.IsNotExist(err) {
+			return nil, fmt.Errorf("config toml: %v", err)
+		}
+	}
+
+	if len(config.Server.Admin.URL) == 0 {
+		config.Server.Admin.URL = defaultAdminURL
+	}
+	if len(config.Datastore.LocalDB.BoltDBConfig.BucketName) == 0 {
+		config.Datastore.LocalDB.BoltDBConfig.BucketName = defaultBucketName
+	}
+	return config, nil
+}
+
+// eachNamespace calls fn with each namespace that starts with the prefix, a
+// page at a time, the options are only looked up when they're asked for
+func eachNamespace(src source, prefix string, withOptions bool, fn func(nsValue) error) error {
+	var cursor string
+	for {
+		page, next, err := src.Namespaces(prefix, cursor, defaultPageLimit)
+		if err != nil {
+			return err
+		}
+
+		for _, nv := range page {
+			if withOptions {
+				if nv.Options, err = src.Options(nv.Namespace); err != nil {
+					return err
+				}
+			}
+			if err := fn(nv); err != nil {
+				return err
+			}
+		}
+
+		if len(next) == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// current returns the namespace and its current value, the namespaces are
+// in order so the namespace itself is the first one with it as a prefix
+func current(src source, ns string) (nsValue, error) {
+	ns = strings.Trim(ns, "/")
+	page, _, err := src.Namespaces(ns, "", 1)
+	if err != nil {
+		return nsValue{}, err
+	}
+	if len(page) == 0 || page[0].Namespace != ns {
+		return nsValue{}, fmt.Errorf("namespace %s has no value, or is retired", ns)
+	}
+	return page[0], nil
+}
+
+// first returns the first arg, if there is one
+func first(args []string) string {
+	if len(args) > 0 {
+		return args[0]
+	}
+	return ""
+}
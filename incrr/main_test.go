@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testAdminServer is a fake admin API with the namespaces pub/a, pub/b and
+// pub/c, it sends at most two a page and records each forward
+func testAdminServer(t *testing.T) (*httptest.Server, map[string]string) {
+	forwards := make(map[string]string)
+	all := []nsValue{{Namespace: "pub/a", Number: "1"}, {Namespace: "pub/b", Number: "2"}, {Namespace: "pub/c", Number: "3"}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/namespaces", func(w http.ResponseWriter, r *http.Request) {
+		limit, _ := strconv.Atoi(r.FormValue("limit"))
+		if limit > 2 {
+			limit = 2
+		}
+
+		page := adminNamespacesResponse{Namespaces: []nsValue{}}
+		for _, nv := range all {
+			if !strings.HasPrefix(nv.Namespace, r.FormValue("prefix")) || nv.Namespace <= r.FormValue("cursor") {
+				continue
+			}
+			if len(page.Namespaces) == limit {
+				page.NextCursor = page.Namespaces[limit-1].Namespace
+				break
+			}
+			page.Namespaces = append(page.Namespaces, nv)
+		}
+		json.NewEncoder(w).Encode(page)
+	})
+	mux.HandleFunc("/admin/forward/", func(w http.ResponseWriter, r *http.Request) {
+		ns := strings.TrimPrefix(r.URL.Path, "/admin/forward/")
+		forwards[ns] = r.FormValue("to")
+		result := "ok"
+		if ns == "pub/down" {
+			result = "connection refused"
+		}
+		json.NewEncoder(w).Encode(adminResponse{Namespace: ns, Number: r.FormValue("to"), Peers: map[string]string{"http://incrr-2": result}})
+	})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-key" {
+			http.Error(w, "not an admin key", http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, forwards
+}
+
+func TestRunAdmin(t *testing.T) {
+	srv, forwards := testAdminServer(t)
+	config := t.TempDir() + "/missing.toml" // the config is optional with -server
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"namespaces"}, "pub/a\t1\npub/b\t2\npub/c\t3\n"},
+		{[]string{"ls", "pub/"}, "pub/a\t1\npub/b\t2\npub/c\t3\n"},
+		{[]string{"current", "pub/b"}, "2\n"},
+		{[]string{"current", "/pub/c/"}, "3\n"},
+		{[]string{"forward", "pub/a", "42"}, "42\n"},
+	} {
+		var out bytes.Buffer
+		if err := run(config, srv.URL, "test-key", tc.args, nil, &out); err != nil {
+			t.Errorf("%v: %v", tc.args, err)
+			continue
+		}
+		if out.String() != tc.want {
+			t.Errorf("%v: got %q, want %q", tc.args, out.String(), tc.want)
+		}
+	}
+	if forwards["pub/a"] != "42" {
+		t.Errorf("forward: the server got %v", forwards)
+	}
+
+	var out bytes.Buffer
+	if err := run(config, srv.URL, "test-key", []string{"forward", "pub/down", "7"}, nil, &out); err == nil || !strings.Contains(err.Error(), "run it again") {
+		t.Errorf("forward a peer missed: got %v", err)
+	}
+	if err := run(config, srv.URL, "test-key", []string{"current", "pub/nothing"}, nil, &out); err == nil {
+		t.Error("current of a missing namespace: got no error")
+	}
+	if err := run(config, srv.URL, "wrong-key", []string{"namespaces"}, nil, &out); err == nil || !strings.Contains(err.Error(), "not an admin key") {
+		t.Errorf("wrong key: got %v", err)
+	}
+}
+
+func TestRunArgs(t *testing.T) {
+	t.Setenv(adminKeyEnv, "")
+	srv, forwards := testAdminServer(t)
+	config := t.TempDir() + "/missing.toml"
+
+	for _, tc := range []struct {
+		server, key string
+		args        []string
+		want        string
+	}{
+		{srv.URL, "test-key", []string{"current"}, "current needs a namespace"},
+		{srv.URL, "test-key", []string{"current", "pub/a", "pub/b"}, "current needs a namespace"},
+		{srv.URL, "test-key", []string{"forward", "pub/a"}, "forward needs a namespace and a value"},
+		{srv.URL, "test-key", []string{"forward", "pub/a", "-1"}, "forward value is not a number"},
+		{srv.URL, "test-key", []string{"retire"}, "retire needs a namespace"},
+		{srv.URL, "test-key", []string{"retire", "-nope", "pub/a"}, "flag provided but not defined"},
+		{srv.URL, "test-key", []string{"import", "a", "b"}, "import takes at most one file"},
+		{srv.URL, "test-key", []string{"localdb", "a", "b"}, "localdb takes at most one file"},
+		{srv.URL, "test-key", []string{"claim", "pub/a"}, `unknown command "claim"`},
+		{srv.URL, "", []string{"namespaces"}, "no admin key"},
+		{"incrr-1", "test-key", []string{"namespaces"}, `server "incrr-1" is not a URL`},
+		{"", "", []string{"namespaces"}, "config toml"}, // the remote datastore needs the config
+	} {
+		var out bytes.Buffer
+		err := run(config, tc.server, tc.key, tc.args, nil, &out)
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%v: got %v, want %q", tc.args, err, tc.want)
+		}
+	}
+	if len(forwards) > 0 {
+		t.Errorf("a bad command was sent on: %v", forwards)
+	}
+}
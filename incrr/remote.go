@@ -0,0 +1,142 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/stdlib"
+)
+
+// errReadOnly is returned for the changes that can't be made to the remote
+// datastore directly, because each server keeps its own value in its local
+// datastore which would be left behind
+var errReadOnly = fmt.Errorf("the remote datastore is read only, use the admin API with -server to make changes")
+
+// remoteDrivers are the SQL drivers of the remote datastores
+var remoteDrivers = map[string]string{
+	"crdb":  "pgx",
+	"mysql": "mysql",
+}
+
+// remoteSource reads the remote datastore of the config directly, using the
+// same tables as the server
+type remoteSource struct {
+	name string // the remote datastore, i.e: crdb or mysql
+	db   *sql.DB
+}
+
+// newRemoteSource connects to the remote datastore of the config, the first
+// one in name order is used when the config doesn't pick one like the server
+func newRemoteSource(config *configuration) (*remoteSource, error) {
+	name := config.Datastore.UseRemoteDB
+	if len(name) == 0 {
+		var names []string
+		for k := range remoteDrivers {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		name = names[0]
+	}
+
+	driver, ok := remoteDrivers[name]
+	if !ok {
+		return nil, fmt.Errorf("no remoteDB by the name: %s", name)
+	}
+
+	dsn, _ := config.Datastore.RemoteOptions[name]["dsn"].(string)
+	if len(strings.TrimSpace(dsn)) == 0 {
+		return nil, fmt.Errorf("[%s] no dsn in the config", name)
+	}
+
+	db, err := sql.Open(driver, strings.TrimSpace(dsn))
+	if err != nil {
+		return nil, fmt.Errorf("[%s] connect: %v", name, err)
+	}
+	if err := db.Ping(); err != nil {
+		return nil, fmt.Errorf("[%s] ping: %v", name, err)
+	}
+	return &remoteSource{name: name, db: db}, nil
+}
+
+// query returns the SQL for the datastore, the MySQL form is written with
+// backticks and ? placeholders which CockroachDB doesn't use
+func (r *remoteSource) query(sql string) string {
+	if r.name == "mysql" {
+		return sql
+	}
+
+	sql = strings.Replace(sql, "`", "", -1)
+	for i := 1; strings.Contains(sql, "?"); i++ {
+		sql = strings.Replace(sql, "?", "$"+strconv.Itoa(i), 1)
+	}
+	return sql
+}
+
+// likePrefix returns a SQL LIKE pattern that matches everything starting
+// with the prefix, the LIKE wildcards in the prefix are escaped
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix) + "%"
+}
+
+// Namespaces returns a page of the namespaces that haven't been retired, in
+// namespace order, the cursor is the last namespace of the page before
+func (r *remoteSource) Namespaces(prefix, cursor string, limit int) (out []nsValue, next string, err error) {
+	sql := "SELECT `k`.`namespace`, MAX(`k`.`value`) FROM `keys` `k` " +
+		"LEFT JOIN `tombstones` `t` ON `t`.`namespace`=`k`.`namespace` " +
+		"WHERE `k`.`namespace` LIKE ? AND `k`.`namespace`>? " +
+		"GROUP BY `k`.`namespace` HAVING MAX(`k`.`value`) > COALESCE(MAX(`t`.`value`), -1) " +
+		"ORDER BY `k`.`namespace` LIMIT ?"
+	rows, err := r.db.Query(r.query(sql), likePrefix(prefix), cursor, limit)
+	if err != nil {
+		return nil, "", fmt.Errorf("[%s] keys page: %v", r.name, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var nv nsValue
+		var val uint64
+		if err = rows.Scan(&nv.Namespace, &val); err != nil {
+			return nil, "", fmt.Errorf("[%s] keys page row: %v", r.name, err)
+		}
+		nv.Number = strconv.FormatUint(val, 10)
+		out = append(out, nv)
+	}
+
+	if len(out) == limit {
+		next = out[len(out)-1].Namespace
+	}
+	return out, next, rows.Err()
+}
+
+// Options returns the latest value of each option set for the namespace
+func (r *remoteSource) Options(ns string) (map[string]string, error) {
+	sql := "SELECT `name`, `value` FROM `options` WHERE `namespace`=? ORDER BY `created`, `id`"
+	rows, err := r.db.Query(r.query(sql), ns)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] options: %v", r.name, err)
+	}
+	defer rows.Close()
+
+	var opts = make(map[string]string)
+	for rows.Next() {
+		var name, val string
+		if err = rows.Scan(&name, &val); err != nil {
+			return nil, fmt.Errorf("[%s] options row: %v", r.name, err)
+		}
+		opts[name] = val // the later rows win
+	}
+	return opts, rows.Err()
+}
+
+// Forward can't be done directly, see errReadOnly
+func (r *remoteSource) Forward(string, uint64) error { return errReadOnly }
+
+// Retire can't be done directly, see errReadOnly
+func (r *remoteSource) Retire(string, bool) (uint64, error) { return 0, errReadOnly }
+
+// SetOptions can't be done directly, see errReadOnly
+func (r *remoteSource) SetOptions(string, map[string]string) error { return errReadOnly }
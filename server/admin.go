@@ -0,0 +1,611 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+// adminPeerClient is the client used to send admin changes on to the
+// other servers in the groupcache pool
+var adminPeerClient = &http.Client{Timeout: 5 * time.Second}
+
+// adminBroadcastTries is how many times an admin change is sent to a server
+// before it's given up on, waiting a little longer after each try
+const adminBroadcastTries = 3
+const adminBroadcastWait = 200 * time.Millisecond
+
+// adminResponse is the JSON body sent back from the admin API, the
+// numbers are strings because JSON doesn't support uint64
+type adminResponse struct {
+	Namespace string            `json:"namespace"`
+	Number    string            `json:"number,omitempty"`
+	Peers     map[string]string `json:"peers,omitempty"` // the result of sending the change to each peer
+}
+
+// adminOptionsResponse is the JSON body sent back from the admin options API
+type adminOptionsResponse struct {
+	Namespace string            `json:"namespace"`
+	Options   map[string]string `json:"options"`
+	Cycle     string            `json:"cycle,omitempty"` // the current cycle of a namespace that wraps
+	Peers     map[string]string `json:"peers,omitempty"`
+}
+
+// adminThresholdsResponse is the JSON body sent back from the admin thresholds API
+type adminThresholdsResponse struct {
+	Namespace  string            `json:"namespace"`
+	Thresholds []adminThreshold  `json:"thresholds"`
+	Peers      map[string]string `json:"peers,omitempty"`
+}
+
+// adminThreshold is a threshold rule of a namespace
+type adminThreshold struct {
+	Threshold string `json:"threshold"`
+	URL       string `json:"url"`
+}
+
+// adminNamespacesResponse is the JSON body sent back from the admin namespace listing
+type adminNamespacesResponse struct {
+	Namespaces []adminResponse `json:"namespaces"`
+	NextCursor string          `json:"next_cursor,omitempty"` // empty when there are no more pages
+}
+
+// UseAdminKeys only lets requests through that have one of the configured admin keys
+func (web *webServer) UseAdminKeys(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := bearerToken(r)
+		if len(key) == 0 {
+			responseOnErr(w, ErrUnauthorized{errNoAPIKey})
+			return
+		}
+
+		for _, adminKey := range web.adminKeys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) == 1 {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		responseOnErr(w, ErrForbidden{errNotAdminKey})
+	})
+}
+
+// adminNamespace returns the full namespace (including the pub/ or priv/
+// prefix) from an admin request
+func adminNamespace(r *http.Request) (string, error) {
+	ns := strings.Trim(chi.URLParam(r, "*"), "/")
+	if len(ns) == 0 {
+		return "", ErrBadRequest{errNoNamespace}
+	}
+	return ns, nil
+}
+
+// formUint64 returns the named form value as a uint64
+func formUint64(r *http.Request, name string) (uint64, error) {
+	val := r.FormValue(name)
+	if len(val) == 0 {
+		return 0, ErrBadRequest{fmt.Errorf("missing the %s value", name)}
+	}
+	num, err := strconv.ParseUint(val, 10, 64)
+	if err != nil {
+		return 0, ErrBadRequest{fmt.Errorf("%s is not a number & %v", name, err)}
+	}
+	return num, nil
+}
+
+// highest returns the highest value known for a namespace from either
+// the local or remote datastore
+func (web *webServer) highest(ns string) (uint64, error) {
+	var max uint64
+
+	remB, err := web.remote.Get([]byte(ns))
+	if err != nil {
+		return 0, ErrInternalService{err}
+	}
+
+	for _, valB := range [][]byte{web.local.Get([]byte(ns)), remB} {
+		if len(valB) == 0 {
+			continue
+		}
+		val, err := strconv.ParseUint(string(valB), 10, 64)
+		if err != nil {
+			return 0, ErrInternalService{ErrParseUint64(err)}
+		}
+		if val > max {
+			max = val
+		}
+	}
+	return max, nil
+}
+
+// forward moves the namespace forward so that the next number claimed
+// will be after the value. The numbers up to the value are saved to the
+// remote DB as a single claimed range, so a server that is still behind
+// has its claims refused and skips past them, then every server in the
+// pool is told to move its local DB value forward as well
+func (web *webServer) forward(r *http.Request, ns string, to uint64) (map[string]string, error) {
+	cur, err := web.highest(ns)
+	if err != nil {
+		return nil, err
+	}
+
+	if to < cur {
+		return nil, ErrConflict{errNumLessThan}
+	}
+
+	if to > cur {
+		// the range starts after the highest number, or at it when the
+		// namespace has never claimed anything
+		first := cur + 1
+		if issued, err := web.remote.Issued(ns, cur); err != nil {
+			return nil, ErrInternalService{err}
+		} else if !issued {
+			first = cur
+		}
+
+		claimed, err := web.remote.Claim(ns, first, to)
+		if err != nil {
+			return nil, ErrInternalService{err}
+		}
+		if !claimed {
+			return nil, ErrConflict{errNumClaimed}
+		}
+	}
+
+	if err := web.localForward(ns, to); err != nil {
+		return nil, ErrInternalService{err}
+	}
+
+	return web.broadcast(r, "/local/forward/"+ns, "to="+strconv.FormatUint(to, 10)), nil
+}
+
+// localForward moves the local DB value of a namespace forward, if the
+// local value is already at or past the value, then nothing changes
+func (web *webServer) localForward(ns string, to uint64) error {
+	err := web.local.Incr([]byte(ns), []byte(strconv.FormatUint(to, 10)))
+	if err == errNumLessThan {
+		return nil
+	}
+	return err
+}
+
+// broadcast sends an admin change on to each server in the groupcache pool,
+// using the same admin key as the request. A server that doesn't take the
+// change is tried again, and the result for each server is returned so the
+// response can say which servers never got it.
+func (web *webServer) broadcast(r *http.Request, path, query string) map[string]string {
+	var results = make(map[string]string)
+	for _, peer := range web.peers {
+		if peer == web.self {
+			continue // the change was already made locally
+		}
+
+		uri := strings.TrimRight(peer, "/") + web.adminURL + path
+		if len(query) > 0 {
+			uri += "?" + query
+		}
+		for try := 1; ; try++ {
+			results[peer] = broadcastPeer(uri, r.Header.Get("Authorization"))
+			if results[peer] == "ok" || try == adminBroadcastTries {
+				break
+			}
+			log.Printf("[admin] broadcast %s: %s", peer, results[peer])
+			time.Sleep(time.Duration(try) * adminBroadcastWait)
+		}
+	}
+	return results
+}
+
+// broadcastPeer sends an admin change to a single server, it returns "ok"
+// or why the server didn't take the change
+func broadcastPeer(uri, auth string) string {
+	req, err := http.NewRequest(http.MethodPost, uri, nil)
+	if err != nil {
+		return err.Error()
+	}
+	req.Header.Set("Authorization", auth)
+
+	resp, err := adminPeerClient.Do(req)
+	if err != nil {
+		return err.Error()
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return resp.Status
+	}
+	return "ok"
+}
+
+// retire writes a tombstone for the namespace to the remote DB, then every
+// server in the pool is told to clear the namespace from its local DB. The
+// tombstone is checked when a number is saved, so a server that missed the
+// change still can't claim from the namespace.
+func (web *webServer) retire(r *http.Request, ns string, recreate bool) (uint64, map[string]string, error) {
+	max, err := web.highest(ns)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if err := web.remote.Retire(ns, tombstone{Value: max, Recreate: recreate}); err != nil {
+		return 0, nil, ErrInternalService{err}
+	}
+
+	if err := web.localRetire(ns); err != nil {
+		return 0, nil, ErrInternalService{err}
+	}
+
+	return max, web.broadcast(r, "/local/retire/"+ns, ""), nil
+}
+
+// localRetire clears a namespace from the local DB and reloads the keys
+// known by the remote DB, so the namespace is no longer reported
+func (web *webServer) localRetire(ns string) error {
+	if err := web.local.Delete([]byte(ns)); err != nil {
+		return err
+	}
+	_, err := web.remote.Keys()
+	return err
+}
+
+// AdminForwardHandler moves a namespace forward to a value, so that it
+// can be seeded from a legacy sequence. It refuses to move backwards.
+func (web *webServer) AdminForwardHandler(w http.ResponseWriter, r *http.Request) {
+	ns, err := adminNamespace(r)
+	if err != nil {
+		responseOnErr(w, err)
+		return
+	}
+
+	to, err := formUint64(r, "to")
+	if err != nil {
+		responseOnErr(w, err)
+		return
+	}
+
+	peers, err := web.forward(r, ns, to)
+	if err != nil {
+		log.Printf("[admin] forward %s: %v", ns, err)
+		responseOnErr(w, err)
+		return
+	}
+
+	responseAdminPeers(w, peers, adminResponse{Namespace: ns, Number: strconv.FormatUint(to, 10), Peers: peers})
+}
+
+// AdminLocalForwardHandler moves the local DB value of a namespace forward,
+// it is sent from the server that handled the AdminForwardHandler request
+func (web *webServer) AdminLocalForwardHandler(w http.ResponseWriter, r *http.Request) {
+	ns, err := adminNamespace(r)
+	if err != nil {
+		responseOnErr(w, err)
+		return
+	}
+
+	to, err := formUint64(r, "to")
+	if err != nil {
+		responseOnErr(w, err)
+		return
+	}
+
+	if err := web.localForward(ns, to); err != nil {
+		log.Printf("[admin] local forward %s: %v", ns, err)
+		responseOnErr(w, ErrInternalService{err})
+		return
+	}
+
+	responseAdmin(w, adminResponse{Namespace: ns, Number: strconv.FormatUint(to, 10)})
+}
+
+// AdminRetireHandler retires a namespace. With recreate=true the namespace
+// can be claimed again starting above its old highest value, otherwise
+// it can never be claimed again.
+func (web *webServer) AdminRetireHandler(w http.ResponseWriter, r *http.Request) {
+	ns, err := adminNamespace(r)
+	if err != nil {
+		responseOnErr(w, err)
+		return
+	}
+
+	recreate, _ := strconv.ParseBool(r.FormValue("recreate"))
+	max, peers, err := web.retire(r, ns, recreate)
+	if err != nil {
+		log.Printf("[admin] retire %s: %v", ns, err)
+		responseOnErr(w, err)
+		return
+	}
+
+	responseAdminPeers(w, peers, adminResponse{Namespace: ns, Number: strconv.FormatUint(max, 10), Peers: peers})
+}
+
+// AdminLocalRetireHandler clears a namespace from the local DB, it is sent
+// from the server that handled the AdminRetireHandler request
+func (web *webServer) AdminLocalRetireHandler(w http.ResponseWriter, r *http.Request) {
+	ns, err := adminNamespace(r)
+	if err != nil {
+		responseOnErr(w, err)
+		return
+	}
+
+	if err := web.localRetire(ns); err != nil {
+		log.Printf("[admin] local retire %s: %v", ns, err)
+		responseOnErr(w, ErrInternalService{err})
+		return
+	}
+
+	responseAdmin(w, adminResponse{Namespace: ns})
+}
+
+// AdminOptionsHandler returns the options set for a namespace
+func (web *webServer) AdminOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	ns, err := adminNamespace(r)
+	if err != nil {
+		responseOnErr(w, err)
+		return
+	}
+
+	opts, err := web.remote.Options(ns)
+	if err != nil {
+		log.Printf("[admin] options %s: %v", ns, err)
+		responseOnErr(w, ErrInternalService{err})
+		return
+	}
+
+	var body = adminOptionsResponse{Namespace: ns, Options: opts}
+	if opts[optOnMax] == onMaxWrap {
+		cycle, err := web.remote.Cycle(ns)
+		if err != nil {
+			log.Printf("[admin] cycle %s: %v", ns, err)
+			responseOnErr(w, ErrInternalService{err})
+			return
+		}
+		body.Cycle = strconv.FormatUint(cycle, 10)
+	}
+
+	responseAdmin(w, body)
+}
+
+// AdminSetOptionsHandler sets the options for a namespace from the form
+// values, only the options that are passed in are changed
+func (web *webServer) AdminSetOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	ns, err := adminNamespace(r)
+	if err != nil {
+		responseOnErr(w, err)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		responseOnErr(w, ErrBadRequest{err})
+		return
+	}
+
+	opts, err := web.remote.Options(ns)
+	if err != nil {
+		log.Printf("[admin] options %s: %v", ns, err)
+		responseOnErr(w, ErrInternalService{err})
+		return
+	}
+
+	var set = make(map[string]string)
+	for _, name := range nsOptionNames {
+		if _, ok := r.Form[name]; ok {
+			set[name], opts[name] = r.Form.Get(name), r.Form.Get(name)
+		}
+	}
+
+	if len(set) == 0 {
+		responseOnErr(w, ErrBadRequest{errNoOptions})
+		return
+	}
+
+	parsed, err := parseNSOptions(opts) // check that all of the options go together
+	if err != nil {
+		responseOnErr(w, ErrBadRequest{err})
+		return
+	}
+	if parsed.Obfuscate > 0 && len(web.options.secret) == 0 {
+		responseOnErr(w, ErrBadRequest{fmt.Errorf("option %s: %v", optObfuscate, errNoObfuscationKey)})
+		return
+	}
+
+	if err := web.remote.SetOptions(ns, set); err != nil {
+		log.Printf("[admin] set options %s: %v", ns, err)
+		responseOnErr(w, ErrInternalService{err})
+		return
+	}
+	web.options.Drop(ns)
+
+	peers := web.broadcast(r, "/local/options/"+ns, "")
+	responseAdminPeers(w, peers, adminOptionsResponse{Namespace: ns, Options: opts, Peers: peers})
+}
+
+// AdminLocalOptionsHandler drops the cached options of a namespace, it is
+// sent from the server that handled the AdminSetOptionsHandler request
+func (web *webServer) AdminLocalOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	ns, err := adminNamespace(r)
+	if err != nil {
+		responseOnErr(w, err)
+		return
+	}
+	web.options.Drop(ns)
+
+	responseAdmin(w, adminResponse{Namespace: ns})
+}
+
+// AdminDecodeHandler returns the sequence number of an id given out by a
+// namespace, it takes off the format and check digit and turns back the
+// obfuscation, i.e: /admin/decode/pub/invoices?id=INV-3828104213
+func (web *webServer) AdminDecodeHandler(w http.ResponseWriter, r *http.Request) {
+	ns, err := adminNamespace(r)
+	if err != nil {
+		responseOnErr(w, err)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if len(id) == 0 {
+		responseOnErr(w, ErrBadRequest{errNoID})
+		return
+	}
+
+	opts, err := web.options.Get(ns)
+	if err != nil {
+		log.Printf("[admin] decode options %s: %v", ns, err)
+		responseOnErr(w, ErrInternalService{err})
+		return
+	}
+
+	n, ok := opts.parse(id)
+	if !ok || !opts.obfuscates(n) {
+		responseOnErr(w, ErrBadRequest{errInvalidID})
+		return
+	}
+
+	responseAdmin(w, adminResponse{Namespace: ns, Number: strconv.FormatUint(opts.deobfuscate(n), 10)})
+}
+
+// AdminThresholdsHandler returns the threshold webhook rules of a namespace
+func (web *webServer) AdminThresholdsHandler(w http.ResponseWriter, r *http.Request) {
+	ns, err := adminNamespace(r)
+	if err != nil {
+		responseOnErr(w, err)
+		return
+	}
+
+	rules, err := web.remote.Thresholds(ns)
+	if err != nil {
+		log.Printf("[admin] thresholds %s: %v", ns, err)
+		responseOnErr(w, ErrInternalService{err})
+		return
+	}
+
+	var body = adminThresholdsResponse{Namespace: ns, Thresholds: []adminThreshold{}}
+	for _, rule := range rules {
+		body.Thresholds = append(body.Thresholds, adminThreshold{Threshold: strconv.FormatUint(rule.Value, 10), URL: rule.URL})
+	}
+
+	responseAdmin(w, body)
+}
+
+// AdminSetThresholdHandler sets the webhook URL for a threshold of a
+// namespace, an empty url removes the threshold
+func (web *webServer) AdminSetThresholdHandler(w http.ResponseWriter, r *http.Request) {
+	ns, err := adminNamespace(r)
+	if err != nil {
+		responseOnErr(w, err)
+		return
+	}
+
+	value, err := formUint64(r, "threshold")
+	if err != nil {
+		responseOnErr(w, err)
+		return
+	}
+
+	uri := r.FormValue("url")
+	if len(uri) > 0 {
+		if err := webhookURL(uri); err != nil {
+			responseOnErr(w, ErrBadRequest{err})
+			return
+		}
+	}
+
+	if err := web.remote.SetThreshold(threshold{Namespace: ns, Value: value, URL: uri}); err != nil {
+		log.Printf("[admin] set threshold %s: %v", ns, err)
+		responseOnErr(w, ErrInternalService{err})
+		return
+	}
+	web.hooks.Drop(ns)
+
+	body := adminThresholdsResponse{
+		Namespace:  ns,
+		Thresholds: []adminThreshold{{Threshold: strconv.FormatUint(value, 10), URL: uri}},
+		Peers:      web.broadcast(r, "/local/thresholds/"+ns, ""),
+	}
+	responseAdminPeers(w, body.Peers, body)
+}
+
+// AdminLocalThresholdsHandler drops the cached thresholds of a namespace, it is
+// sent from the server that handled the AdminSetThresholdHandler request
+func (web *webServer) AdminLocalThresholdsHandler(w http.ResponseWriter, r *http.Request) {
+	ns, err := adminNamespace(r)
+	if err != nil {
+		responseOnErr(w, err)
+		return
+	}
+	web.hooks.Drop(ns)
+
+	responseAdmin(w, adminResponse{Namespace: ns})
+}
+
+// AdminNamespacesHandler lists the namespaces with their current value. The list
+// can be filtered with a prefix and is paged using the next_cursor of the response.
+func (web *webServer) AdminNamespacesHandler(w http.ResponseWriter, r *http.Request) {
+	var limit = defaultAdminPageLimit
+	if len(r.FormValue("limit")) > 0 {
+		l, err := strconv.Atoi(r.FormValue("limit"))
+		if err != nil || l < 1 || l > maxAdminPageLimit {
+			responseOnErr(w, ErrBadRequest{fmt.Errorf("limit must be between 1 and %d", maxAdminPageLimit)})
+			return
+		}
+		limit = l
+	}
+
+	var after string
+	if cursor := r.FormValue("cursor"); len(cursor) > 0 {
+		b, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			responseOnErr(w, ErrBadRequest{errInvalidCursor})
+			return
+		}
+		after = string(b)
+	}
+
+	page, err := web.remote.KeysPage(r.FormValue("prefix"), after, limit+1) // one more to see if there is a next page
+	if err != nil {
+		log.Printf("[admin] namespaces: %v", err)
+		responseOnErr(w, ErrInternalService{err})
+		return
+	}
+
+	var body = adminNamespacesResponse{Namespaces: []adminResponse{}}
+	if len(page) > limit {
+		page = page[:limit]
+		body.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(page[limit-1].Namespace))
+	}
+	for _, nv := range page {
+		body.Namespaces = append(body.Namespaces, adminResponse{Namespace: nv.Namespace, Number: strconv.FormatUint(nv.Value, 10)})
+	}
+
+	responseAdmin(w, body)
+}
+
+// responseAdmin writes the admin response as a JSON body
+func responseAdmin(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("[admin] json encode: %v", err)
+	}
+}
+
+// responseAdminPeers writes out the JSON body of an admin change that was
+// sent on to the pool, with a 502 status if any server didn't make the
+// change, so that the change is sent again
+func responseAdminPeers(w http.ResponseWriter, peers map[string]string, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	for _, result := range peers {
+		if result != "ok" {
+			w.WriteHeader(http.StatusBadGateway)
+			break
+		}
+	}
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("[admin] json encode: %v", err)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// testAdminPost sends an admin request to the test server
+func testAdminPost(t *testing.T, srv *httptest.Server, path string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+testConfig(t).Web.adminURL+path, nil)
+	req.Header.Set("Authorization", "Bearer test-admin-key")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestClaimMissedRetire(t *testing.T) {
+	web, remote := testConfig(t).Web, testRemoteDB(t)
+	ns := testNS(t, "pub/")
+
+	if _, err := web.claim(ns, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	// the namespace is retired by another server, and this server keeps
+	// its local value because the change never reached it
+	if err := remote.Retire(ns, tombstone{Value: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := web.claim(ns, 1); err != (ErrGone{errRetired}) {
+		t.Errorf("got %v, want %v", err, errRetired)
+	}
+}
+
+func TestClaimMissedRetireRecreate(t *testing.T) {
+	web, remote := testConfig(t).Web, testRemoteDB(t)
+	ns := testNS(t, "pub/")
+
+	if _, err := web.claim(ns, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Retire(ns, tombstone{Value: 10, Recreate: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := web.claim(ns, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.First != 11 {
+		t.Errorf("got %d, want 11", c.First)
+	}
+}
+
+func TestRetireUnacknowledged(t *testing.T) {
+	web := testConfig(t).Web
+	srv := testHTTPS(t)
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}))
+	defer down.Close()
+
+	peers := web.peers
+	web.peers = []string{web.self, down.URL}
+	defer func() { web.peers = peers }()
+
+	ns := testNS(t, "pub/")
+	if _, err := web.claim(ns, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := testAdminPost(t, srv, "/retire/"+ns)
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status: got %d, want %d", resp.StatusCode, http.StatusBadGateway)
+	}
+	var body adminResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Peers[down.URL] == "ok" || len(body.Peers[down.URL]) == 0 {
+		t.Errorf("peers: got %v, want a failure for %s", body.Peers, down.URL)
+	}
+
+	// the tombstone was still written, so the namespace can't be claimed
+	if _, err := web.claim(ns, 1); err != (ErrGone{errRetired}) {
+		t.Errorf("got %v, want %v", err, errRetired)
+	}
+}
+
+func TestForwardMissedServer(t *testing.T) {
+	web := testConfig(t).Web
+	srv := testHTTPS(t)
+	ns := testNS(t, "pub/")
+
+	if _, err := web.claim(ns, 3); err != nil {
+		t.Fatal(err)
+	}
+	if resp := testAdminPost(t, srv, "/forward/"+ns+"?to=100"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("forward: got %s", resp.Status)
+	}
+
+	// a server that missed the forward is still at its old local value
+	if err := web.local.Set([]byte(ns), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	c, err := web.claim(ns, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.First != 101 {
+		t.Errorf("got %d, want 101", c.First)
+	}
+}
+
+func TestForwardRetriesPeer(t *testing.T) {
+	web := testConfig(t).Web
+	srv := testHTTPS(t)
+
+	var calls int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < adminBroadcastTries {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer flaky.Close()
+
+	peers := web.peers
+	web.peers = []string{web.self, flaky.URL}
+	defer func() { web.peers = peers }()
+
+	resp := testAdminPost(t, srv, "/forward/pub/admin/forward-retry?to=10")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status: got %s, want 200", resp.Status)
+	}
+	if calls != adminBroadcastTries {
+		t.Errorf("tries: got %d, want %d", calls, adminBroadcastTries)
+	}
+}
+
+func TestLikePrefix(t *testing.T) {
+	for _, tc := range []struct{ prefix, want string }{
+		{"", "%"},
+		{"pub/orders", "pub/orders%"},
+		{"pub/100%_off", `pub/100\%\_off%`},
+		{`pub/a\b`, `pub/a\\b%`},
+	} {
+		if got := likePrefix(tc.prefix); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.prefix, got, tc.want)
+		}
+	}
+}
+
+func TestAdminNamespacesPages(t *testing.T) {
+	web, srv := testConfig(t).Web, testHTTPS(t)
+	base := testNS(t, "pub/")
+
+	// without escaping, a%b would also match axb and a_c would match abc
+	var all []string
+	for _, name := range []string{"a%b/1", "a%b/2", "a_c/1", "abc/1", "axb/1", "z/1", "z/2"} {
+		ns := base + "/" + name
+		if _, err := web.claim(ns, 1); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, ns)
+	}
+	sort.Strings(all)
+
+	list := func(prefix string, limit int) (got []string) {
+		t.Helper()
+		var cursor string
+		for pages := 0; ; pages++ {
+			q := url.Values{"prefix": {prefix}, "limit": {strconv.Itoa(limit)}}
+			if len(cursor) > 0 {
+				q.Set("cursor", cursor)
+			}
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+web.adminURL+"/namespaces?"+q.Encode(), nil)
+			req.Header.Set("Authorization", "Bearer test-admin-key")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var body adminNamespacesResponse
+			err = json.NewDecoder(resp.Body).Decode(&body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(body.Namespaces) > limit {
+				t.Fatalf("%s: got %d namespaces in a page of %d", prefix, len(body.Namespaces), limit)
+			}
+			for _, nv := range body.Namespaces {
+				got = append(got, nv.Namespace)
+			}
+			if cursor = body.NextCursor; len(cursor) == 0 || pages > len(all) {
+				return got
+			}
+		}
+	}
+
+	if got := list(base+"/", 2); !reflect.DeepEqual(got, all) {
+		t.Errorf("pages: got %v, want %v", got, all)
+	}
+	if got := list(base+"/", 100); !reflect.DeepEqual(got, all) {
+		t.Errorf("one page: got %v, want %v", got, all)
+	}
+	if got, want := list(base+"/a%b", 1), []string{base + "/a%b/1", base + "/a%b/2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("a%%b: got %v, want %v", got, want)
+	}
+	if got, want := list(base+"/a_c", 1), []string{base + "/a_c/1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("a_c: got %v, want %v", got, want)
+	}
+	if got := list(base+"/nothing", 2); len(got) != 0 {
+		t.Errorf("nothing: got %v", got)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+web.adminURL+"/namespaces?cursor=!!", nil)
+	req.Header.Set("Authorization", "Bearer test-admin-key")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad cursor: got %d, want 400", resp.StatusCode)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/groupcache"
+)
+
+// the states of an allocator number
+const (
+	allocAcquired = "acquired"
+	allocReleased = "released"
+)
+
+// allocTries is how many released numbers are tried before a new number is
+// claimed, each try can lose to another server acquiring the number
+const allocTries = 5
+
+// allocation is a number of an allocator namespace that is held by the
+// token it was acquired with. A new number is generation 0 and each release
+// is the next generation, which the next acquire takes with its own token.
+type allocation struct {
+	Namespace          string
+	Number, Generation uint64
+	Owner              string // the SHA256 hex of the acquire token
+	Released           bool   // it was released after it was acquired with the token
+}
+
+// acquireReleased acquires the lowest released number of an allocator
+// namespace for the (hashed) token, it returns false when there are none.
+//
+// A released number is claimed with the same set-and-compare as a new number,
+// through its own groupcache group. The key holds how many times the number
+// has been released, so each release is a new key that only one server can
+// win, and the getter marks it as taken by the token in the remote DB.
+func (web *webServer) acquireReleased(ns, owner string) (c claimed, ok bool, err error) {
+	for i := 0; i < allocTries; i++ {
+		n, gen, found, err := web.remote.LowestReleased(ns)
+		if err != nil {
+			return c, false, ErrInternalService{fmt.Errorf("[alloc] lowest released: %v", err)}
+		}
+		if !found {
+			return c, false, nil
+		}
+
+		cacheCtx := &leaseContext{
+			respContext: &respContext{ServerID: web.serverID, Timestamp: strconv.FormatInt(time.Now().UnixNano(), 10)},
+			Token:       owner,
+		}
+
+		var respStr string
+		if err := web.alloc.Get(cacheCtx, fmt.Sprintf("%d:%d:%s", gen, n, ns), groupcache.StringSink(&respStr)); err != nil {
+			return c, false, ErrInternalService{fmt.Errorf("[alloc] cache response: %v", err)}
+		}
+
+		var resp respContext
+		if err := json.Unmarshal([]byte(respStr), &resp); err != nil {
+			return c, false, ErrInternalService{fmt.Errorf("[alloc] json unmarshal: %v", err)}
+		}
+
+		if cacheCtx.Equal(resp.ServerID, resp.Timestamp) && resp.Number == strconv.FormatUint(n, 10) {
+			return claimed{NS: ns, First: n, Last: n, Source: "released", resp: &resp}, true, nil
+		}
+	}
+	return c, false, nil // it's busy, so claim a new number instead
+}
+
+// acquire acquires the lowest released number of an allocator namespace,
+// or a new number when none have been released, for the token. Only the
+// token can release the number again.
+func (web *webServer) acquire(ns, token string) (claimed, error) {
+	ns, err := web.periods.namespace(ns)
+	if err != nil {
+		return claimed{}, err
+	}
+
+	opts, err := web.options.Get(ns)
+	if err != nil {
+		return claimed{}, ErrInternalService{fmt.Errorf("[alloc] options: %v", err)}
+	}
+	if !opts.Allocator {
+		return claimed{}, ErrBadRequest{errNotAllocator}
+	}
+
+	c, ok, err := web.acquireReleased(ns, hashAPIKey(token))
+	if err != nil || ok {
+		return c, err
+	}
+
+	return web.claimNew(ns, 1, hashAPIKey(token))
+}
+
+// release gives the number acquired with the token back to its allocator
+// namespace, so it's acquired again before any new number. A token can only
+// release its number once, as the number may be acquired again straight away.
+func (web *webServer) release(ns, token string) (claimed, error) {
+	a, err := web.remote.Allocation(hashAPIKey(token))
+	if err != nil {
+		return claimed{}, ErrInternalService{fmt.Errorf("[alloc] allocation: %v", err)}
+	}
+	if a == nil {
+		return claimed{}, ErrNotFound{errNoAllocation}
+	}
+	if parent, _ := splitPeriod(a.Namespace); parent != ns && a.Namespace != ns {
+		return claimed{}, ErrNotFound{errNoAllocation} // the token is for another namespace
+	}
+	if a.Released {
+		return claimed{}, ErrConflict{errAlreadyReleased}
+	}
+
+	ok, err := web.remote.Release(*a)
+	if err != nil {
+		return claimed{}, ErrInternalService{fmt.Errorf("[alloc] release: %v", err)}
+	}
+	if !ok {
+		return claimed{}, ErrConflict{errAlreadyReleased} // by another server at the same time
+	}
+
+	c := claimed{
+		NS: a.Namespace, First: a.Number, Last: a.Number,
+		resp: &respContext{ServerID: web.serverID, Timestamp: strconv.FormatInt(time.Now().UnixNano(), 10)},
+	}
+	return c, nil
+}
+
+// newAllocatorGroup sets up the groupcache group that acquires the released
+// numbers of allocator namespaces. The getter runs on the server that owns
+// the key, which takes the number in the remote DB for the token of the
+// first context that asks for it, every other context gets a response that
+// won't be equal.
+func newAllocatorGroup(config *configuration) *groupcache.Group {
+	return groupcache.NewGroup("alloc", 8<<20, groupcache.GetterFunc(func(ctxi groupcache.Context, key string, dest groupcache.Sink) error {
+		kk := strings.SplitN(key, ":", 3)
+		if len(kk) != 3 {
+			return fmt.Errorf("[groupcache]:alloc: invalid key")
+		}
+
+		gen, err := strconv.ParseUint(kk[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("[groupcache]:alloc: generation parse: %v", err)
+		}
+		n, err := strconv.ParseUint(kk[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("[groupcache]:alloc: number parse: %v", err)
+		}
+		ns := kk[2]
+
+		ctx, ok := ctxi.(*leaseContext)
+		if !ok { // a released number is only taken along with its owner
+			return dest.SetString(fmt.Sprintf(respContext{}.Meta(), kk[1]))
+		}
+
+		taken, err := config.Datastore.RemoteDB.TakeReleased(allocation{Namespace: ns, Number: n, Generation: gen, Owner: ctx.Token})
+		if err != nil {
+			return fmt.Errorf("[groupcache]:alloc: take: %v", err)
+		}
+		if !taken { // it was taken before this key was cached, i.e: it was evicted
+			return dest.SetString(fmt.Sprintf(respContext{}.Meta(), kk[1]))
+		}
+		return dest.SetString(fmt.Sprintf(ctx.Meta(), kk[1]))
+	}))
+}
@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestAllocatorReleaseNeedsToken(t *testing.T) {
+	web, remote := testConfig(t).Web, testRemoteDB(t)
+	ns := testNS(t, "pub/")
+	remote.SetOptions(ns, map[string]string{optAllocator: "true"})
+	token := func(name string) string { return ns + "/" + name } // owners are looked up by token alone
+
+	a, err := web.acquire(ns, token("token-a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := web.acquire(ns, token("token-b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Last == b.Last {
+		t.Fatalf("both tokens acquired %d", a.Last)
+	}
+
+	// only the token that acquired a number can release it
+	if _, err := web.release(ns, token("token-c")); err != (ErrNotFound{errNoAllocation}) {
+		t.Errorf("unknown token: got %v, want %v", err, errNoAllocation)
+	}
+	if _, err := web.release("pub/alloc/other", token("token-a")); err != (ErrNotFound{errNoAllocation}) {
+		t.Errorf("other namespace: got %v, want %v", err, errNoAllocation)
+	}
+	c, err := web.release(ns, token("token-a"))
+	if err != nil || c.Last != a.Last {
+		t.Fatalf("release: got %d %v, want %d", c.Last, err, a.Last)
+	}
+	if _, err := web.release(ns, token("token-a")); err != (ErrConflict{errAlreadyReleased}) {
+		t.Errorf("release again: got %v, want %v", err, errAlreadyReleased)
+	}
+
+	// the released number goes to the next token, and the old token can't
+	// release it out from under it
+	again, err := web.acquire(ns, token("token-d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Last != a.Last || again.Source != "released" {
+		t.Errorf("acquire: got %d from %q, want %d released", again.Last, again.Source, a.Last)
+	}
+	if _, err := web.release(ns, token("token-a")); err != (ErrConflict{errAlreadyReleased}) {
+		t.Errorf("old token: got %v, want %v", err, errAlreadyReleased)
+	}
+	if _, err := web.release(ns, token("token-d")); err != nil {
+		t.Errorf("new token: %v", err)
+	}
+}
+
+func TestAllocatorRefusesClaim(t *testing.T) {
+	web, remote := testConfig(t).Web, testRemoteDB(t)
+	ns := testNS(t, "pub/")
+	remote.SetOptions(ns, map[string]string{optAllocator: "true"})
+
+	if _, err := web.claim(ns, 1); err != (ErrBadRequest{errAllocatorAcquire}) {
+		t.Errorf("claim: got %v, want %v", err, errAllocatorAcquire)
+	}
+
+	// a server that still sends a plain claim has it refused by the key owner
+	if _, won, err := web.probe(ns, 0, 1, "local", ""); err != nil || won {
+		t.Errorf("probe: got won=%v %v, want refused", won, err)
+	}
+}
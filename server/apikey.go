@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// apiKeyCache holds the namespace prefixes that API keys are allowed to use,
+// the keys are looked up from the remote DB so that every server sees the
+// same keys, and then held for a short time so not every request hits the DB.
+// Only the keys that are found are held, so made up keys can't fill it.
+type apiKeyCache struct {
+	remote remoteDB
+	keys   *ttlCache
+}
+
+// newAPIKeyCache returns an API key cache using the remote DB of the config
+func newAPIKeyCache(config *configuration) *apiKeyCache {
+	ttl, err := time.ParseDuration(config.Server.API.KeyCacheTTL)
+	log.OnErr(err).Fatalf("[config] api key cache ttl: %v", err)
+
+	return &apiKeyCache{
+		remote: config.Datastore.RemoteDB,
+		keys:   newTTLCache(config.Server.API.CacheSize, ttl),
+	}
+}
+
+// hashAPIKey returns the hex SHA256 of a key, which is what is stored in the
+// remote DB so that the plain text keys are never saved
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Prefixes returns the namespace prefixes that the key is allowed to use
+func (kc *apiKeyCache) Prefixes(key string) ([]string, error) {
+	hash := hashAPIKey(key)
+
+	if cached, ok := kc.keys.Get(hash); ok {
+		return cached.([]string), nil
+	}
+
+	prefixes, err := kc.remote.APIKey(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(prefixes) > 0 {
+		kc.keys.Set(hash, prefixes)
+	}
+	return prefixes, nil
+}
+
+// Allowed returns if the key is allowed to use the namespace
+func (kc *apiKeyCache) Allowed(key, ns string) (bool, error) {
+	prefixes, err := kc.Prefixes(key)
+	if err != nil {
+		return false, err
+	}
+	for _, prefix := range prefixes {
+		if prefixAllows(prefix, ns) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// prefixAllows returns if the namespace is under the prefix, the prefix has
+// to end on a / in the namespace so priv/acme allows priv/acme/orders but
+// not priv/acme2/orders
+func prefixAllows(prefix, ns string) bool {
+	if !strings.HasPrefix(ns, prefix) {
+		return false
+	}
+	return len(ns) == len(prefix) || strings.HasSuffix(prefix, "/") || ns[len(prefix)] == '/'
+}
+
+// bearerToken returns the token from an "Authorization: Bearer <token>" header
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// UseAPIKeys only lets requests through that have an API key that is
+// allowed to use the private namespace of the request
+func (web *webServer) UseAPIKeys(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := bearerToken(r)
+		if len(key) == 0 {
+			responseOnErr(w, ErrUnauthorized{errNoAPIKey})
+			return
+		}
+
+		ns, _ := namespace("priv/", r)
+		ok, err := web.keys.Allowed(key, ns)
+		if err != nil {
+			log.Printf("[api key] %v", err)
+			responseOnErr(w, ErrInternalService{err})
+			return
+		}
+
+		if !ok {
+			responseOnErr(w, ErrForbidden{errAPIKeyNamespace})
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPrefixAllows(t *testing.T) {
+	for _, tc := range []struct {
+		prefix, ns string
+		want       bool
+	}{
+		{"priv/acme/", "priv/acme/orders", true},
+		{"priv/acme", "priv/acme/orders", true},
+		{"priv/acme", "priv/acme", true},
+		{"priv/acme", "priv/acme2/orders", false},
+		{"priv/acme", "priv/acmeorders", false},
+		{"priv/acme/orders", "priv/acme/orders/eu", true},
+		{"priv/acme/orders", "priv/acme/orders-eu", false},
+		{"priv/acme/", "priv/acme", false},
+	} {
+		if got := prefixAllows(tc.prefix, tc.ns); got != tc.want {
+			t.Errorf("%q %q: got %v, want %v", tc.prefix, tc.ns, got, tc.want)
+		}
+	}
+}
+
+func TestAPIKeyCacheMisses(t *testing.T) {
+	remote := newMemoryDB()
+	kc := &apiKeyCache{remote: remote, keys: newTTLCache(10, time.Minute)}
+
+	// an unknown key isn't held, so a key that is added is seen straight away
+	if ok, err := kc.Allowed("new-key", "priv/acme/orders"); err != nil || ok {
+		t.Fatalf("unknown key: got %v %v", ok, err)
+	}
+	if kc.keys.Len() != 0 {
+		t.Errorf("an unknown key was cached")
+	}
+
+	remote.apikeys[hashAPIKey("new-key")] = []string{"priv/acme"}
+	if ok, err := kc.Allowed("new-key", "priv/acme/orders"); err != nil || !ok {
+		t.Errorf("added key: got %v %v", ok, err)
+	}
+	if kc.keys.Len() != 1 {
+		t.Errorf("the key wasn't cached")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/groupcache/lru"
+)
+
+// ttlCache is a cache of values that are looked up from the remote DB. It
+// holds at most size entries, dropping the least recently used one when it's
+// full, so a client can't grow it by asking for many namespaces or keys. An
+// entry expires after the ttl, or is kept until it's dropped when the ttl is 0.
+type ttlCache struct {
+	sync.Mutex
+
+	ttl time.Duration
+	lru *lru.Cache
+}
+
+// ttlEntry is a cached value and when it expires
+type ttlEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// newTTLCache returns a cache of size entries that expire after the ttl
+func newTTLCache(size int, ttl time.Duration) *ttlCache {
+	return &ttlCache{ttl: ttl, lru: lru.New(size)}
+}
+
+// Get returns the cached value of the key, if there is one that hasn't expired
+func (c *ttlCache) Get(key string) (interface{}, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	v, ok := c.lru.Get(key)
+	if !ok {
+		return nil, false
+	}
+	entry := v.(ttlEntry)
+	if c.ttl > 0 && !time.Now().Before(entry.expires) {
+		c.lru.Remove(key)
+		return nil, false
+	}
+	return entry.value, true
+}
+
+// Set caches the value of the key
+func (c *ttlCache) Set(key string, value interface{}) {
+	c.Lock()
+	c.lru.Add(key, ttlEntry{value: value, expires: time.Now().Add(c.ttl)})
+	c.Unlock()
+}
+
+// Drop removes the key, so the next lookup is from the remote DB
+func (c *ttlCache) Drop(key string) {
+	c.Lock()
+	c.lru.Remove(key)
+	c.Unlock()
+}
+
+// Len returns how many entries are cached, including any that have expired
+func (c *ttlCache) Len() int {
+	c.Lock()
+	defer c.Unlock()
+	return c.lru.Len()
+}
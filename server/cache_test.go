@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLCacheBounded(t *testing.T) {
+	c := newTTLCache(2, time.Minute)
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Get("a") // a is used more recently than b
+	c.Set("c", 3)
+
+	if c.Len() != 2 {
+		t.Errorf("len: got %d, want 2", c.Len())
+	}
+	if _, ok := c.Get("b"); ok {
+		t.Error("the least recently used entry was kept")
+	}
+	if v, ok := c.Get("a"); !ok || v.(int) != 1 {
+		t.Errorf("a: got %v %v, want 1", v, ok)
+	}
+
+	c.Drop("a")
+	if _, ok := c.Get("a"); ok {
+		t.Error("a dropped entry was kept")
+	}
+}
+
+func TestTTLCacheExpires(t *testing.T) {
+	c := newTTLCache(10, 20*time.Millisecond)
+	c.Set("a", 1)
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("the entry wasn't cached")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if _, ok := c.Get("a"); ok {
+		t.Error("an expired entry was given back")
+	}
+	if c.Len() != 0 {
+		t.Errorf("len: got %d, want the expired entry removed", c.Len())
+	}
+
+	// with no ttl an entry is kept until it's pushed out
+	forever := newTTLCache(10, 0)
+	forever.Set("a", 1)
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := forever.Get("a"); !ok {
+		t.Error("an entry without a ttl expired")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+// the check digit algorithms that can be set for a namespace
+const (
+	checkLuhn     = "luhn"
+	checkDamm     = "damm"
+	checkVerhoeff = "verhoeff"
+)
+
+// dammTable is the weakly totally anti-symmetric quasigroup of order 10 used by
+// the Damm algorithm, it catches all single digit errors and adjacent swaps
+var dammTable = [10][10]byte{
+	{0, 3, 1, 7, 5, 9, 8, 6, 4, 2},
+	{7, 0, 9, 2, 1, 5, 4, 8, 6, 3},
+	{4, 2, 0, 6, 8, 7, 1, 3, 5, 9},
+	{1, 7, 5, 0, 9, 8, 3, 4, 2, 6},
+	{6, 1, 2, 3, 0, 4, 5, 9, 7, 8},
+	{3, 6, 7, 4, 2, 0, 9, 5, 8, 1},
+	{5, 8, 6, 9, 7, 2, 0, 1, 3, 4},
+	{8, 9, 4, 5, 3, 6, 2, 0, 1, 7},
+	{9, 4, 3, 8, 6, 1, 7, 2, 0, 5},
+	{2, 5, 8, 1, 4, 3, 6, 7, 9, 0},
+}
+
+// the Verhoeff multiplication (dihedral group D5), permutation and inverse tables
+var (
+	verhoeffD = [10][10]byte{
+		{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+		{1, 2, 3, 4, 0, 6, 7, 8, 9, 5},
+		{2, 3, 4, 0, 1, 7, 8, 9, 5, 6},
+		{3, 4, 0, 1, 2, 8, 9, 5, 6, 7},
+		{4, 0, 1, 2, 3, 9, 5, 6, 7, 8},
+		{5, 9, 8, 7, 6, 0, 4, 3, 2, 1},
+		{6, 5, 9, 8, 7, 1, 0, 4, 3, 2},
+		{7, 6, 5, 9, 8, 2, 1, 0, 4, 3},
+		{8, 7, 6, 5, 9, 3, 2, 1, 0, 4},
+		{9, 8, 7, 6, 5, 4, 3, 2, 1, 0},
+	}
+	verhoeffP = [8][10]byte{
+		{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+		{1, 5, 7, 6, 2, 8, 3, 0, 9, 4},
+		{5, 8, 0, 3, 7, 9, 6, 1, 4, 2},
+		{8, 9, 1, 6, 0, 4, 3, 5, 2, 7},
+		{9, 4, 5, 3, 1, 2, 6, 8, 7, 0},
+		{4, 2, 8, 6, 5, 7, 3, 9, 0, 1},
+		{2, 7, 9, 3, 8, 0, 6, 4, 1, 5},
+		{7, 0, 4, 6, 9, 1, 3, 2, 5, 8},
+	}
+	verhoeffInv = [10]byte{0, 4, 3, 2, 1, 5, 6, 7, 8, 9}
+)
+
+// checkDigit returns the check digit of the algorithm for the decimal digits,
+// the digits must only be 0-9
+func checkDigit(algo, digits string) byte {
+	switch algo {
+	case checkLuhn:
+		var sum int
+		for i := 0; i < len(digits); i++ {
+			d := int(digits[len(digits)-1-i] - '0')
+			if i%2 == 0 { // the check digit goes to the right, so the rightmost digit is doubled
+				if d *= 2; d > 9 {
+					d -= 9
+				}
+			}
+			sum += d
+		}
+		return byte('0' + (10-sum%10)%10)
+	case checkDamm:
+		var interim byte
+		for i := 0; i < len(digits); i++ {
+			interim = dammTable[interim][digits[i]-'0']
+		}
+		return '0' + interim
+	case checkVerhoeff:
+		var c byte
+		for i := 0; i < len(digits); i++ {
+			c = verhoeffD[c][verhoeffP[(i+1)%8][digits[len(digits)-1-i]-'0']]
+		}
+		return '0' + verhoeffInv[c]
+	}
+	return 0
+}
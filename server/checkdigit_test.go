@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestCheckDigit(t *testing.T) {
+	for _, tc := range []struct {
+		algo, digits string
+		want         byte
+	}{
+		{checkLuhn, "7992739871", '3'},
+		{checkLuhn, "123456781234567", '0'},
+		{checkLuhn, "453957876362148", '6'},
+		{checkLuhn, "0", '0'},
+		{checkDamm, "572", '4'},
+		{checkDamm, "0", '0'},
+		{checkVerhoeff, "236", '3'},
+		{checkVerhoeff, "12345", '1'},
+		{checkVerhoeff, "0", '4'},
+		{"", "572", 0},
+	} {
+		if got := checkDigit(tc.algo, tc.digits); got != tc.want {
+			t.Errorf("%s %s: got %q, want %q", tc.algo, tc.digits, got, tc.want)
+		}
+	}
+}
+
+func TestCheckDigitSingleErrors(t *testing.T) {
+	const digits = "7992739871"
+
+	// every algorithm catches a single digit that is wrong
+	for _, algo := range []string{checkLuhn, checkDamm, checkVerhoeff} {
+		want := checkDigit(algo, digits)
+		for i := 0; i < len(digits); i++ {
+			for d := byte('0'); d <= '9'; d++ {
+				if d == digits[i] {
+					continue
+				}
+				typo := digits[:i] + string(d) + digits[i+1:]
+				if checkDigit(algo, typo) == want {
+					t.Errorf("%s: %s has the same check digit as %s", algo, typo, digits)
+				}
+			}
+		}
+	}
+}
+
+func TestValidateHTTP(t *testing.T) {
+	web, srv := testConfig(t).Web, testHTTPS(t)
+	ns := testNS(t, "pub/")
+	testRemoteDB(t).SetOptions(ns, map[string]string{optCheck: checkLuhn})
+
+	if _, err := web.claim(ns, 13); err != nil { // 0-12
+		t.Fatal(err)
+	}
+
+	validate := func(id string) (resp nsValidateResponse) {
+		t.Helper()
+		r, err := http.Get(srv.URL + "/" + ns + ".json?validate=" + url.QueryEscape(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Body.Close()
+		if r.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(r.Body)
+			t.Fatalf("%s: got %s %s", id, r.Status, body)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	good := "12" + string(checkDigit(checkLuhn, "12"))
+	bad := "12" + string('0'+(checkDigit(checkLuhn, "12")-'0'+1)%10)
+	unclaimed := "99" + string(checkDigit(checkLuhn, "99"))
+
+	if v := validate(good); !v.Valid || !v.Issued || v.Number != "12" {
+		t.Errorf("%s: got %+v, want valid and issued", good, v)
+	}
+	if v := validate(bad); v.Valid || v.Issued {
+		t.Errorf("%s: got %+v, want the check digit refused", bad, v)
+	}
+	if v := validate(unclaimed); !v.Valid || v.Issued {
+		t.Errorf("%s: got %+v, want valid but not issued", unclaimed, v)
+	}
+	if v := validate("1x"); v.Valid {
+		t.Errorf("1x: got %+v, want it refused", v)
+	}
+
+	r, err := http.Get(srv.URL + "/" + ns + "?validate=" + bad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+	if body, _ := io.ReadAll(r.Body); string(body) != "false" {
+		t.Errorf("%s: got %q, want false", bad, body)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang/groupcache"
+)
+
+// claimTries is how many times a claim is tried before giving up, each try
+// is a single round trip through groupcache
+const claimTries = 10000
+
+// claimed holds the contiguous range of numbers claimed for a namespace
+// along with the groupcache response for the last claimed number
+type claimed struct {
+	NS          string
+	First, Last uint64
+	Source      string // where a value was read from when not claimed
+
+	FirstID, LastID string // the numbers as they are given out, see formatIDs
+
+	resp *respContext
+}
+
+// claim claims count contiguous numbers for the namespace. A namespace that
+// resets claims in its current period. A gapless namespace only gives out
+// numbers with a reservation, and an allocator namespace only with ?acquire.
+func (web *webServer) claim(ns string, count uint64) (c claimed, err error) {
+	if ns, err = web.periods.namespace(ns); err != nil {
+		return c, err
+	}
+
+	opts, err := web.options.Get(ns)
+	if err != nil {
+		return c, ErrInternalService{fmt.Errorf("[claim] options: %v", err)}
+	}
+
+	if opts.Gapless { // a number without a lease could never be given out again
+		return c, ErrBadRequest{errGaplessReserve}
+	}
+
+	if opts.Allocator { // a number without a token could never be released
+		return c, ErrBadRequest{errAllocatorAcquire}
+	}
+
+	return web.claimNew(ns, count, "")
+}
+
+// claimNew walks the SAC loop through groupcache until it has claimed count
+// contiguous numbers for the namespace. The whole range is claimed with the
+// key of its first number, and is saved by the server that owns that key,
+// so a range is a single round trip. If the key is claimed by another
+// server, then the range is started over just after it. A gapless or
+// allocator number is claimed with the hashed token that it's reserved or
+// acquired for.
+func (web *webServer) claimNew(ns string, count uint64, token string) (c claimed, err error) {
+
+	// 1. See if we have the key locally, and GET that value
+	// 2. If no key locally, see if we have the key remotely
+	// 3. Check that the value is in Groupcache, if not then the key was evicted
+	// 4. Replicas should take care of members joining and leaving the pool
+
+	var idxB, idx, hasKey = []byte{}, uint64(0), false
+	if idxB = web.local.Get([]byte(ns)); len(idxB) == 0 {
+		hasKey = web.remote.HasKey(ns)
+		if !hasKey {
+			// if we can't find the key, then we pull the latest...
+			// this should be okay because we should be looking
+			// for pretty old keys, and new keys should be in memory
+			web.remote.Keys()
+			hasKey = web.remote.HasKey(ns)
+		}
+	}
+
+	if len(idxB) > 0 {
+		hasKey = true
+		idx, err = strconv.ParseUint(string(idxB), 10, 64)
+		if err != nil {
+			return c, ErrInternalService{fmt.Errorf("[claim] strconv idx: %v", err)}
+		}
+	}
+
+	// a namespace that isn't known anywhere may have been retired, so
+	// either refuse it or start it again above where it was retired
+	if !hasKey {
+		ts, err := web.remote.Tombstone(ns)
+		if err != nil {
+			return c, ErrInternalService{fmt.Errorf("[claim] tombstone: %v", err)}
+		}
+		if ts != nil {
+			if !ts.Recreate {
+				return c, ErrGone{errRetired}
+			}
+			idx = ts.Value + 1
+		}
+	}
+
+	if count == 0 {
+		count = 1
+	}
+
+	opts, err := web.options.Get(ns)
+	if err != nil {
+		return c, ErrInternalService{fmt.Errorf("[claim] options: %v", err)}
+	}
+
+	if opts.wraps() && count > opts.size() {
+		return c, ErrBadRequest{errBatchOverCycle}
+	}
+	if opts.Obfuscate > 0 && count > 1 { // the obfuscated numbers of a range aren't a range
+		return c, ErrBadRequest{errBatchObfuscated}
+	}
+
+	// check remote if don't have local, but do remote
+	useRemote := hasKey && len(idxB) == 0
+
+	idx = opts.next(idx) // only probe numbers that are in the sequence
+	for tries := 0; tries < claimTries; tries++ {
+		// a range has to fit under the max, or within a single cycle when
+		// the sequence wraps, so the numbers given out are still contiguous
+		last, ok := opts.end(idx, count)
+		switch {
+		case !ok, opts.Max > 0 && !opts.Wrap && last > opts.Max:
+			return c, ErrConflict{errMaxReached}
+		case opts.wraps() && opts.cycle(idx) != opts.cycle(last):
+			idx = opts.cycleStart(opts.cycle(last))
+			continue
+		}
+
+		var kind = "local"
+		switch {
+		case len(token) > 0:
+			kind = "lease"
+		case count > 1:
+			kind = "batch"
+		case useRemote:
+			kind = "remote"
+		}
+
+		respCtx, won, err := web.probe(ns, idx, count, kind, token)
+		if err != nil {
+			// the server that owns the key refuses it once the namespace
+			// is retired, even when this server hasn't been told yet
+			if ts, tsErr := web.remote.Tombstone(ns); tsErr == nil && ts != nil && !ts.Recreate {
+				return c, ErrGone{errRetired}
+			}
+			return c, err
+		}
+
+		// the JSON sent back from Groupcache can "change" type, so we
+		// get the Response() back to figure out what type the response
+		// really was meant to be
+		if skip, ok := respCtx.Response().(contextSkipper); ok {
+			ctxSkipTo, err := skip.SkipTo()
+			if err != nil {
+				return c, ErrInternalService{err}
+			}
+			idx = opts.next(ctxSkipTo)
+			continue // yup, it's been considered and accepted
+		}
+		useRemote = false
+
+		if !won {
+			if idx > math.MaxUint64-opts.Step {
+				return c, ErrConflict{errMaxReached}
+			}
+			idx += opts.Step // someone else has this one, so start the range over after it
+			continue
+		}
+
+		c.NS, c.First, c.Last, c.resp = ns, idx, last, respCtx.Data()
+		if opts.wraps() {
+			web.cycles.claimed(ns, opts.cycle(c.Last))
+			c.First, c.Last = opts.number(c.First), opts.number(c.Last)
+		}
+		c.First, c.Last = opts.obfuscate(c.First), opts.obfuscate(c.Last)
+		return c, nil
+	}
+
+	return c, ErrBadRequest{errMaxIncrementRange}
+}
+
+// formatIDs writes out the claimed numbers using the format options of
+// the namespace, the numbers themselves are left as they are
+func (web *webServer) formatIDs(c *claimed) error {
+	opts, err := web.options.Get(c.NS)
+	if err != nil {
+		return ErrInternalService{fmt.Errorf("[claim] options: %v", err)}
+	}
+	c.FirstID, c.LastID = opts.format(c.First), opts.format(c.Last)
+	return nil
+}
+
+// probe does a single SAC through groupcache for the number, or the range of
+// count numbers starting at it, using a context of the kind passed in, and
+// returns if the numbers were claimed by this server. The token is only
+// used by a lease context.
+func (web *webServer) probe(ns string, idx, count uint64, kind, token string) (contextResponder, bool, error) {
+	var cacheCtx contextEqualizer
+	var respStr string
+
+	ts := strconv.FormatInt(time.Now().UnixNano(), 10)
+	switch kind {
+	case "remote":
+		cacheCtx = &remoteContext{respContext: &respContext{ServerID: web.serverID, Timestamp: ts}}
+	case "batch":
+		cacheCtx = &batchContext{respContext: &respContext{ServerID: web.serverID, Timestamp: ts}, Count: count}
+	case "lease":
+		cacheCtx = &leaseContext{respContext: &respContext{ServerID: web.serverID, Timestamp: ts}, Token: token}
+	default:
+		cacheCtx = &respContext{ServerID: web.serverID, Timestamp: ts}
+	}
+
+	// any kind of claim can be sent back a skip, when the number has already
+	// been saved by another server
+	var respCtx contextResponder = &remoteContext{respContext: &respContext{}}
+
+	if err := web.cache.Get(cacheCtx, fmt.Sprintf("%d:%s", idx, ns), groupcache.StringSink(&respStr)); err != nil {
+		return nil, false, ErrInternalService{fmt.Errorf("[claim] cache response: %v", err)}
+	}
+
+	if err := json.Unmarshal([]byte(respStr), &respCtx); err != nil {
+		return nil, false, ErrInternalService{fmt.Errorf("[claim] json unmarshal: %v", err)}
+	}
+
+	// see if we can claim a number
+	resp := respCtx.Data()
+	ctxAreEqual := cacheCtx.Equal(resp.ServerID, resp.Timestamp)
+
+	return respCtx, ctxAreEqual && resp.Number == strconv.FormatUint(idx, 10), nil
+}
+
+// batchCount returns the number of contiguous numbers asked for by
+// the request, it defaults to one number
+func (web *webServer) batchCount(r *http.Request) (uint64, error) {
+	cnt := r.URL.Query().Get("count")
+	if len(cnt) == 0 {
+		return 1, nil
+	}
+
+	count, err := strconv.ParseUint(cnt, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("count is not a number & %v", err)
+	}
+
+	if count == 0 || count > web.maxBatch {
+		return 0, fmt.Errorf("count must be between 1 and %d", web.maxBatch)
+	}
+	return count, nil
+}
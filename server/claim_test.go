@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestClaimRange(t *testing.T) {
+	web, remote := testConfig(t).Web, testRemoteDB(t)
+	ns := testNS(t, "pub/")
+
+	c, err := web.claim(ns, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.First != 0 || c.Last != 4 {
+		t.Errorf("range: got %d-%d, want 0-4", c.First, c.Last)
+	}
+
+	c, err = web.claim(ns, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.First != 5 || c.Last != 5 {
+		t.Errorf("after the range: got %d-%d, want 5-5", c.First, c.Last)
+	}
+
+	// the whole range is saved as one claim
+	remote.mu.Lock()
+	rows := remote.keys[ns]
+	remote.mu.Unlock()
+	if len(rows) != 2 || rows[0] != [2]uint64{0, 4} {
+		t.Errorf("saved claims: got %v, want [[0 4] [5 5]]", rows)
+	}
+	for n := uint64(0); n <= 5; n++ {
+		if issued, _ := remote.Issued(ns, n); !issued {
+			t.Errorf("%d was not issued", n)
+		}
+	}
+}
+
+func TestClaimSkipsSavedRange(t *testing.T) {
+	web, remote := testConfig(t).Web, testRemoteDB(t)
+	ns := testNS(t, "pub/")
+
+	if _, err := web.claim(ns, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// another server claimed a range that this server's local value is behind
+	if ok, _ := remote.Claim(ns, 1, 100); !ok {
+		t.Fatal("the range wasn't saved")
+	}
+
+	c, err := web.claim(ns, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.First != 101 || c.Last != 103 {
+		t.Errorf("got %d-%d, want 101-103", c.First, c.Last)
+	}
+}
+
+func TestClaimRangeStep(t *testing.T) {
+	web, remote := testConfig(t).Web, testRemoteDB(t)
+	ns := testNS(t, "pub/")
+	remote.SetOptions(ns, map[string]string{optStep: "10", optStart: "100"})
+
+	c, err := web.claim(ns, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.First != 100 || c.Last != 120 {
+		t.Errorf("got %d-%d, want 100-120", c.First, c.Last)
+	}
+	if issued, _ := remote.Issued(ns, 110); !issued {
+		t.Error("110 was not issued")
+	}
+}
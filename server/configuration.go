@@ -6,8 +6,10 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/go-chi/chi"
 	"github.com/njones/logger"
 )
 
@@ -19,14 +21,46 @@ const defaultHTTPSPort = ":443"
 // webServer
 const defaultHealthcheckURL = "/.healthcheck"
 const defaultPublicNSURL = "/pub/*"
+const defaultPrivateNSURL = "/priv/*"
+const defaultAPIKeyCacheTTL = "30s"
+const defaultOptionsCacheTTL = "30s"
+const defaultCacheSize = 10000
+const defaultIdempotencyHeader = "Idempotency-Key"
+const defaultIdempotencyWindow = "24h"
+const defaultWatchTimeout = "30s"
+const defaultPeriodSkew = "5s"
+const defaultLeaseTTL = "5m"
+const defaultSnowflakeURL = "/snowflake"
+const defaultSnowflakeEpoch = "2020-01-01T00:00:00Z"
+const defaultAPIMaxBatch = 5000
+const defaultSourceHeader = "Incrr-Source"
+
+// resp
+const defaultRESPPrefix = "pub/"
+
+// memcached
+const defaultMemcachedPrefix = "pub/"
+
+// webhooks
+const defaultWebhooksTimeout = "10s"
+const defaultWebhooksPollInterval = "5s"
+const defaultWebhooksMaxAttempts = 10
+
+// admin
+const defaultAdminURL = "/admin"
+const defaultAdminPageLimit = 100
+const maxAdminPageLimit = 1000
 
 // groupcache
 const defaultGroupcacheReplicas = 50
 const defaultGroupcacheBasePath = "/_groupcache/"
+const defaultGroupcacheWatchPath = "/_watch/"
 const defaultGroupcacheServer = "localhost"
 const defaultGroupcacheCtxHeaderID = "Grp-Ctx-I"
 const defaultGroupcacheCtxHeaderTS = "Grp-Ctx-T"
 const defaultGroupcacheCtxHeaderKind = "Grp-Ctx-K"
+const defaultGroupcacheCtxHeaderCount = "Grp-Ctx-C"
+const defaultGroupcacheCtxHeaderLease = "Grp-Ctx-L"
 
 // localDB
 const defaultBucketName = "incrr"
@@ -39,6 +73,12 @@ type shutdowner interface {
 	Shutdown() error
 }
 
+// listener is a server, other than the HTTP and HTTPS servers, that
+// listens on its own port
+type listener interface {
+	ListenAndServe() error
+}
+
 // serverCerts holds the private key and cert for HTTPS
 type serverCerts struct {
 	PrivateKey  string `toml:"private_key"`
@@ -58,8 +98,38 @@ type serverURLs struct {
 
 // serverSite is set up for the API website
 type serverAPI struct {
-	PublicNSURL string   `toml:"public_prefix"`
-	Domains     []string `toml:"domains"`
+	PublicNSURL  string   `toml:"public_prefix"`
+	PrivateNSURL string   `toml:"private_prefix"`
+	Domains      []string `toml:"domains"`
+	MaxBatch     uint64   `toml:"max_batch"`
+	KeyCacheTTL  string   `toml:"key_cache_ttl"` // how long API keys are cached before looking them up again
+
+	OptionsCacheTTL   string `toml:"options_cache_ttl"`  // how long namespace options are cached before looking them up again
+	CacheSize         int    `toml:"cache_size"`         // the most namespaces or API keys that each cache holds
+	IdempotencyWindow string `toml:"idempotency_window"` // how long an Idempotency-Key gives back the same numbers
+	WatchTimeout      string `toml:"watch_timeout"`      // how long a long-poll ?watch waits for a number
+	ObfuscationKey    string `toml:"obfuscation_key"`    // keys the permutation of namespaces that obfuscate their numbers
+	PeriodSkew        string `toml:"period_skew"`        // how far apart the server clocks can be around a period rollover
+	LeaseTTL          string `toml:"lease_ttl"`          // how long a reserved number is held before it can be given out again
+	SnowflakeURL      string `toml:"snowflake_url"`      // where the time sortable IDs are served
+	SnowflakeEpoch    string `toml:"snowflake_epoch"`    // the time that the snowflake milliseconds count from
+	SnowflakeNode     *int   `toml:"snowflake_node"`     // the node of this server's snowflake IDs, unique to each server
+
+	RateLimits serverRateLimits `toml:"rate_limits"`
+}
+
+// serverAdmin is set up for the admin API
+type serverAdmin struct {
+	URL  string   `toml:"prefix"`
+	Keys []string `toml:"keys"`
+}
+
+// serverWebhooks is set up for sending the threshold webhooks
+type serverWebhooks struct {
+	Secret       string `toml:"secret"` // signs the webhooks, they are not sent without it
+	Timeout      string `toml:"timeout"`
+	PollInterval string `toml:"poll_interval"` // how often the queued webhooks are checked
+	MaxAttempts  int    `toml:"max_attempts"`
 }
 
 // serverDatastores are the datastores
@@ -77,11 +147,16 @@ type configuration struct {
 	Environment string `toml:"environment"`
 	ShowConfig  bool   `toml:"show_config"` // show the config values on startup
 	Server      struct {
-		ForceHTTP bool        `toml:"force_http"`
-		API       serverAPI   `toml:"api"`
-		Certs     serverCerts `toml:"certs"`
-		Ports     serverPorts `toml:"ports"`
-		URLs      serverURLs  `toml:"urls"`
+		ForceHTTP bool             `toml:"force_http"`
+		API       serverAPI        `toml:"api"`
+		Admin     serverAdmin      `toml:"admin"`
+		Webhooks  serverWebhooks   `toml:"webhooks"`
+		GRPC      *grpcServer      `toml:"grpc"`
+		RESP      *respServer      `toml:"resp"`
+		Memcached *memcachedServer `toml:"memcached"`
+		Certs     serverCerts      `toml:"certs"`
+		Ports     serverPorts      `toml:"ports"`
+		URLs      serverURLs       `toml:"urls"`
 
 		LetsEncrypt struct {
 			Email           string   `toml:"email"`
@@ -95,8 +170,9 @@ type configuration struct {
 	Datastore  serverDatastores  `toml:"datastore"`
 
 	internal struct {
-		shutdown []shutdowner
-		metadata toml.MetaData
+		shutdown  []shutdowner
+		listeners []listener
+		metadata  toml.MetaData
 	}
 }
 
@@ -133,6 +209,9 @@ func parseConfiguration(r io.Reader) *configuration {
 	setDefaults(config)
 
 	config.Web.canServe = webCanServe(config)
+	config.Server.GRPC = setupGRPCServer(config)
+	config.Server.RESP = setupRESPServer(config)
+	config.Server.Memcached = setupMemcachedServer(config)
 
 	return config
 }
@@ -150,6 +229,55 @@ func setDefaults(config *configuration) {
 	if len(config.Server.API.PublicNSURL) == 0 {
 		config.Server.API.PublicNSURL = defaultPublicNSURL
 	}
+	if len(config.Server.API.PrivateNSURL) == 0 {
+		config.Server.API.PrivateNSURL = defaultPrivateNSURL
+	}
+	if len(config.Server.API.KeyCacheTTL) == 0 {
+		config.Server.API.KeyCacheTTL = defaultAPIKeyCacheTTL
+	}
+	if len(config.Server.API.OptionsCacheTTL) == 0 {
+		config.Server.API.OptionsCacheTTL = defaultOptionsCacheTTL
+	}
+	if config.Server.API.CacheSize <= 0 {
+		config.Server.API.CacheSize = defaultCacheSize
+	}
+	if len(config.Server.API.IdempotencyWindow) == 0 {
+		config.Server.API.IdempotencyWindow = defaultIdempotencyWindow
+	}
+	if len(config.Server.API.WatchTimeout) == 0 {
+		config.Server.API.WatchTimeout = defaultWatchTimeout
+	}
+	if len(config.Server.API.PeriodSkew) == 0 {
+		config.Server.API.PeriodSkew = defaultPeriodSkew
+	}
+	if len(config.Server.API.LeaseTTL) == 0 {
+		config.Server.API.LeaseTTL = defaultLeaseTTL
+	}
+	if len(config.Server.API.SnowflakeURL) == 0 {
+		config.Server.API.SnowflakeURL = defaultSnowflakeURL
+	}
+	config.Server.API.SnowflakeURL = "/" + strings.Trim(config.Server.API.SnowflakeURL, "/*")
+	if len(config.Server.API.SnowflakeEpoch) == 0 {
+		config.Server.API.SnowflakeEpoch = defaultSnowflakeEpoch
+	}
+	if config.Server.API.MaxBatch == 0 {
+		config.Server.API.MaxBatch = defaultAPIMaxBatch
+	}
+
+	if len(config.Server.Admin.URL) == 0 {
+		config.Server.Admin.URL = defaultAdminURL
+	}
+	config.Server.Admin.URL = "/" + strings.Trim(config.Server.Admin.URL, "/*")
+
+	if len(config.Server.Webhooks.Timeout) == 0 {
+		config.Server.Webhooks.Timeout = defaultWebhooksTimeout
+	}
+	if len(config.Server.Webhooks.PollInterval) == 0 {
+		config.Server.Webhooks.PollInterval = defaultWebhooksPollInterval
+	}
+	if config.Server.Webhooks.MaxAttempts == 0 {
+		config.Server.Webhooks.MaxAttempts = defaultWebhooksMaxAttempts
+	}
 
 	// WebServer
 	config.Web.http.shutdownFunc = &sync.Once{}
@@ -160,14 +288,90 @@ func setDefaults(config *configuration) {
 	// Groupcache
 	// See the Groupcache object for default values
 
+	config.Web.maxBatch = config.Server.API.MaxBatch
+	config.Web.keys = newAPIKeyCache(config)
+	config.Web.limits = newRateLimiter(config)
+	config.Web.options = newNSOptionsCache(config)
+	config.Web.cycles = newCycleTracker(config)
+	config.Web.periods = newPeriodTracker(config)
+
+	idemWindow, err := time.ParseDuration(config.Server.API.IdempotencyWindow)
+	log.OnErr(err).Fatalf("[config] idempotency window: %v", err)
+	if idemWindow <= 0 {
+		log.Fatalf("[config] idempotency window must be more than zero")
+	}
+	config.Web.idemWindow = idemWindow
+
+	leaseTTL, err := time.ParseDuration(config.Server.API.LeaseTTL)
+	log.OnErr(err).Fatalf("[config] lease ttl: %v", err)
+	if leaseTTL <= 0 {
+		log.Fatalf("[config] lease ttl must be more than zero")
+	}
+	config.Web.leaseTTL = leaseTTL
+	config.Web.adminURL = config.Server.Admin.URL
+	config.Web.adminKeys = config.Server.Admin.Keys
+	config.Web.self = config.Groupcache.internal.self
+	config.Web.peers = config.Groupcache.Pool
+	config.Web.watch = newWatchHub(config)
+	config.Web.http.server.RegisterOnShutdown(func() { config.Web.watch.Shutdown() }) // so open watches don't hold up a shutdown
+	config.Web.https.server.RegisterOnShutdown(func() { config.Web.watch.Shutdown() })
+	config.internal.shutdown = append(config.internal.shutdown, config.Web.watch)
+	config.Web.hooks = newWebhookSender(config)
+	config.internal.shutdown = append(config.internal.shutdown, config.Web.hooks)
+	config.Web.snowflake = newSnowflakeGen(config)
+
 	config.Web.local = config.Datastore.LocalDB   // connect the localDB to the webServer for access
 	config.Web.remote = config.Datastore.RemoteDB // connect the remoteDB to the webServer for access
+
+	go config.Web.pruneIdempotency(config.Web.https.shutdownChan)
 }
 
 func routeConfiguration(config *configuration) {
 	config.Web.http.Get(config.Server.URLs.HealthcheckURL, config.Web.HealthcheckHandler)
-	config.Web.https.With(config.Web.PublicNSHandlerCheck, config.Web.UseDomains(config.Server.API.Domains)).Get(config.Server.API.PublicNSURL, config.Web.PublicNSHandler)
-	config.Web.https.Handle(config.Groupcache.internal.pattern, config.Groupcache)
+	config.Web.https.With(config.Web.PublicNSHandlerCheck, config.Web.UseDomains(config.Server.API.Domains), config.Web.UseRateLimits("pub/")).Get(config.Server.API.PublicNSURL, config.Web.PublicNSHandler)
+	config.Web.https.With(config.Web.PublicNSHandlerCheck, config.Web.UseDomains(config.Server.API.Domains), config.Web.UseAPIKeys).Get(config.Server.API.PrivateNSURL, config.Web.PrivateNSHandler)
+	config.Web.https.With(config.Web.PublicNSHandlerCheck, config.Web.UseDomains(config.Server.API.Domains), config.Web.UseRateLimits("pub/")).Post(config.Server.API.PublicNSURL, config.Web.PublicLeaseHandler)
+	config.Web.https.With(config.Web.PublicNSHandlerCheck, config.Web.UseDomains(config.Server.API.Domains), config.Web.UseAPIKeys).Post(config.Server.API.PrivateNSURL, config.Web.PrivateLeaseHandler)
+	config.Web.https.With(config.Web.UseDomains(config.Server.API.Domains)).Get(config.Server.API.SnowflakeURL, config.Web.SnowflakeHandler)
+	config.Web.https.With(config.Web.UseDomains(config.Server.API.Domains)).Get(config.Server.API.SnowflakeURL+".json", config.Web.SnowflakeHandler)
+
+	// the groupcache path claims numbers without an API key, so it is only
+	// served to the servers in the pool, that send the peer key
+	if len(config.Groupcache.PeerKey) == 0 {
+		for _, peer := range config.Groupcache.Pool {
+			if peer != config.Groupcache.internal.self {
+				log.Fatalf("[config] a groupcache peer key must be set for a http_pool with other servers")
+			}
+		}
+		log.Warnf("no groupcache peer key is set, watches only see the numbers claimed on their own server")
+	} else {
+		config.Web.https.With(config.Web.UsePeerKey).Handle(config.Groupcache.internal.pattern, config.Groupcache)
+		config.Web.https.Route(config.Groupcache.WatchPath, func(r chi.Router) {
+			r.Use(config.Web.UsePeerKey)
+			r.Post("/subscribe", config.Web.WatchSubscribeHandler)
+			r.Post("/events", config.Web.WatchEventsHandler)
+		})
+	}
+
+	if len(config.Server.Admin.Keys) == 0 {
+		log.Warnf("no admin keys are set, the admin API is not being served")
+	} else {
+		config.Web.https.Route(config.Server.Admin.URL, func(r chi.Router) {
+			r.Use(config.Web.UseAdminKeys)
+			r.Post("/forward/*", config.Web.AdminForwardHandler)
+			r.Post("/local/forward/*", config.Web.AdminLocalForwardHandler)
+			r.Post("/retire/*", config.Web.AdminRetireHandler)
+			r.Post("/local/retire/*", config.Web.AdminLocalRetireHandler)
+			r.Get("/namespaces", config.Web.AdminNamespacesHandler)
+			r.Get("/options/*", config.Web.AdminOptionsHandler)
+			r.Post("/options/*", config.Web.AdminSetOptionsHandler)
+			r.Post("/local/options/*", config.Web.AdminLocalOptionsHandler)
+			r.Get("/decode/*", config.Web.AdminDecodeHandler)
+			r.Get("/thresholds/*", config.Web.AdminThresholdsHandler)
+			r.Post("/thresholds/*", config.Web.AdminSetThresholdHandler)
+			r.Post("/local/thresholds/*", config.Web.AdminLocalThresholdsHandler)
+		})
+	}
 }
 
 // displayConfiguration displays all of the config information
@@ -184,7 +388,39 @@ func displayConfiguration(config *configuration) {
 	display.Printf(leftpad(padd, "[config] Api Domains:", "%v"), config.Server.API.Domains)
 	display.Printf(leftpad(padd, "[config] Healthcheck URL:", "%v"), config.Server.URLs.HealthcheckURL)
 	display.Printf(leftpad(padd, "[config] PublicNS URL:", "%v"), config.Server.API.PublicNSURL)
-
+	display.Printf(leftpad(padd, "[config] PrivateNS URL:", "%v"), config.Server.API.PrivateNSURL)
+	display.Printf(leftpad(padd, "[config] Api Max Batch:", "%v"), config.Server.API.MaxBatch)
+	display.Printf(leftpad(padd, "[config] Api Key Cache TTL:", "%v"), config.Server.API.KeyCacheTTL)
+	display.Printf(leftpad(padd, "[config] Api Options Cache TTL:", "%v"), config.Server.API.OptionsCacheTTL)
+	display.Printf(leftpad(padd, "[config] Api Cache Size:", "%v"), config.Server.API.CacheSize)
+	display.Printf(leftpad(padd, "[config] Api Idempotency Window:", "%v"), config.Server.API.IdempotencyWindow)
+	display.Printf(leftpad(padd, "[config] Api Watch Timeout:", "%v"), config.Server.API.WatchTimeout)
+	display.Printf(leftpad(padd, "[config] Api Obfuscation Key:", "%v"), len(config.Server.API.ObfuscationKey) > 0)
+	display.Printf(leftpad(padd, "[config] Api Period Skew:", "%v"), config.Server.API.PeriodSkew)
+	display.Printf(leftpad(padd, "[config] Api Lease TTL:", "%v"), config.Server.API.LeaseTTL)
+	display.Printf(leftpad(padd, "[config] Snowflake URL:", "%v"), config.Server.API.SnowflakeURL)
+	display.Printf(leftpad(padd, "[config] Snowflake Epoch:", "%v"), config.Server.API.SnowflakeEpoch)
+	display.Printf(leftpad(padd, "[config] Snowflake Node:", "%v"), config.Web.snowflake.node)
+	display.Printf(leftpad(padd, "[config] Api Rate Limit IP:", "%v"), config.Server.API.RateLimits.IP)
+	display.Printf(leftpad(padd, "[config] Api Rate Limit Domain:", "%v"), config.Server.API.RateLimits.Domain)
+	display.Printf(leftpad(padd, "[config] Api Rate Limit Namespace:", "%v"), config.Server.API.RateLimits.Namespace)
+	display.Printf(leftpad(padd, "[config] Api Rate Limit X-Fwd-For:", "%v"), config.Server.API.RateLimits.ForwardedFor)
+	display.Printf(leftpad(padd, "[config] Admin URL:", "%v"), config.Server.Admin.URL)
+	display.Printf(leftpad(padd, "[config] Admin Keys:", "%v"), len(config.Server.Admin.Keys))
+	display.Printf(leftpad(padd, "[config] Webhooks Secret:", "%v"), len(config.Server.Webhooks.Secret) > 0)
+	display.Printf(leftpad(padd, "[config] Webhooks Timeout:", "%v"), config.Server.Webhooks.Timeout)
+	display.Printf(leftpad(padd, "[config] Webhooks Poll Interval:", "%v"), config.Server.Webhooks.PollInterval)
+	display.Printf(leftpad(padd, "[config] Webhooks Max Attempts:", "%v"), config.Server.Webhooks.MaxAttempts)
+
+	if config.Server.GRPC != nil {
+		config.Server.GRPC.configDisplay(padd, config)
+	}
+	if config.Server.RESP != nil {
+		config.Server.RESP.configDisplay(padd, config)
+	}
+	if config.Server.Memcached != nil {
+		config.Server.Memcached.configDisplay(padd, config)
+	}
 	if disp, ok := interface{}(config.Groupcache).(configDisplay); ok {
 		disp.configDisplay(padd, config)
 	}
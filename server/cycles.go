@@ -0,0 +1,49 @@
+package main
+
+import "sync"
+
+// cycleTracker records each new cycle of a wrapping namespace in the remote
+// DB, the latest cycles that have already been recorded are kept so that a
+// claim only goes to the remote DB when a namespace wraps
+type cycleTracker struct {
+	sync.Mutex
+
+	remote remoteDB
+	seen   *ttlCache // the latest cycle of each namespace
+}
+
+// newCycleTracker returns a cycle tracker using the remote DB of the config
+func newCycleTracker(config *configuration) *cycleTracker {
+	return &cycleTracker{
+		remote: config.Datastore.RemoteDB,
+		seen:   newTTLCache(config.Server.API.CacheSize, 0),
+	}
+}
+
+// latest returns the latest cycle recorded for the namespace, a namespace
+// that was dropped from the cache is recorded again on its next claim
+func (ct *cycleTracker) latest(ns string) uint64 {
+	if cycle, ok := ct.seen.Get(ns); ok {
+		return cycle.(uint64)
+	}
+	return 0
+}
+
+// claimed records the cycle of a claimed number if it's new, a failed
+// record is logged and tried again on the next claim
+func (ct *cycleTracker) claimed(ns string, cycle uint64) {
+	if cycle <= ct.latest(ns) {
+		return // the first cycle is never recorded
+	}
+
+	if err := ct.remote.SetCycle(ns, cycle); err != nil {
+		log.Printf("[cycle] %s %d: %v", ns, cycle, err)
+		return
+	}
+
+	ct.Lock()
+	if cycle > ct.latest(ns) {
+		ct.seen.Set(ns, cycle)
+	}
+	ct.Unlock()
+}
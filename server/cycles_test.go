@@ -0,0 +1,95 @@
+package main
+
+import "testing"
+
+func TestClaimWrap(t *testing.T) {
+	web, remote := testConfig(t).Web, testRemoteDB(t)
+	ns := testNS(t, "pub/")
+	remote.SetOptions(ns, map[string]string{optStart: "1", optMax: "3", optOnMax: onMaxWrap})
+
+	for i, want := range []uint64{1, 2, 3, 1, 2, 3, 1} {
+		c, err := web.claim(ns, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.First != want {
+			t.Errorf("claim %d: got %d, want %d", i, c.First, want)
+		}
+	}
+	if cycle, err := remote.Cycle(ns); err != nil || cycle != 2 {
+		t.Errorf("cycle: got %d %v, want 2", cycle, err)
+	}
+}
+
+func TestClaimWrapBatch(t *testing.T) {
+	web, remote := testConfig(t).Web, testRemoteDB(t)
+	ns := testNS(t, "pub/")
+	remote.SetOptions(ns, map[string]string{optStep: "10", optMax: "20", optOnMax: onMaxWrap}) // 0, 10, 20
+
+	if _, err := web.claim(ns, 4); err != (ErrBadRequest{errBatchOverCycle}) {
+		t.Errorf("count over the cycle: got %v, want %v", err, errBatchOverCycle)
+	}
+
+	c, err := web.claim(ns, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.First != 0 || c.Last != 10 {
+		t.Errorf("batch: got %d-%d, want 0-10", c.First, c.Last)
+	}
+
+	// a batch is never split by the max, it starts again in the next cycle
+	if c, err = web.claim(ns, 2); err != nil {
+		t.Fatal(err)
+	}
+	if c.First != 0 || c.Last != 10 {
+		t.Errorf("batch past the max: got %d-%d, want 0-10", c.First, c.Last)
+	}
+	if cycle, err := remote.Cycle(ns); err != nil || cycle != 1 {
+		t.Errorf("cycle: got %d %v, want 1", cycle, err)
+	}
+
+	if c, err = web.claim(ns, 3); err != nil {
+		t.Fatal(err)
+	}
+	if c.First != 0 || c.Last != 20 {
+		t.Errorf("whole cycle: got %d-%d, want 0-20", c.First, c.Last)
+	}
+}
+
+func TestClaimRefuseAtMax(t *testing.T) {
+	web, remote := testConfig(t).Web, testRemoteDB(t)
+	ns := testNS(t, "pub/")
+	remote.SetOptions(ns, map[string]string{optMax: "2"})
+
+	if _, err := web.claim(ns, 4); err != (ErrConflict{errMaxReached}) {
+		t.Errorf("batch past the max: got %v, want %v", err, errMaxReached)
+	}
+	for want := uint64(0); want <= 2; want++ {
+		c, err := web.claim(ns, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.First != want {
+			t.Errorf("claim: got %d, want %d", c.First, want)
+		}
+	}
+	if _, err := web.claim(ns, 1); err != (ErrConflict{errMaxReached}) {
+		t.Errorf("claim past the max: got %v, want %v", err, errMaxReached)
+	}
+}
+
+func TestCycleTracker(t *testing.T) {
+	remote := newMemoryDB()
+	ct := &cycleTracker{remote: remote, seen: newTTLCache(10, 0)}
+
+	ct.claimed("pub/cycles", 0) // the first cycle is never recorded
+	if cycle, _ := remote.Cycle("pub/cycles"); cycle != 0 {
+		t.Errorf("first cycle: got %d, want 0", cycle)
+	}
+	ct.claimed("pub/cycles", 3)
+	ct.claimed("pub/cycles", 2) // a claim that was slow to finish doesn't move it back
+	if cycle, _ := remote.Cycle("pub/cycles"); cycle != 3 || ct.latest("pub/cycles") != 3 {
+		t.Errorf("cycle: got %d (latest %d), want 3", cycle, ct.latest("pub/cycles"))
+	}
+}
@@ -21,6 +21,27 @@ type (
 
 	// ErrBadRequest initiates the HTTP Bad Request Error behavior
 	ErrBadRequest struct{ errErr }
+
+	// ErrNotFound initiates the HTTP Not Found Error behavior
+	ErrNotFound struct{ errErr }
+
+	// ErrUnauthorized initiates the HTTP Unauthorized Error behavior
+	ErrUnauthorized struct{ errErr }
+
+	// ErrForbidden initiates the HTTP Forbidden Error behavior
+	ErrForbidden struct{ errErr }
+
+	// ErrConflict initiates the HTTP Conflict Error behavior
+	ErrConflict struct{ errErr }
+
+	// ErrGone initiates the HTTP Gone Error behavior
+	ErrGone struct{ errErr }
+
+	// ErrTooManyRequests initiates the HTTP Too Many Requests Error behavior
+	ErrTooManyRequests struct{ errErr }
+
+	// ErrServiceUnavailable initiates the HTTP Service Unavailable Error behavior
+	ErrServiceUnavailable struct{ errErr }
 )
 
 // Error satisfies the error interface
@@ -35,3 +56,54 @@ func (e ErrBadRequest) Error() string {
 const errNumLessThan errStr = "the number was not incremented"
 const errMaxIncrementRange errStr = "exhausted max number increments"
 const errSkipNilValue errStr = "nil Skip value"
+const errNoNamespaceValue errStr = "the namespace has no value"
+const errNoAPIKey errStr = "no API key"
+const errAPIKeyNamespace errStr = "the API key is not allowed for the namespace"
+const errNotAdminKey errStr = "not an admin key"
+const errNoNamespace errStr = "no namespace"
+const errNumClaimed errStr = "the number has already been claimed"
+const errRetired errStr = "the namespace has been retired"
+const errZeroStep errStr = "the step must be more than zero"
+const errNoOptions errStr = "no options were set"
+const errIdemKeyTooLong errStr = "the idempotency key is too long"
+const errInvalidCursor errStr = "invalid cursor"
+const errRESPProtocol errStr = "Protocol error"
+const errInvalidKey errStr = "invalid key"
+const errNotPeer errStr = "not a server in the groupcache pool"
+const errNoPeerContext errStr = "the claim has no groupcache context"
+const errNoStreaming errStr = "streaming is not supported"
+const errOnMax errStr = "must be refuse or wrap"
+const errMaxBelowStart errStr = "the max must not be less than the start"
+const errStepRange errStr = "the step after the start must not go past 9223372036854775807"
+const errNumberRange errStr = "must not be more than 9223372036854775807"
+const errMaxReached errStr = "the namespace has reached its max"
+const errBatchOverCycle errStr = "the count is more than the numbers between the start and max"
+const errPad errStr = "must be between 0 and 64"
+const errAffixTooLong errStr = "must be 64 characters or less"
+const errBase errStr = "must be 10, 36 or 62"
+const errInvalidBase62 errStr = "not a base62 number"
+const errCheck errStr = "must be luhn, damm or verhoeff"
+const errCheckBase errStr = "can only be used with base 10"
+const errObfuscateBits errStr = "must be an even number between 16 and 64"
+const errObfuscateMax errStr = "must fit in the obfuscate bit width"
+const errNoObfuscationKey errStr = "no obfuscation key is set"
+const errBatchObfuscated errStr = "obfuscated numbers can only be claimed one at a time"
+const errInvalidID errStr = "the id is not valid for the namespace"
+const errClockBackwards errStr = "the clock went back"
+const errSnowflakeEpoch errStr = "the snowflake epoch is too far in the past"
+const errReset errStr = "must be daily, monthly or yearly"
+const errGaplessReserve errStr = "gapless numbers can only be given out with ?reserve"
+const errNotGapless errStr = "numbers can only be reserved in a gapless namespace"
+const errNoLeaseAction errStr = "one of reserve, commit, abort, acquire or release is needed"
+const errNoLease errStr = "no reserved number was found for the token"
+const errLeaseEnded errStr = "the reserved number has already been committed or aborted"
+const errLeaseExpired errStr = "the lease of the reserved number has expired"
+const errAllocatorAcquire errStr = "allocator numbers can only be given out with ?acquire"
+const errAllocatorMode errStr = "can't be used with gapless, obfuscate or on_max=wrap"
+const errNotAllocator errStr = "numbers can only be acquired and released in an allocator namespace"
+const errNoAllocation errStr = "no acquired number was found for the token"
+const errAlreadyReleased errStr = "the number has already been released"
+const errNoID errStr = "the id is missing"
+const errRateLimited errStr = "too many requests"
+const errWebhookURL errStr = "the url must be an absolute http or https URL"
+const errLineTooLong errStr = "the line is too long"
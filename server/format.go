@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// maxFormatLen is the most padding, or characters of a prefix or suffix
+const maxFormatLen = 64
+
+// base62Digits are the digits of a base62 number, in ASCII order so
+// that numbers of the same length sort the same as their values
+const base62Digits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// formatBase62 returns the base62 string of the number
+func formatBase62(n uint64) string {
+	if n == 0 {
+		return "0"
+	}
+
+	var buf [11]byte // the most base62 digits a uint64 can need
+	i := len(buf)
+	for n > 0 {
+		i--
+		buf[i] = base62Digits[n%62]
+		n /= 62
+	}
+	return string(buf[i:])
+}
+
+// parseBase62 returns the number of a base62 string
+func parseBase62(s string) (uint64, error) {
+	var n uint64
+	for i := 0; i < len(s); i++ {
+		d := strings.IndexByte(base62Digits, s[i])
+		if d < 0 {
+			return 0, errInvalidBase62
+		}
+		if n > (math.MaxUint64-uint64(d))/62 {
+			return 0, errInvalidBase62
+		}
+		n = n*62 + uint64(d)
+	}
+	return n, nil
+}
+
+// format returns the number as it's given out for the namespace, i.e: with
+// a prefix of "ORD-" and a pad of 6 then 123 is written as ORD-000123
+func (o nsOptions) format(n uint64) string {
+	var s string
+	switch o.Base {
+	case 36:
+		s = strconv.FormatUint(n, 36)
+	case 62:
+		s = formatBase62(n)
+	default:
+		s = strconv.FormatUint(n, 10)
+	}
+
+	if pad := o.Pad - len(s); pad > 0 {
+		s = strings.Repeat("0", pad) + s
+	}
+	if len(o.Check) > 0 { // worked out from the number without padding, as leading zeros change a Verhoeff digit
+		s += string(checkDigit(o.Check, strconv.FormatUint(n, 10)))
+	}
+	return o.Prefix + s + o.Suffix
+}
+
+// parse returns the number of an id written out by format, it returns
+// false if the id isn't in the format of the namespace or the check
+// digit doesn't match
+func (o nsOptions) parse(id string) (uint64, bool) {
+	if !strings.HasPrefix(id, o.Prefix) || !strings.HasSuffix(id, o.Suffix) ||
+		len(id) < len(o.Prefix)+len(o.Suffix) {
+		return 0, false
+	}
+	s := id[len(o.Prefix) : len(id)-len(o.Suffix)]
+
+	var check byte
+	if len(o.Check) > 0 {
+		if len(s) < 2 {
+			return 0, false
+		}
+		s, check = s[:len(s)-1], s[len(s)-1]
+	}
+	if len(s) == 0 || (o.Pad > 0 && len(s) < o.Pad) {
+		return 0, false
+	}
+
+	var n uint64
+	var err error
+	switch o.Base {
+	case 36:
+		if strings.ToLower(s) != s { // base36 is written out in lowercase only
+			return 0, false
+		}
+		n, err = strconv.ParseUint(s, 36, 64)
+	case 62:
+		n, err = parseBase62(s)
+	default:
+		n, err = strconv.ParseUint(s, 10, 64)
+	}
+	if err != nil {
+		return 0, false
+	}
+
+	if len(o.Check) > 0 && checkDigit(o.Check, strconv.FormatUint(n, 10)) != check {
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestNSOptionsFormat(t *testing.T) {
+	for _, tc := range []struct {
+		raw  map[string]string
+		n    uint64
+		want string
+	}{
+		{map[string]string{}, 123, "123"},
+		{map[string]string{optPad: "6"}, 123, "000123"},
+		{map[string]string{optPad: "2"}, 123, "123"}, // a number longer than the pad is never cut
+		{map[string]string{optPad: "64"}, 1, strings.Repeat("0", 63) + "1"},
+		{map[string]string{optPrefix: "ORD-"}, 123, "ORD-123"},
+		{map[string]string{optSuffix: "-EU"}, 123, "123-EU"},
+		{map[string]string{optPrefix: "ORD-", optSuffix: "-EU", optPad: "6"}, 123, "ORD-000123-EU"},
+		{map[string]string{optBase: "36"}, 123, "3f"},
+		{map[string]string{optBase: "36", optPad: "4"}, 123, "003f"},
+		{map[string]string{optBase: "62"}, 123, "1z"},
+		{map[string]string{optBase: "62"}, 61, "z"},
+		{map[string]string{optBase: "62"}, 62, "10"},
+		{map[string]string{optBase: "62"}, 0, "0"},
+		{map[string]string{optCheck: checkLuhn}, 7992739871, "79927398713"},
+		{map[string]string{optCheck: checkDamm, optPad: "5"}, 572, "005724"},
+		{map[string]string{optCheck: checkVerhoeff, optPrefix: "V"}, 236, "V2363"},
+		{map[string]string{}, math.MaxUint64, "18446744073709551615"},
+		{map[string]string{optBase: "36"}, math.MaxUint64, "3w5e11264sgsf"},
+		{map[string]string{optBase: "62"}, math.MaxUint64, "LygHa16AHYF"},
+	} {
+		opts, err := parseNSOptions(tc.raw)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.raw, err)
+		}
+		got := opts.format(tc.n)
+		if got != tc.want {
+			t.Errorf("%v %d: got %s, want %s", tc.raw, tc.n, got, tc.want)
+		}
+		if n, ok := opts.parse(got); !ok || n != tc.n {
+			t.Errorf("%v %s: parsed %d %v, want %d", tc.raw, got, n, ok, tc.n)
+		}
+	}
+}
+
+func TestNSOptionsParseRefused(t *testing.T) {
+	for _, tc := range []struct {
+		raw map[string]string
+		id  string
+	}{
+		{map[string]string{optPrefix: "ORD-"}, "INV-123"},
+		{map[string]string{optSuffix: "-EU"}, "123-US"},
+		{map[string]string{optPrefix: "ORD-"}, "ORD-"},
+		{map[string]string{optPad: "6"}, "123"}, // written out with less than the pad
+		{map[string]string{}, "12a"},
+		{map[string]string{}, "18446744073709551616"},
+		{map[string]string{optBase: "36"}, "3F"}, // base36 is only lowercase
+		{map[string]string{optBase: "62"}, "LygHa16AHYG"},
+		{map[string]string{optBase: "62"}, "1-"},
+		{map[string]string{optCheck: checkLuhn}, "79927398710"},
+		{map[string]string{optCheck: checkLuhn}, "3"},
+	} {
+		opts, err := parseNSOptions(tc.raw)
+		if err != nil {
+			t.Fatalf("%v: %v", tc.raw, err)
+		}
+		if n, ok := opts.parse(tc.id); ok {
+			t.Errorf("%v %s: parsed %d, want it refused", tc.raw, tc.id, n)
+		}
+	}
+}
+
+func TestParseNSOptionsFormat(t *testing.T) {
+	long := strings.Repeat("x", maxFormatLen+1)
+
+	for name, tc := range map[string]struct {
+		raw  map[string]string
+		want string
+	}{
+		"negative pad":     {map[string]string{optPad: "-1"}, "option pad: " + errPad.Error()},
+		"pad over 64":      {map[string]string{optPad: "65"}, "option pad: " + errPad.Error()},
+		"long prefix":      {map[string]string{optPrefix: long}, "option prefix: " + errAffixTooLong.Error()},
+		"long suffix":      {map[string]string{optSuffix: long}, "option suffix: " + errAffixTooLong.Error()},
+		"base 16":          {map[string]string{optBase: "16"}, "option base: " + errBase.Error()},
+		"unknown check":    {map[string]string{optCheck: "mod11"}, "option check: " + errCheck.Error()},
+		"check on base 36": {map[string]string{optCheck: checkLuhn, optBase: "36"}, "option check: " + errCheckBase.Error()},
+	} {
+		_, err := parseNSOptions(tc.raw)
+		if err == nil || err.Error() != tc.want {
+			t.Errorf("%s: got %v, want %q", name, err, tc.want)
+		}
+	}
+}
+
+func TestNSOptionsPeriodFormat(t *testing.T) {
+	web, remote := testConfig(t).Web, testRemoteDB(t)
+	ns := testNS(t, "pub/")
+	remote.SetOptions(ns, map[string]string{optReset: resetMonthly, optPrefix: "{period}/", optPad: "3"})
+
+	opts, err := web.options.Get(ns + periodSep + "202610")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := opts.format(7); got != "2026-10/007" {
+		t.Errorf("got %s, want 2026-10/007", got)
+	}
+}
@@ -6,21 +6,26 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang/groupcache"
 )
 
 // groupcacheServer holds the groupcache configuration information
 type groupcacheServer struct {
-	Server   string   `toml:"self"`
-	Replicas int      `toml:"replicas"`
-	Pool     []string `toml:"http_pool"`
-	BasePath string   `toml:"base_path"`
+	Server    string   `toml:"self"`
+	Replicas  int      `toml:"replicas"`
+	Pool      []string `toml:"http_pool"`
+	BasePath  string   `toml:"base_path"`
+	WatchPath string   `toml:"watch_path"` // where the servers send each other the numbers claimed in watched namespaces
+	PeerKey   string   `toml:"peer_key"`   // the shared secret the servers send each other on the groupcache and watch paths
 
 	Header struct {
 		ID        string `toml:"id"`
 		Timestamp string `toml:"ts"`
 		Kind      string
+		Count     string
+		Lease     string
 	} `toml:"header"`
 
 	*groupcache.HTTPPool
@@ -39,6 +44,8 @@ func (gs *groupcacheServer) configDisplay(padd int, config *configuration) {
 	display.Printf(leftpad(padd, "[config] Groupcache Replicas:", "%v"), gs.Replicas)
 	display.Printf(leftpad(padd, "[config] Groupcache Pool:", "%v"), gs.Pool)
 	display.Printf(leftpad(padd, "[config] Groupcache BasePath:", "%v"), gs.BasePath)
+	display.Printf(leftpad(padd, "[config] Groupcache WatchPath:", "%v"), gs.WatchPath)
+	display.Printf(leftpad(padd, "[config] Groupcache Peer Key:", "%v"), len(gs.PeerKey) > 0)
 	display.Printf(leftpad(padd, "[config] Groupcache Ctx Header ID:", "%v"), gs.Header.ID)
 	display.Printf(leftpad(padd, "[config] Groupcache Ctx Header Ts:", "%v"), gs.Header.Timestamp)
 }
@@ -131,6 +138,23 @@ func (rc *remoteContext) SkipTo() (uint64, error) {
 	return skipTo, nil
 }
 
+// batchContext is the context used for groupcache responses that claim a
+// range of count numbers starting at the key, the whole range is saved to
+// the datastores by the server that owns the key
+type batchContext struct {
+	*respContext
+	Count uint64
+}
+
+// leaseContext is the context used for groupcache responses that claim a
+// number of a gapless or allocator namespace, the number is saved to the
+// datastore along with its reservation, or its owner, for the token (as
+// SHA256 hex)
+type leaseContext struct {
+	*respContext
+	Token string
+}
+
 // groupcacheRT is the RoundTripper and it's context values
 type groupcacheRT map[string]string
 
@@ -166,6 +190,14 @@ func setupGroupcacheServer(config *configuration) *groupcacheServer {
 		gcache.Header.Kind = defaultGroupcacheCtxHeaderKind
 	}
 
+	if len(gcache.Header.Count) == 0 {
+		gcache.Header.Count = defaultGroupcacheCtxHeaderCount
+	}
+
+	if len(gcache.Header.Lease) == 0 {
+		gcache.Header.Lease = defaultGroupcacheCtxHeaderLease
+	}
+
 	if gcache.Replicas < 30 {
 		log.Warnf("groupcache replicas set at %d, but should be about 50 or above", gcache.Replicas)
 	}
@@ -174,6 +206,11 @@ func setupGroupcacheServer(config *configuration) *groupcacheServer {
 		gcache.BasePath = defaultGroupcacheBasePath
 	}
 	gcache.internal.pattern = strings.TrimRight(gcache.BasePath, "/*") + "/*"
+
+	if len(gcache.WatchPath) == 0 {
+		gcache.WatchPath = defaultGroupcacheWatchPath
+	}
+	gcache.WatchPath = "/" + strings.Trim(gcache.WatchPath, "/*")
 	// This is the heart of the application. It's pretty simple, until you hit
 	// some edge cases, which happens with a lot of things in programming.
 	//
@@ -208,6 +245,18 @@ func setupGroupcacheServer(config *configuration) *groupcacheServer {
 		kk := strings.Split(key, ":")
 		keyNo, keyNS := kk[0], strings.Join(kk[1:], ":")
 
+		// numbers that are not in the namespace sequence can never be claimed,
+		// so they are given back with a context that will never be equal
+		opts, err := config.Web.options.Get(keyNS)
+		if err != nil {
+			return fmt.Errorf("[groupcache]:grp:options: %v", err)
+		}
+		keyNo64, err := strconv.ParseUint(keyNo, 10, 64)
+		if err != nil || !opts.fits(keyNo64) {
+			return dest.SetString(fmt.Sprintf(respContext{}.Meta(), keyNo))
+		}
+		lastNo64 := keyNo64 // the last number of the range that is claimed
+
 		switch ctx := ctxi.(type) {
 		case *respContext:
 			resp = ctx.Meta()
@@ -223,29 +272,98 @@ func setupGroupcacheServer(config *configuration) *groupcacheServer {
 					return fmt.Errorf("[groupcache]:grp:remote rem64 parse: %v", err)
 				}
 
-				key64, err := strconv.ParseUint(keyNo, 10, 64)
-				if err != nil {
-					return fmt.Errorf("[groupcache]:grp:remote key64 parse: %v", err)
-				}
-
-				if rem64 > key64 {
+				if rem64 > keyNo64 {
 					return dest.SetString(fmt.Sprintf(ctx.Meta(), keyNo, strconv.FormatUint(rem64+1, 10)))
 				}
 			}
 			resp = ctx.respContext.Meta()
+		case *batchContext:
+			// the count comes from a header, so it is held to the same
+			// bounds as a ?count= even though the handler checks it too
+			if ctx.Count == 0 || ctx.Count > config.Web.maxBatch {
+				return fmt.Errorf("[groupcache]:grp:batch: count must be between 1 and %d", config.Web.maxBatch)
+			}
+			var ok bool
+			if lastNo64, ok = opts.end(keyNo64, ctx.Count); !ok || !opts.fits(lastNo64) {
+				return dest.SetString(fmt.Sprintf(respContext{}.Meta(), keyNo))
+			}
+			resp = ctx.Meta()
+		case *leaseContext:
+			resp = ctx.Meta()
+		default:
+			return errNoPeerContext // only a server in the pool sends one of the contexts above
 		}
 
-		if err := config.Datastore.LocalDB.Incr([]byte(keyNS), []byte(keyNo)); err != nil { // save the key locally, since we're handling it
-			return fmt.Errorf("local: %v", err)
+		// a gapless number is only ever saved along with its reservation,
+		// and an allocator number along with its owner, so any other kind
+		// of claim is refused
+		leaseCtx, isLease := ctxi.(*leaseContext)
+		if isLease != (opts.Gapless || opts.Allocator) {
+			return dest.SetString(fmt.Sprintf(respContext{}.Meta(), keyNo))
 		}
 
-		if err := config.Datastore.RemoteDB.Set([]byte(keyNS), []byte(keyNo)); err != nil { // save the key remotely
+		// the datastore only saves the range when none of its numbers have
+		// been claimed before, which catches a server that is behind (or a
+		// key that was evicted) so it starts again after the highest number
+		var claimed bool
+		switch {
+		case isLease && opts.Allocator:
+			claimed, err = config.Datastore.RemoteDB.ClaimAllocation(allocation{Namespace: keyNS, Number: keyNo64, Owner: leaseCtx.Token})
+		case isLease:
+			l := lease{Namespace: keyNS, Number: keyNo64, Token: leaseCtx.Token, State: leaseReserved, Expires: time.Now().Add(config.Web.leaseTTL)}
+			claimed, err = config.Datastore.RemoteDB.ClaimLease(l)
+		default:
+			claimed, err = config.Datastore.RemoteDB.Claim(keyNS, keyNo64, lastNo64)
+		}
+		if err != nil {
 			return fmt.Errorf("remote: %v", err)
 		}
+		if !claimed {
+			// a retired namespace is refused, or is started again above
+			// the value it was retired at, an error is never cached
+			var skip64 uint64
+			ts, err := config.Datastore.RemoteDB.Tombstone(keyNS)
+			if err != nil {
+				return fmt.Errorf("[groupcache]:grp:claimed tombstone: %v", err)
+			}
+			if ts != nil {
+				if !ts.Recreate {
+					return errRetired
+				}
+				skip64 = ts.Value
+			}
+			valB, err := config.Datastore.RemoteDB.Get([]byte(keyNS))
+			if err != nil {
+				return fmt.Errorf("[groupcache]:grp:claimed rem64 get: %v", err)
+			}
+			if len(valB) > 0 {
+				rem64, err := strconv.ParseUint(string(valB), 10, 64)
+				if err != nil {
+					return fmt.Errorf("[groupcache]:grp:claimed rem64 parse: %v", err)
+				}
+				if rem64 > skip64 {
+					skip64 = rem64
+				}
+			}
+			return dest.SetString(fmt.Sprintf(remoteContext{respContext: &respContext{}}.Meta(), keyNo, strconv.FormatUint(skip64+1, 10)))
+		}
 
+		// save the key locally, since we're handling it, a higher local value is left as it is
+		lastNo := strconv.FormatUint(lastNo64, 10)
+		if err := config.Datastore.LocalDB.Incr([]byte(keyNS), []byte(lastNo)); err != nil && err != errNumLessThan {
+			return fmt.Errorf("local: %v", err)
+		}
+
+		// a range is only claimed within a single cycle and is never
+		// obfuscated, so the numbers given out are still a range
+		watchNS, _ := splitPeriod(keyNS) // watches and thresholds are on the namespace, not its period
+		config.Web.watch.claimed(watchNS, opts.obfuscate(opts.number(keyNo64)), opts.obfuscate(opts.number(lastNo64)), opts.Step, ctxi)
+		config.Web.hooks.claimed(watchNS, strconv.FormatUint(opts.number(lastNo64), 10)) // thresholds are set on the sequence, not the obfuscated numbers
 		return dest.SetString(fmt.Sprintf(resp, keyNo))
 	},
 	))
+	config.Web.idem = newIdempotencyGroup(config)
+	config.Web.alloc = newAllocatorGroup(config)
 
 	if len(gcache.Server) == 0 {
 		addrs, err := publicAddresses()
@@ -286,18 +404,25 @@ func setupGroupcacheServer(config *configuration) *groupcacheServer {
 	opts := &groupcache.HTTPPoolOptions{BasePath: gcache.BasePath, Replicas: config.Groupcache.Replicas}
 	gcache.HTTPPool = groupcache.NewHTTPPoolOpts(gcache.internal.self, opts)
 	gcache.Transport = func(ctx groupcache.Context) http.RoundTripper {
-		var id, ts, kind string
+		var id, ts, kind, count, token string
 		switch c := ctx.(type) {
 		case *respContext:
 			id, ts, kind = c.ServerID, c.Timestamp, "local"
 		case *remoteContext:
 			id, ts, kind = c.ServerID, c.Timestamp, "remote"
+		case *batchContext:
+			id, ts, kind, count = c.ServerID, c.Timestamp, "batch", strconv.FormatUint(c.Count, 10)
+		case *leaseContext:
+			id, ts, kind, token = c.ServerID, c.Timestamp, "lease", c.Token
 		}
 
 		return groupcacheRT{
+			"Authorization":         "Bearer " + gcache.PeerKey,
 			gcache.Header.ID:        id,
 			gcache.Header.Timestamp: ts,
 			gcache.Header.Kind:      kind,
+			gcache.Header.Count:     count,
+			gcache.Header.Lease:     token,
 		}
 	}
 	gcache.Context = func(r *http.Request) groupcache.Context {
@@ -312,6 +437,13 @@ func setupGroupcacheServer(config *configuration) *groupcacheServer {
 			respCtx = rc
 		case "remote":
 			respCtx = &remoteContext{respContext: rc}
+		case "batch":
+			count, _ := strconv.ParseUint(r.Header.Get(gcache.Header.Count), 10, 64)
+			respCtx = &batchContext{respContext: rc, Count: count}
+		case "lease":
+			respCtx = &leaseContext{respContext: rc, Token: r.Header.Get(gcache.Header.Lease)}
+		default:
+			return nil // refused by the getter
 		}
 
 		return groupcache.Context(respCtx)
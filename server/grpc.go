@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcServer serves the Incrr gRPC API (see incrr.proto) on its own port,
+// it uses the same claim logic and namespace rules as the HTTP API. The
+// messages and service code are generated from incrr.proto by go generate.
+type grpcServer struct {
+	Port string `toml:"port"`
+
+	*grpc.Server
+	UnimplementedIncrrServer
+
+	web     *webServer
+	domains []string
+}
+
+func (gs *grpcServer) configDisplay(padd int, config *configuration) {
+	display.Printf(leftpad(padd, "[config] gRPC Port:", "%v"), gs.Port)
+}
+
+// ListenAndServe listens on the gRPC port and serves the gRPC API
+func (gs *grpcServer) ListenAndServe() error {
+	lis, err := net.Listen("tcp", gs.Port)
+	if err != nil {
+		return fmt.Errorf("[grpc] listen: %v", err)
+	}
+	return gs.Serve(lis)
+}
+
+// Shutdown is a hook that can be called on server shutdown
+func (gs *grpcServer) Shutdown() error {
+	gs.GracefulStop()
+	return nil
+}
+
+// namespace checks that the namespace can be used by the caller using the same
+// rules as the HTTP API, the domain is checked against the :authority and
+// private namespaces need an API key in the authorization metadata
+func (gs *grpcServer) namespace(ctx context.Context, ns string) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	var authority string
+	if v := md.Get(":authority"); len(v) > 0 {
+		authority = v[0]
+	}
+	if !inDomain(authority, gs.domains) {
+		return "", status.Error(codes.NotFound, "unknown domain")
+	}
+
+	if len(filepath.Ext(ns)) > 0 {
+		return "", status.Error(codes.InvalidArgument, "namespace does not support extensions")
+	}
+	if err := checkNSPath("/" + ns); err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	switch {
+	case strings.HasPrefix(ns, "pub/"):
+		return ns, nil
+	case strings.HasPrefix(ns, "priv/"):
+		var key string
+		if v := md.Get("authorization"); len(v) > 0 && len(v[0]) > 7 && strings.EqualFold(v[0][:7], "bearer ") {
+			key = strings.TrimSpace(v[0][7:])
+		}
+		if len(key) == 0 {
+			return "", grpcError(ErrUnauthorized{errNoAPIKey})
+		}
+
+		ok, err := gs.web.keys.Allowed(key, ns)
+		if err != nil {
+			log.Printf("[grpc] api key: %v", err)
+			return "", grpcError(ErrInternalService{err})
+		}
+		if !ok {
+			return "", grpcError(ErrForbidden{errAPIKeyNamespace})
+		}
+		return ns, nil
+	}
+	return "", status.Error(codes.InvalidArgument, "namespace must start with pub/ or priv/")
+}
+
+// caller returns who the call is from, for its idempotency keys, which is
+// the API key or else the client IP
+func (gs *grpcServer) caller(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get("authorization"); len(v) > 0 && len(v[0]) > 7 && strings.EqualFold(v[0][:7], "bearer ") {
+		return strings.TrimSpace(v[0][7:])
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			return host
+		}
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// increment claims the numbers for a namespace, and is shared by the
+// Increment and IncrementBatch calls
+func (gs *grpcServer) increment(ctx context.Context, ns string, count uint64, idemKey string) (*IncrementResponse, error) {
+	if !gs.web.canServe {
+		return nil, status.Error(codes.Unavailable, http.StatusText(http.StatusServiceUnavailable))
+	}
+
+	ns, err := gs.namespace(ctx, ns)
+	if err != nil {
+		return nil, err
+	}
+
+	var c claimed
+	if len(idemKey) > 0 {
+		c, err = gs.web.claimIdempotent(ns, count, gs.caller(ctx), idemKey)
+	} else {
+		c, err = gs.web.claim(ns, count)
+	}
+	if err != nil {
+		log.Printf("[grpc] %v", err)
+		return nil, grpcError(err)
+	}
+
+	ts, _ := strconv.ParseInt(c.resp.Timestamp, 10, 64)
+	return &IncrementResponse{Namespace: c.NS, First: c.First, Last: c.Last, ServerId: c.resp.ServerID, Timestamp: ts}, nil
+}
+
+// Increment claims the next number for a namespace
+func (gs *grpcServer) Increment(ctx context.Context, req *IncrementRequest) (*IncrementResponse, error) {
+	return gs.increment(ctx, req.GetNamespace(), 1, req.GetIdempotencyKey())
+}
+
+// IncrementBatch claims count contiguous numbers for a namespace
+func (gs *grpcServer) IncrementBatch(ctx context.Context, req *IncrementBatchRequest) (*IncrementResponse, error) {
+	if req.GetCount() == 0 || req.GetCount() > gs.web.maxBatch {
+		return nil, status.Errorf(codes.InvalidArgument, "count must be between 1 and %d", gs.web.maxBatch)
+	}
+	return gs.increment(ctx, req.GetNamespace(), req.GetCount(), req.GetIdempotencyKey())
+}
+
+// Current returns the highest known number for a namespace without claiming one
+func (gs *grpcServer) Current(ctx context.Context, req *CurrentRequest) (*CurrentResponse, error) {
+	if !gs.web.canServe {
+		return nil, status.Error(codes.Unavailable, http.StatusText(http.StatusServiceUnavailable))
+	}
+
+	ns, err := gs.namespace(ctx, req.GetNamespace())
+	if err != nil {
+		return nil, err
+	}
+
+	val, source, err := gs.web.current(ns)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &CurrentResponse{Namespace: ns, Value: val, Source: source}, nil
+}
+
+// grpcError returns a gRPC status error that matches the HTTP response for the error type
+func grpcError(err error) error {
+	switch err.(type) {
+	case ErrInternalService:
+		return status.Error(codes.Internal, "internal error")
+	case ErrNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case ErrUnauthorized:
+		return status.Error(codes.Unauthenticated, err.Error())
+	case ErrForbidden:
+		return status.Error(codes.PermissionDenied, err.Error())
+	case ErrConflict:
+		if err.(ErrConflict).errErr == errMaxReached {
+			return status.Error(codes.ResourceExhausted, err.Error())
+		}
+		return status.Error(codes.AlreadyExists, err.Error())
+	case ErrGone:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case ErrTooManyRequests:
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case ErrServiceUnavailable:
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return status.Error(codes.InvalidArgument, err.Error())
+}
+
+// setupGRPCServer sets up the gRPC server, if there is no port
+// configured then the gRPC API is not served
+func setupGRPCServer(config *configuration) *grpcServer {
+	gs := config.Server.GRPC
+	if gs == nil || len(gs.Port) == 0 {
+		return nil
+	}
+
+	if len(strings.Split(gs.Port, ":")) != 2 {
+		log.Fatal(`The config grpc port is invalid. Should be like ":9090"`)
+	}
+
+	gs.web = config.Web
+	gs.domains = config.Server.API.Domains
+
+	var opts []grpc.ServerOption
+	if !config.Server.ForceHTTP {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(config.Web.https.server.TLSConfig)))
+	}
+
+	gs.Server = grpc.NewServer(opts...)
+	RegisterIncrrServer(gs.Server, gs)
+
+	config.internal.shutdown = append(config.internal.shutdown, gs)
+	config.internal.listeners = append(config.internal.listeners, gs)
+
+	return gs
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// testGRPC starts the gRPC API of the test server in memory and returns a client for it
+func testGRPC(t *testing.T) IncrrClient {
+	t.Helper()
+	gs := &grpcServer{web: testConfig(t).Web, domains: []string{"incrr.test"}}
+	gs.Server = grpc.NewServer()
+	RegisterIncrrServer(gs.Server, gs)
+
+	lis := bufconn.Listen(1 << 20)
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///incrr.test",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return NewIncrrClient(conn)
+}
+
+func TestGRPCIncrement(t *testing.T) {
+	client, ctx := testGRPC(t), context.Background()
+	ns := testNS(t, "pub/")
+
+	resp, err := client.IncrementBatch(ctx, &IncrementBatchRequest{Namespace: ns, Count: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetFirst() != 0 || resp.GetLast() != 2 {
+		t.Errorf("batch: got %d-%d, want 0-2", resp.GetFirst(), resp.GetLast())
+	}
+
+	cur, err := client.Current(ctx, &CurrentRequest{Namespace: ns})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur.GetValue() != 2 {
+		t.Errorf("current: got %d, want 2", cur.GetValue())
+	}
+
+	if _, err := client.Increment(ctx, &IncrementRequest{Namespace: "priv/grpc/increment"}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("private: got %v, want %v", err, codes.Unauthenticated)
+	}
+}
+
+func TestGRPCCanServe(t *testing.T) {
+	web := testConfig(t).Web
+	client, ctx := testGRPC(t), context.Background()
+
+	web.canServe = false
+	defer func() { web.canServe = true }()
+
+	if _, err := client.Increment(ctx, &IncrementRequest{Namespace: "pub/grpc/serve"}); status.Code(err) != codes.Unavailable {
+		t.Errorf("increment: got %v, want %v", err, codes.Unavailable)
+	}
+	if _, err := client.Current(ctx, &CurrentRequest{Namespace: "pub/grpc/serve"}); status.Code(err) != codes.Unavailable {
+		t.Errorf("current: got %v, want %v", err, codes.Unavailable)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/groupcache"
+)
+
+// idemRecord is the claim that was made for an idempotency key, the
+// numbers are strings because JSON doesn't support uint64
+type idemRecord struct {
+	NS        string `json:"ns,omitempty"` // the namespace of the period the claim was made in, for a namespace that resets
+	First     string `json:"first"`
+	Last      string `json:"last"`
+	ServerID  string `json:"id"`
+	Timestamp string `json:"ts"`
+
+	Class string `json:"class,omitempty"` // the kind of error the claim was turned away with, see idemError
+	Err   string `json:"err,omitempty"`
+}
+
+// the kinds of error that are kept for an idempotency key
+const (
+	idemBadRequest = "bad_request"
+	idemNotFound   = "not_found"
+	idemConflict   = "conflict"
+	idemGone       = "gone"
+)
+
+// idemPrune is how often the idempotency keys past the window are deleted
+const idemPrune = time.Minute
+
+// idemError returns the kind of a claim error that comes back the same however
+// many times the claim is tried, so it's kept for the idempotency key along
+// with its message. Any other error isn't kept, so a retry tries the claim again.
+func idemError(err error) (string, bool) {
+	switch err.(type) {
+	case ErrBadRequest:
+		return idemBadRequest, true
+	case ErrNotFound:
+		return idemNotFound, true
+	case ErrConflict:
+		return idemConflict, true
+	case ErrGone:
+		return idemGone, true
+	}
+	return "", false
+}
+
+// err returns the error that the claim was turned away with, if it was
+func (rec idemRecord) err() error {
+	msg := errStr(rec.Err)
+	switch rec.Class {
+	case idemBadRequest:
+		return ErrBadRequest{msg}
+	case idemNotFound:
+		return ErrNotFound{msg}
+	case idemConflict:
+		return ErrConflict{msg}
+	case idemGone:
+		return ErrGone{msg}
+	}
+	return nil
+}
+
+// claimed returns the record as a claimed range
+func (rec idemRecord) claimed(ns string) (c claimed, err error) {
+	c.NS, c.resp = ns, &respContext{ServerID: rec.ServerID, Timestamp: rec.Timestamp, Number: rec.Last}
+	if len(rec.NS) > 0 {
+		c.NS = rec.NS
+	}
+	if c.First, err = strconv.ParseUint(rec.First, 10, 64); err != nil {
+		return c, ErrParseUint64(err)
+	}
+	if c.Last, err = strconv.ParseUint(rec.Last, 10, 64); err != nil {
+		return c, ErrParseUint64(err)
+	}
+	return c, nil
+}
+
+// idemCallerKey returns the idempotency key of the caller, which is the API
+// key or else the client IP, so a caller can't get back the numbers claimed
+// for another caller that happened to send the same key. It's hashed, so the
+// API key isn't kept in the remote DB.
+func idemCallerKey(caller, key string) string {
+	return hashAPIKey(caller + " " + key)
+}
+
+// idemKey returns the groupcache key for an idempotency key. The key holds the
+// time window that it's in, so that a cached claim is only handed back while
+// the window is open. The namespace is last because it may have ':' in it.
+func idemKey(window time.Duration, count uint64, key, ns string) string {
+	epoch := time.Now().UnixNano() / int64(window)
+	return fmt.Sprintf("%d:%d:%s:%s", epoch, count, key, ns)
+}
+
+// claimIdempotent claims count numbers for the namespace, unless the caller
+// has already used the idempotency key within the window, then the numbers
+// that were claimed before, or the error the claim was turned away with, are
+// sent back. The claim is made through a groupcache group, so every retry for
+// the key ends up at the same server no matter which server gets it.
+func (web *webServer) claimIdempotent(ns string, count uint64, caller, key string) (claimed, error) {
+	if len(key) > 255 {
+		return claimed{}, ErrBadRequest{errIdemKeyTooLong}
+	}
+
+	var respStr string
+	if err := web.idem.Get(nil, idemKey(web.idemWindow, count, idemCallerKey(caller, key), ns), groupcache.StringSink(&respStr)); err != nil {
+		switch err.(type) {
+		case ErrServiceUnavailable, ErrTooManyRequests, ErrInternalService:
+			return claimed{}, err // the claim failed on this server, and is tried again on a retry
+		}
+		return claimed{}, ErrInternalService{fmt.Errorf("[idempotent] cache response: %v", err)}
+	}
+
+	var rec idemRecord
+	if err := json.Unmarshal([]byte(respStr), &rec); err != nil {
+		return claimed{}, ErrInternalService{fmt.Errorf("[idempotent] json unmarshal: %v", err)}
+	}
+	if err := rec.err(); err != nil {
+		return claimed{}, err
+	}
+
+	c, err := rec.claimed(ns)
+	if err != nil {
+		return c, ErrInternalService{err}
+	}
+	return c, nil
+}
+
+// pruneIdempotency deletes the idempotency keys that are past the window
+// until shutdown, every server prunes on its own as a delete of rows that
+// are already gone is cheap
+func (web *webServer) pruneIdempotency(done chan struct{}) {
+	ticker := time.NewTicker(idemPrune)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if err := web.remote.PruneIdempotent(time.Now().Add(-web.idemWindow)); err != nil {
+			log.Printf("[idempotent] prune: %v", err)
+		}
+	}
+}
+
+// newIdempotencyGroup sets up the groupcache group that holds the claims made
+// for idempotency keys. A claim is looked up in the remote DB first, so a key
+// that was evicted from groupcache still gets the same numbers back.
+func newIdempotencyGroup(config *configuration) *groupcache.Group {
+	return groupcache.NewGroup("idem", 64<<20, groupcache.GetterFunc(func(_ groupcache.Context, key string, dest groupcache.Sink) error {
+		kk := strings.SplitN(key, ":", 4)
+		if len(kk) != 4 {
+			return fmt.Errorf("[groupcache]:idem: invalid key")
+		}
+
+		count, err := strconv.ParseUint(kk[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("[groupcache]:idem: count parse: %v", err)
+		}
+
+		idem, ns := kk[2], kk[3]
+
+		web := config.Web
+		rec, err := config.Datastore.RemoteDB.Idempotent(idem, ns, time.Now().Add(-web.idemWindow))
+		if err != nil {
+			return fmt.Errorf("[groupcache]:idem: remote get: %v", err)
+		}
+
+		if rec == nil {
+			c, err := web.claim(ns, count)
+			if class, ok := idemError(err); ok {
+				rec = &idemRecord{Class: class, Err: err.Error()} // only cached, the remote DB keeps claims
+				return setIdemRecord(rec, dest)
+			}
+			if err != nil {
+				return err
+			}
+
+			rec = &idemRecord{
+				NS:        c.NS,
+				First:     strconv.FormatUint(c.First, 10),
+				Last:      strconv.FormatUint(c.Last, 10),
+				ServerID:  c.resp.ServerID,
+				Timestamp: c.resp.Timestamp,
+			}
+			if err := config.Datastore.RemoteDB.SetIdempotent(idem, c.NS, *rec); err != nil {
+				return fmt.Errorf("[groupcache]:idem: remote set: %v", err)
+			}
+		}
+
+		return setIdemRecord(rec, dest)
+	}))
+}
+
+// setIdemRecord sets the record as the groupcache value
+func setIdemRecord(rec *idemRecord, dest groupcache.Sink) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("[groupcache]:idem: json marshal: %v", err)
+	}
+	return dest.SetBytes(b)
+}
@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestIdempotentCaller(t *testing.T) {
+	web := testConfig(t).Web
+	ns := testNS(t, "pub/")
+
+	a, err := web.claimIdempotent(ns, 1, "10.0.0.1", "key-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := web.claimIdempotent(ns, 1, "10.0.0.1", "key-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Last != a.Last {
+		t.Errorf("retry: got %d, want %d", again.Last, a.Last)
+	}
+
+	// another caller with the same key gets its own number
+	b, err := web.claimIdempotent(ns, 1, "10.0.0.2", "key-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Last == a.Last {
+		t.Errorf("another caller got %d back", b.Last)
+	}
+}
+
+func TestIdempotentKeepsError(t *testing.T) {
+	web, remote := testConfig(t).Web, testRemoteDB(t)
+	ns := testNS(t, "pub/")
+	remote.SetOptions(ns, map[string]string{optGapless: "true"})
+
+	for i := 0; i < 2; i++ {
+		_, err := web.claimIdempotent(ns, 1, "10.0.0.1", "key-1")
+		if _, ok := err.(ErrBadRequest); !ok || err.Error() != errGaplessReserve.Error() {
+			t.Errorf("try %d: got %#v, want a bad request", i, err)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// The Incrr gRPC API. The Go code is generated from this file into
+// incrr.pb.go and incrr_grpc.pb.go by go generate, see generate.go.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.28.3
+// source: incrr.proto
+
+package main
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Incrr_Increment_FullMethodName      = "/incrr.Incrr/Increment"
+	Incrr_IncrementBatch_FullMethodName = "/incrr.Incrr/IncrementBatch"
+	Incrr_Current_FullMethodName        = "/incrr.Incrr/Current"
+)
+
+// IncrrClient is the client API for Incrr service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type IncrrClient interface {
+	// Increment claims the next number for a namespace
+	Increment(ctx context.Context, in *IncrementRequest, opts ...grpc.CallOption) (*IncrementResponse, error)
+	// IncrementBatch claims count contiguous numbers for a namespace
+	IncrementBatch(ctx context.Context, in *IncrementBatchRequest, opts ...grpc.CallOption) (*IncrementResponse, error)
+	// Current returns the highest known number for a namespace without claiming one
+	Current(ctx context.Context, in *CurrentRequest, opts ...grpc.CallOption) (*CurrentResponse, error)
+}
+
+type incrrClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewIncrrClient(cc grpc.ClientConnInterface) IncrrClient {
+	return &incrrClient{cc}
+}
+
+func (c *incrrClient) Increment(ctx context.Context, in *IncrementRequest, opts ...grpc.CallOption) (*IncrementResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(IncrementResponse)
+	err := c.cc.Invoke(ctx, Incrr_Increment_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *incrrClient) IncrementBatch(ctx context.Context, in *IncrementBatchRequest, opts ...grpc.CallOption) (*IncrementResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(IncrementResponse)
+	err := c.cc.Invoke(ctx, Incrr_IncrementBatch_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *incrrClient) Current(ctx context.Context, in *CurrentRequest, opts ...grpc.CallOption) (*CurrentResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CurrentResponse)
+	err := c.cc.Invoke(ctx, Incrr_Current_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// IncrrServer is the server API for Incrr service.
+// All implementations must embed UnimplementedIncrrServer
+// for forward compatibility.
+type IncrrServer interface {
+	// Increment claims the next number for a namespace
+	Increment(context.Context, *IncrementRequest) (*IncrementResponse, error)
+	// IncrementBatch claims count contiguous numbers for a namespace
+	IncrementBatch(context.Context, *IncrementBatchRequest) (*IncrementResponse, error)
+	// Current returns the highest known number for a namespace without claiming one
+	Current(context.Context, *CurrentRequest) (*CurrentResponse, error)
+	mustEmbedUnimplementedIncrrServer()
+}
+
+// UnimplementedIncrrServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedIncrrServer struct{}
+
+func (UnimplementedIncrrServer) Increment(context.Context, *IncrementRequest) (*IncrementResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Increment not implemented")
+}
+func (UnimplementedIncrrServer) IncrementBatch(context.Context, *IncrementBatchRequest) (*IncrementResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method IncrementBatch not implemented")
+}
+func (UnimplementedIncrrServer) Current(context.Context, *CurrentRequest) (*CurrentResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Current not implemented")
+}
+func (UnimplementedIncrrServer) mustEmbedUnimplementedIncrrServer() {}
+func (UnimplementedIncrrServer) testEmbeddedByValue()               {}
+
+// UnsafeIncrrServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to IncrrServer will
+// result in compilation errors.
+type UnsafeIncrrServer interface {
+	mustEmbedUnimplementedIncrrServer()
+}
+
+func RegisterIncrrServer(s grpc.ServiceRegistrar, srv IncrrServer) {
+	// If the following call pancis, it indicates UnimplementedIncrrServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Incrr_ServiceDesc, srv)
+}
+
+func _Incrr_Increment_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(IncrementRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IncrrServer).Increment(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Incrr_Increment_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IncrrServer).Increment(ctx, req.(*IncrementRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Incrr_IncrementBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(IncrementBatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IncrrServer).IncrementBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Incrr_IncrementBatch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IncrrServer).IncrementBatch(ctx, req.(*IncrementBatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Incrr_Current_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CurrentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IncrrServer).Current(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Incrr_Current_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IncrrServer).Current(ctx, req.(*CurrentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Incrr_ServiceDesc is the grpc.ServiceDesc for Incrr service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Incrr_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "incrr.Incrr",
+	HandlerType: (*IncrrServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Increment",
+			Handler:    _Incrr_Increment_Handler,
+		},
+		{
+			MethodName: "IncrementBatch",
+			Handler:    _Incrr_IncrementBatch_Handler,
+		},
+		{
+			MethodName: "Current",
+			Handler:    _Incrr_Current_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "incrr.proto",
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// the states of a reserved number
+const (
+	leaseReserved  = "reserved"
+	leaseCommitted = "committed"
+	leaseAborted   = "aborted"
+)
+
+// leaseReuseTries is how many numbers in the reuse pool are tried before a
+// new number is claimed, each try can lose to another server taking the number
+const leaseReuseTries = 5
+
+// lease is a number given out by a gapless namespace that is kept in the
+// remote DB. A reserved number is committed or aborted with its token, an
+// aborted number or a reserved number whose lease has expired is in the
+// reuse pool, which is given out again before any new number.
+type lease struct {
+	Namespace string
+	Number    uint64
+	Token     string // the SHA256 hex of the lease token
+	State     string
+	Expires   time.Time
+}
+
+// nsLeaseResponse is the JSON body sent back for the reservation API, the
+// numbers are strings because JSON doesn't support uint64
+type nsLeaseResponse struct {
+	Namespace string `json:"namespace"`
+	Number    string `json:"number"`
+	ID        string `json:"id,omitempty"`    // the number as it's given out, when the namespace has a format
+	Token     string `json:"token,omitempty"` // only sent back when the number is reserved or acquired
+	State     string `json:"state"`
+	Expires   string `json:"expires,omitempty"`
+	Version   string `json:"version"`
+}
+
+// newLeaseToken returns a random lease token
+func newLeaseToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// reuse gives out the lowest number in the reuse pool of the namespace, it's
+// reserved for the token until it expires. It returns false when the pool is empty.
+func (web *webServer) reuse(ns, token string, expires time.Time) (c claimed, ok bool, err error) {
+	to := lease{Namespace: ns, Token: hashAPIKey(token), State: leaseReserved, Expires: expires}
+
+	for i := 0; i < leaseReuseTries; i++ {
+		from, err := web.remote.Reusable(ns, time.Now())
+		if err != nil {
+			return c, false, ErrInternalService{fmt.Errorf("[lease] reusable: %v", err)}
+		}
+		if from == nil {
+			return c, false, nil
+		}
+
+		to.Number = from.Number
+		ok, err := web.remote.TakeLease(*from, to, time.Now())
+		if err != nil {
+			return c, false, ErrInternalService{fmt.Errorf("[lease] take: %v", err)}
+		}
+		if ok {
+			c = claimed{
+				NS: ns, First: from.Number, Last: from.Number, Source: "reuse",
+				resp: &respContext{ServerID: web.serverID, Timestamp: strconv.FormatInt(time.Now().UnixNano(), 10)},
+			}
+			return c, true, nil
+		}
+	}
+	return c, false, nil // it's busy, so claim a new number instead
+}
+
+// reserve reserves a number of a gapless namespace for the lease token until
+// it expires, from the reuse pool if there are any there. A new number is
+// saved along with its reservation by the server that claims it, so there
+// is never a claimed number without a lease.
+func (web *webServer) reserve(ns, token string, expires time.Time) (claimed, error) {
+	ns, err := web.periods.namespace(ns)
+	if err != nil {
+		return claimed{}, err
+	}
+
+	opts, err := web.options.Get(ns)
+	if err != nil {
+		return claimed{}, ErrInternalService{fmt.Errorf("[lease] options: %v", err)}
+	}
+	if !opts.Gapless {
+		return claimed{}, ErrBadRequest{errNotGapless}
+	}
+
+	c, ok, err := web.reuse(ns, token, expires)
+	if err != nil || ok {
+		return c, err
+	}
+
+	return web.claimNew(ns, 1, hashAPIKey(token))
+}
+
+// endLease commits or aborts the number reserved with the lease token, doing
+// the same again gives back the number, as the first response may have been lost
+func (web *webServer) endLease(ns, token, state string) (claimed, error) {
+	hash := hashAPIKey(token)
+
+	l, err := web.remote.Reservation(hash)
+	if err != nil {
+		return claimed{}, ErrInternalService{fmt.Errorf("[lease] reservation: %v", err)}
+	}
+	if l == nil {
+		return claimed{}, ErrNotFound{errNoLease}
+	}
+	if parent, _ := splitPeriod(l.Namespace); parent != ns && l.Namespace != ns {
+		return claimed{}, ErrNotFound{errNoLease} // the token is for another namespace
+	}
+
+	if l.State != state {
+		ok, err := web.remote.EndLease(hash, state, time.Now())
+		if err != nil {
+			return claimed{}, ErrInternalService{fmt.Errorf("[lease] end: %v", err)}
+		}
+		switch {
+		case ok:
+		case l.State == leaseReserved && time.Now().After(l.Expires):
+			return claimed{}, ErrGone{errLeaseExpired}
+		default:
+			return claimed{}, ErrConflict{errLeaseEnded}
+		}
+	}
+
+	c := claimed{
+		NS: l.Namespace, First: l.Number, Last: l.Number,
+		resp: &respContext{ServerID: web.serverID, Timestamp: strconv.FormatInt(time.Now().UnixNano(), 10)},
+	}
+	return c, nil
+}
+
+// PublicLeaseHandler handles the reservation API of public namespaces
+func (web *webServer) PublicLeaseHandler(w http.ResponseWriter, r *http.Request) {
+	web.serveLease(w, r, "pub/")
+}
+
+// PrivateLeaseHandler handles the reservation API of private namespaces,
+// the API key has already been checked by the UseAPIKeys middleware
+func (web *webServer) PrivateLeaseHandler(w http.ResponseWriter, r *http.Request) {
+	web.serveLease(w, r, "priv/")
+}
+
+// serveLease reserves a number with ?reserve, then commits it with ?commit=<token>
+// or aborts it with ?abort=<token>. A reserved number's text response is the
+// number and the token separated by a space. An allocator namespace acquires
+// a number and its token with ?acquire, and gives it back with ?release=<token>.
+func (web *webServer) serveLease(w http.ResponseWriter, r *http.Request, prefix string) {
+	if !web.canServe {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		responseOnErr(w, ErrBadRequest{err})
+		return
+	}
+
+	var c claimed
+	var err error
+	var token, state string
+	var expires = time.Now().Add(web.leaseTTL)
+	ns, asJSON := namespace(prefix, r)
+	switch _, reserve := r.Form["reserve"]; {
+	case reserve:
+		if token, err = newLeaseToken(); err != nil {
+			responseOnErr(w, ErrInternalService{err})
+			return
+		}
+		state = leaseReserved
+		c, err = web.reserve(ns, token, expires)
+	case len(r.FormValue("commit")) > 0:
+		state = leaseCommitted
+		c, err = web.endLease(ns, r.FormValue("commit"), state)
+	case len(r.FormValue("abort")) > 0:
+		state = leaseAborted
+		c, err = web.endLease(ns, r.FormValue("abort"), state)
+	case len(r.Form["acquire"]) > 0:
+		if token, err = newLeaseToken(); err != nil {
+			responseOnErr(w, ErrInternalService{err})
+			return
+		}
+		state = allocAcquired
+		c, err = web.acquire(ns, token)
+	case len(r.FormValue("release")) > 0:
+		state = allocReleased
+		c, err = web.release(ns, r.FormValue("release"))
+	default:
+		err = ErrBadRequest{errNoLeaseAction}
+	}
+	if err == nil {
+		err = web.formatIDs(&c)
+	}
+	if err != nil {
+		log.Printf("[%sNS lease] %v", prefix, err)
+		responseOnErr(w, err)
+		return
+	}
+
+	if !asJSON {
+		if len(token) > 0 {
+			fmt.Fprintf(w, "%s %s", c.LastID, token)
+			return
+		}
+		fmt.Fprint(w, c.LastID)
+		return
+	}
+
+	body := nsLeaseResponse{
+		Namespace: c.NS,
+		Number:    strconv.FormatUint(c.Last, 10),
+		Token:     token,
+		State:     state,
+		Version:   verSemVer,
+	}
+	if c.LastID != body.Number {
+		body.ID = c.LastID
+	}
+	if state == leaseReserved {
+		body.Expires = expires.UTC().Format(time.RFC3339)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("[response] json encode: %v", err)
+	}
+}
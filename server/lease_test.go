@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReserveSavesLease(t *testing.T) {
+	web, remote := testConfig(t).Web, testRemoteDB(t)
+	ns := testNS(t, "pub/")
+	remote.SetOptions(ns, map[string]string{optGapless: "true"})
+
+	c, err := web.reserve(ns, "token-a", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the number was saved along with its reservation for the token
+	l, err := remote.Reservation(hashAPIKey("token-a"))
+	if err != nil || l == nil {
+		t.Fatalf("reservation: got %v %v", l, err)
+	}
+	if l.Namespace != ns || l.Number != c.Last || l.State != leaseReserved {
+		t.Errorf("reservation: got %+v, want %d reserved", l, c.Last)
+	}
+
+	// an aborted number is given out again before a new one
+	if _, err := web.endLease(ns, "token-a", leaseAborted); err != nil {
+		t.Fatal(err)
+	}
+	again, err := web.reserve(ns, "token-b", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Last != c.Last || again.Source != "reuse" {
+		t.Errorf("reuse: got %d from %q, want %d", again.Last, again.Source, c.Last)
+	}
+}
+
+func TestGaplessRefusesClaim(t *testing.T) {
+	web, remote := testConfig(t).Web, testRemoteDB(t)
+	ns := testNS(t, "pub/")
+	remote.SetOptions(ns, map[string]string{optGapless: "true"})
+
+	if _, err := web.claim(ns, 1); err != (ErrBadRequest{errGaplessReserve}) {
+		t.Errorf("claim: got %v, want %v", err, errGaplessReserve)
+	}
+
+	// a server that still sends a plain claim has it refused by the key owner
+	if _, won, err := web.probe(ns, 0, 1, "local", ""); err != nil || won {
+		t.Errorf("probe: got won=%v %v, want refused", won, err)
+	}
+	if issued, _ := remote.Issued(ns, 0); issued {
+		t.Error("a number was saved without a lease")
+	}
+}
@@ -38,6 +38,14 @@ func (l localDB) Set(key, val []byte) error {
 	})
 }
 
+// Delete removes a given key (namespace)
+func (l localDB) Delete(key []byte) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(l.BoltDBConfig.BucketName))
+		return b.Delete(key)
+	})
+}
+
 // Incr sets the value for a given key (namespace), and
 // makes sure that it is larger than the previous value
 func (l localDB) Incr(key, val []byte) error {
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/groupcache"
+)
+
+// memcachedMaxKeyLen is the longest key that memcached allows
+const memcachedMaxKeyLen = 250
+
+// memcachedServer speaks the part of the memcached text protocol (incr, get,
+// version and stats) that apps using memcached incr for sequences need, so
+// they can point at incrr instead. Keys are namespaces under the configured prefix.
+type memcachedServer struct {
+	Port   string `toml:"port"`
+	Prefix string `toml:"prefix"`
+
+	*tcpServer
+
+	web     *webServer
+	started time.Time
+}
+
+func (ms *memcachedServer) configDisplay(padd int, config *configuration) {
+	display.Printf(leftpad(padd, "[config] Memcached Port:", "%v"), ms.Port)
+	display.Printf(leftpad(padd, "[config] Memcached Prefix:", "%v"), ms.Prefix)
+}
+
+// namespace returns the namespace for a memcached key
+func (ms *memcachedServer) namespace(key string) (string, error) {
+	if len(key) > memcachedMaxKeyLen {
+		return "", errInvalidKey
+	}
+	return keyNamespace(ms.Prefix, key)
+}
+
+// serve handles the commands of a single connection until it's closed
+func (ms *memcachedServer) serve(conn net.Conn) {
+	r, w := newReader(conn), bufio.NewWriter(conn)
+
+	for {
+		if err := waitCommand(conn, r); err != nil {
+			return // the client went away, or was idle too long
+		}
+
+		line, err := readLine(r)
+		if err == errLineTooLong {
+			fmt.Fprint(w, "CLIENT_ERROR line too long\r\n")
+			w.Flush()
+			return
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("[memcached] %v", err)
+			}
+			return
+		}
+
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			fmt.Fprint(w, "ERROR\r\n")
+			w.Flush()
+			continue
+		}
+
+		if quit := ms.command(w, args); quit {
+			w.Flush()
+			return
+		}
+
+		if r.Buffered() == 0 { // let pipelined commands go out together
+			w.Flush()
+		}
+	}
+}
+
+// command runs a single command and writes the reply, it returns true
+// when the connection should be closed
+func (ms *memcachedServer) command(w *bufio.Writer, args []string) (quit bool) {
+	switch args[0] {
+	case "quit":
+		return true
+	case "version":
+		fmt.Fprintf(w, "VERSION %s\r\n", verSemVer)
+	case "incr":
+		noreply := len(args) == 4 && args[3] == "noreply"
+		if len(args) != 3 && !noreply {
+			fmt.Fprint(w, "ERROR\r\n")
+			return
+		}
+
+		count, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil || count == 0 || count > ms.web.maxBatch {
+			fmt.Fprintf(w, "CLIENT_ERROR the delta must be between 1 and %d\r\n", ms.web.maxBatch)
+			return
+		}
+
+		ns, err := ms.namespace(args[1])
+		if err != nil {
+			fmt.Fprintf(w, "CLIENT_ERROR %v\r\n", err)
+			return
+		}
+
+		c, err := ms.web.claim(ns, count)
+		if err != nil {
+			log.Printf("[memcached] %v", err)
+			memcachedErr(w, err)
+			return
+		}
+		if !noreply {
+			fmt.Fprintf(w, "%d\r\n", c.Last) // like memcached, the value after the increment
+		}
+	case "get":
+		if len(args) < 2 {
+			fmt.Fprint(w, "ERROR\r\n")
+			return
+		}
+
+		for _, key := range args[1:] {
+			ns, err := ms.namespace(key)
+			if err != nil {
+				fmt.Fprintf(w, "CLIENT_ERROR %v\r\n", err)
+				return
+			}
+
+			val, _, err := ms.web.current(ns)
+			switch err.(type) {
+			case nil:
+				data := strconv.FormatUint(val, 10)
+				fmt.Fprintf(w, "VALUE %s 0 %d\r\n%s\r\n", key, len(data), data)
+			case ErrNotFound, ErrGone: // a miss
+			default:
+				log.Printf("[memcached] %v", err)
+				memcachedErr(w, err)
+				return
+			}
+		}
+		fmt.Fprint(w, "END\r\n")
+	case "stats":
+		if len(args) != 1 {
+			fmt.Fprint(w, "ERROR\r\n")
+			return
+		}
+		ms.stats(w)
+	default:
+		fmt.Fprint(w, "ERROR\r\n")
+	}
+	return false
+}
+
+// stats writes the server details and the groupcache counters of the incr group
+func (ms *memcachedServer) stats(w *bufio.Writer) {
+	stat := func(name string, v interface{}) { fmt.Fprintf(w, "STAT %s %v\r\n", name, v) }
+
+	stat("pid", os.Getpid())
+	stat("uptime", int64(time.Since(ms.started)/time.Second))
+	stat("time", time.Now().Unix())
+	stat("version", verSemVer)
+	stat("server_id", ms.web.serverID)
+
+	s := &ms.web.cache.Stats
+	stat("gets", s.Gets.Get())
+	stat("cache_hits", s.CacheHits.Get())
+	stat("peer_loads", s.PeerLoads.Get())
+	stat("peer_errors", s.PeerErrors.Get())
+	stat("loads", s.Loads.Get())
+	stat("loads_deduped", s.LoadsDeduped.Get())
+	stat("local_loads", s.LocalLoads.Get())
+	stat("local_load_errs", s.LocalLoadErrs.Get())
+	stat("server_requests", s.ServerRequests.Get())
+
+	for _, c := range []struct {
+		name string
+		typ  groupcache.CacheType
+	}{{"main", groupcache.MainCache}, {"hot", groupcache.HotCache}} {
+		cs, name := ms.web.cache.CacheStats(c.typ), c.name
+		stat(name+"_cache_bytes", cs.Bytes)
+		stat(name+"_cache_items", cs.Items)
+		stat(name+"_cache_gets", cs.Gets)
+		stat(name+"_cache_hits", cs.Hits)
+		stat(name+"_cache_evictions", cs.Evictions)
+	}
+	fmt.Fprint(w, "END\r\n")
+}
+
+// memcachedErr writes the reply for an error from a claim or lookup
+func memcachedErr(w *bufio.Writer, err error) {
+	switch err.(type) {
+	case ErrInternalService:
+		fmt.Fprint(w, "SERVER_ERROR internal error\r\n")
+	case ErrGone:
+		fmt.Fprintf(w, "CLIENT_ERROR %v\r\n", errRetired)
+	case ErrBadRequest:
+		fmt.Fprintf(w, "CLIENT_ERROR %v\r\n", err)
+	default:
+		fmt.Fprintf(w, "SERVER_ERROR %v\r\n", err)
+	}
+}
+
+// setupMemcachedServer sets up the memcached server, if there is no port
+// configured then the memcached protocol is not served
+func setupMemcachedServer(config *configuration) *memcachedServer {
+	ms := config.Server.Memcached
+	if ms == nil || len(ms.Port) == 0 {
+		return nil
+	}
+
+	if len(strings.Split(ms.Port, ":")) != 2 {
+		log.Fatal(`The config memcached port is invalid. Should be like ":11211"`)
+	}
+
+	if len(ms.Prefix) == 0 {
+		ms.Prefix = defaultMemcachedPrefix
+	}
+	if !strings.HasPrefix(ms.Prefix, "pub/") {
+		log.Fatal(`The config memcached prefix must be a public namespace, i.e: "pub/"`)
+	}
+
+	ms.web = config.Web
+	ms.started = time.Now()
+	ms.tcpServer = &tcpServer{addr: ms.Port, handle: ms.serve}
+
+	config.internal.shutdown = append(config.internal.shutdown, ms)
+	config.internal.listeners = append(config.internal.listeners, ms)
+
+	return ms
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+// testMemcachedServer starts a memcached server on a random port for the test
+func testMemcachedServer(t *testing.T) string {
+	config := testConfig(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := &memcachedServer{Prefix: testNS(t, "pub/") + "/", web: config.Web}
+	ms.tcpServer = &tcpServer{handle: ms.serve}
+	go ms.Serve(ln)
+	t.Cleanup(func() { ms.Shutdown() })
+
+	return ln.Addr().String()
+}
+
+func TestMemcachedClient(t *testing.T) {
+	conn, err := net.Dial("tcp", testMemcachedServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	for _, tc := range []struct{ send, want string }{
+		{"version\r\n", "VERSION " + verSemVer},
+		{"incr order 1\r\n", "0"}, // a namespace starts at zero
+		{"incr order 1\r\n", "1"},
+		{"incr order 10\r\n", "11"},
+		{"incr order 1 noreply\r\nget order\r\n", "VALUE order 0 2"},
+		{"", "12"},
+		{"", "END"},
+		{"get nothing\r\n", "END"},
+		{"get order nothing\r\n", "VALUE order 0 2"},
+		{"", "12"},
+		{"", "END"},
+		{"incr order 0\r\n", "CLIENT_ERROR the delta must be between 1 and 5000"},
+		{"incr order\r\n", "ERROR"},
+		{"set order 0 0 1\r\n", "ERROR"},
+		{"incr " + strings.Repeat("k", memcachedMaxKeyLen+1) + " 1\r\n", "CLIENT_ERROR " + errInvalidKey.Error()},
+	} {
+		if len(tc.send) > 0 {
+			if _, err := conn.Write([]byte(tc.send)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%q: %v", tc.send, err)
+		}
+		if got := strings.TrimRight(line, "\r\n"); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.send, got, tc.want)
+		}
+	}
+
+	// stats ends with END, and quit closes the connection
+	conn.Write([]byte("stats\r\n"))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "END\r\n" {
+			break
+		}
+		if !strings.HasPrefix(line, "STAT ") {
+			t.Errorf("stats: got %q", line)
+		}
+	}
+	conn.Write([]byte("quit\r\n"))
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Error("the connection is still open after quit")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"strconv"
+)
+
+// feistelRounds is the number of rounds of the Feistel network
+const feistelRounds = 8
+
+// the bit widths that numbers can be obfuscated over
+const (
+	minObfuscateBits = 16
+	maxObfuscateBits = 64
+)
+
+// feistelKeys are the round keys of a namespace
+type feistelKeys [feistelRounds]uint64
+
+// newFeistelKeys returns the round keys for the namespace, they come from the
+// obfuscation key so each namespace has its own permutation
+func newFeistelKeys(secret []byte, ns string) (keys feistelKeys) {
+	for i := range keys {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(ns + ":" + strconv.Itoa(i)))
+		keys[i] = binary.BigEndian.Uint64(mac.Sum(nil))
+	}
+	return keys
+}
+
+// feistelRound mixes half of a number with a round key, it's the
+// SplitMix64 finalizer so every bit of the input moves the output
+func feistelRound(x, key uint64) uint64 {
+	z := x ^ key
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// obfuscate returns the number passed through the keyed Feistel network of the
+// namespace. It's a permutation of the numbers that fit in the bit width, so
+// each number gives a different value that deobfuscate turns back.
+func (o nsOptions) obfuscate(n uint64) uint64 {
+	if o.Obfuscate == 0 {
+		return n
+	}
+
+	half := uint(o.Obfuscate / 2)
+	mask := uint64(1)<<half - 1
+
+	l, r := n>>half&mask, n&mask
+	for i := 0; i < feistelRounds; i++ {
+		l, r = r, l^(feistelRound(r, o.keys[i])&mask)
+	}
+	return l<<half | r
+}
+
+// deobfuscate returns the number that was obfuscated to the value
+func (o nsOptions) deobfuscate(v uint64) uint64 {
+	if o.Obfuscate == 0 {
+		return v
+	}
+
+	half := uint(o.Obfuscate / 2)
+	mask := uint64(1)<<half - 1
+
+	l, r := v>>half&mask, v&mask
+	for i := feistelRounds - 1; i >= 0; i-- {
+		l, r = r^(feistelRound(l, o.keys[i])&mask), l
+	}
+	return l<<half | r
+}
+
+// obfuscates returns if the value can be given out by the namespace, an
+// obfuscated value has to fit in the bit width
+func (o nsOptions) obfuscates(v uint64) bool {
+	return o.Obfuscate == 0 || o.Obfuscate == maxObfuscateBits || v>>uint(o.Obfuscate) == 0
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestObfuscateRoundTrip(t *testing.T) {
+	for _, bits := range []int{16, 24, 32, 48, 64} {
+		opts := nsOptions{Obfuscate: bits, keys: newFeistelKeys([]byte("test-key"), "pub/obfuscate")}
+		top := uint64(math.MaxUint64)
+		if bits < maxObfuscateBits {
+			top = uint64(1)<<uint(bits) - 1
+		}
+
+		for _, n := range []uint64{0, 1, 2, 3, 1000, top / 2, top - 1, top} {
+			v := opts.obfuscate(n)
+			if !opts.obfuscates(v) {
+				t.Errorf("%d bits: %d obfuscates to %d, which doesn't fit", bits, n, v)
+			}
+			if got := opts.deobfuscate(v); got != n {
+				t.Errorf("%d bits: %d obfuscates to %d, which deobfuscates to %d", bits, n, v, got)
+			}
+		}
+	}
+}
+
+func TestObfuscatePermutation(t *testing.T) {
+	opts := nsOptions{Obfuscate: minObfuscateBits, keys: newFeistelKeys([]byte("test-key"), "pub/obfuscate")}
+	size := uint64(1) << minObfuscateBits
+
+	seen := make(map[uint64]uint64, size)
+	for n := uint64(0); n < size; n++ {
+		v := opts.obfuscate(n)
+		if v >= size {
+			t.Fatalf("%d obfuscates to %d, which is outside of %d bits", n, v, minObfuscateBits)
+		}
+		if prev, ok := seen[v]; ok {
+			t.Fatalf("%d and %d both obfuscate to %d", prev, n, v)
+		}
+		seen[v] = n
+	}
+
+	// each namespace has its own permutation
+	other := nsOptions{Obfuscate: minObfuscateBits, keys: newFeistelKeys([]byte("test-key"), "pub/other")}
+	var same int
+	for n := uint64(0); n < 100; n++ {
+		if opts.obfuscate(n) == other.obfuscate(n) {
+			same++
+		}
+	}
+	if same > 5 {
+		t.Errorf("%d of 100 numbers obfuscate the same in two namespaces", same)
+	}
+}
+
+func TestClaimObfuscated(t *testing.T) {
+	web, remote := testConfig(t).Web, testRemoteDB(t)
+	ns := testNS(t, "pub/")
+	remote.SetOptions(ns, map[string]string{optObfuscate: "16"})
+
+	if _, err := web.claim(ns, 2); err != (ErrBadRequest{errBatchObfuscated}) {
+		t.Errorf("batch: got %v, want %v", err, errBatchObfuscated)
+	}
+
+	opts, err := web.options.Get(ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for want := uint64(0); want < 3; want++ {
+		c, err := web.claim(ns, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.First != opts.obfuscate(want) || opts.deobfuscate(c.First) != want {
+			t.Errorf("claim: got %d, want %d obfuscated to %d", c.First, want, opts.obfuscate(want))
+		}
+	}
+}
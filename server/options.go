@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the names of the per namespace options kept in the remote DB
+const (
+	optStep  = "step"
+	optStart = "start"
+	optMax   = "max"
+	optOnMax = "on_max"
+
+	optPad    = "pad"
+	optPrefix = "prefix"
+	optSuffix = "suffix"
+	optBase   = "base"
+	optCheck  = "check"
+
+	optObfuscate = "obfuscate"
+
+	optReset    = "reset"
+	optTimeZone = "time_zone"
+
+	optGapless   = "gapless"
+	optAllocator = "allocator"
+)
+
+// nsOptionNames are all of the options that can be set for a namespace
+var nsOptionNames = []string{optStep, optStart, optMax, optOnMax, optPad, optPrefix, optSuffix, optBase, optCheck, optObfuscate, optReset, optTimeZone, optGapless, optAllocator}
+
+// maxNumber is the highest number of any namespace, the remote datastores
+// save the numbers in signed 64 bit columns
+const maxNumber = math.MaxInt64
+
+// the values of the on_max option
+const (
+	onMaxRefuse = "refuse"
+	onMaxWrap   = "wrap"
+)
+
+// nsOptions are the per namespace settings that are kept in the remote
+// DB, so every server uses the same settings for a namespace
+type nsOptions struct {
+	Step  uint64 // the distance between numbers in the sequence
+	Start uint64 // the first number in the sequence
+	Max   uint64 // the highest number in the sequence, zero is no max
+	Wrap  bool   // if the sequence goes back to the start after the max, otherwise it's refused
+
+	// how a number is written out once it's claimed, the stored values are
+	// always the plain number
+	Pad    int    // the least number of digits, zeros are added in front
+	Prefix string // added before the digits
+	Suffix string // added after the digits
+	Base   int    // 10, 36 or 62
+	Check  string // the check digit algorithm added after the digits, if any
+
+	Obfuscate int         // the bit width of the permutation the claimed numbers go through, zero is off
+	keys      feistelKeys // the round keys of the permutation, from the obfuscation key
+
+	Reset    string         // the period that the numbers start again after, if any
+	Location *time.Location // the time zone of the periods
+
+	Gapless   bool // if the numbers that are aborted or not committed are given out again
+	Allocator bool // if the numbers can be released, the lowest released number is acquired first
+}
+
+// parseNSOptions returns the namespace options from the raw remote DB
+// values, any option that isn't set is given its default value and any
+// unknown option is skipped
+func parseNSOptions(raw map[string]string) (opts nsOptions, err error) {
+	opts.Step, opts.Base = 1, 10
+
+	for name, val := range raw {
+		switch name {
+		case optStep:
+			opts.Step, err = parseNumber(val)
+			if err == nil && opts.Step == 0 {
+				err = errZeroStep
+			}
+		case optStart:
+			opts.Start, err = parseNumber(val)
+		case optMax:
+			opts.Max, err = parseNumber(val)
+		case optOnMax:
+			switch val {
+			case onMaxRefuse, "":
+				opts.Wrap = false
+			case onMaxWrap:
+				opts.Wrap = true
+			default:
+				err = errOnMax
+			}
+		case optPad:
+			opts.Pad, err = strconv.Atoi(val)
+			if err == nil && (opts.Pad < 0 || opts.Pad > maxFormatLen) {
+				err = errPad
+			}
+		case optPrefix, optSuffix:
+			if len(val) > maxFormatLen {
+				err = errAffixTooLong
+			}
+			if name == optPrefix {
+				opts.Prefix = val
+			} else {
+				opts.Suffix = val
+			}
+		case optBase:
+			opts.Base, err = strconv.Atoi(val)
+			if err == nil && opts.Base != 10 && opts.Base != 36 && opts.Base != 62 {
+				err = errBase
+			}
+		case optCheck:
+			switch val {
+			case checkLuhn, checkDamm, checkVerhoeff, "":
+				opts.Check = val
+			default:
+				err = errCheck
+			}
+		case optObfuscate:
+			opts.Obfuscate, err = strconv.Atoi(val)
+			if err == nil && opts.Obfuscate != 0 &&
+				(opts.Obfuscate < minObfuscateBits || opts.Obfuscate > maxObfuscateBits || opts.Obfuscate%2 != 0) {
+				err = errObfuscateBits
+			}
+		case optReset:
+			switch val {
+			case resetDaily, resetMonthly, resetYearly, "":
+				opts.Reset = val
+			default:
+				err = errReset
+			}
+		case optTimeZone:
+			opts.Location, err = time.LoadLocation(val)
+		case optGapless:
+			opts.Gapless, err = strconv.ParseBool(val)
+		case optAllocator:
+			opts.Allocator, err = strconv.ParseBool(val)
+		}
+		if err != nil {
+			return opts, fmt.Errorf("option %s: %v", name, err)
+		}
+	}
+
+	if opts.Allocator && (opts.Gapless || opts.Obfuscate > 0 || opts.Wrap) {
+		return opts, fmt.Errorf("option %s: %v", optAllocator, errAllocatorMode)
+	}
+	if len(opts.Check) > 0 && opts.Base != 10 {
+		return opts, fmt.Errorf("option %s: %v", optCheck, errCheckBase)
+	}
+	// the numbers have to fit in the bit width to be obfuscated, so the
+	// width is the max when there isn't a lower one
+	if opts.Obfuscate > 0 && opts.Obfuscate < maxObfuscateBits {
+		limit := uint64(1)<<uint(opts.Obfuscate) - 1
+		switch {
+		case opts.Max == 0:
+			opts.Max = limit
+		case opts.Max > limit:
+			return opts, fmt.Errorf("option %s: %v", optMax, errObfuscateMax)
+		}
+	}
+	if opts.Max > 0 && opts.Max < opts.Start {
+		return opts, fmt.Errorf("option %s: %v", optMax, errMaxBelowStart)
+	}
+	// the number after the start has to fit in the datastores
+	if opts.Step > maxNumber-opts.Start {
+		return opts, fmt.Errorf("option %s: %v", optStep, errStepRange)
+	}
+	return opts, nil
+}
+
+// parseNumber parses the value of a number option, which can be no more
+// than the highest number the datastores can save
+func parseNumber(val string) (uint64, error) {
+	n, err := strconv.ParseUint(val, 10, 64)
+	if err == nil && n > maxNumber {
+		err = errNumberRange
+	}
+	return n, err
+}
+
+// fits returns if the number is part of the namespace sequence, numbers
+// past the max only fit when the sequence wraps
+func (o nsOptions) fits(n uint64) bool {
+	if o.Max > 0 && !o.Wrap && n > o.Max {
+		return false
+	}
+	return n >= o.Start && (n-o.Start)%o.Step == 0
+}
+
+// wraps returns if the sequence goes back to the start after the max
+func (o nsOptions) wraps() bool { return o.Max > 0 && o.Wrap }
+
+// size returns how many numbers there are in a cycle of a wrapping sequence
+func (o nsOptions) size() uint64 { return (o.Max-o.Start)/o.Step + 1 }
+
+// cycle returns the cycle of a wrapping sequence that a claimed number is in.
+// The numbers claimed through groupcache always go up, so a wrapping sequence
+// maps them into cycles of the numbers from the start to the max.
+func (o nsOptions) cycle(n uint64) uint64 {
+	if !o.wraps() || n < o.Start {
+		return 0
+	}
+	return (n - o.Start) / o.Step / o.size()
+}
+
+// cycleStart returns the first claimed number of a cycle of a wrapping sequence
+func (o nsOptions) cycleStart(cycle uint64) uint64 {
+	return o.Start + cycle*o.size()*o.Step
+}
+
+// number returns the number given out for a claimed number, which is only
+// different for a wrapping sequence
+func (o nsOptions) number(n uint64) uint64 {
+	if !o.wraps() || n < o.Start {
+		return n
+	}
+	return o.Start + (n-o.Start)/o.Step%o.size()*o.Step
+}
+
+// next returns the first number of the namespace sequence at or after n. The
+// highest uint64 is given back when the next number would go past it, it's
+// never in the sequence then, so it can't be claimed.
+func (o nsOptions) next(n uint64) uint64 {
+	if n <= o.Start {
+		return o.Start
+	}
+	if rem := (n - o.Start) % o.Step; rem > 0 {
+		if n > math.MaxUint64-(o.Step-rem) {
+			return math.MaxUint64
+		}
+		return n + o.Step - rem
+	}
+	return n
+}
+
+// end returns the last number of a range of count numbers of the sequence
+// starting at first, false when the range goes past the highest number
+func (o nsOptions) end(first, count uint64) (uint64, bool) {
+	if first > maxNumber {
+		return 0, false
+	}
+	if count <= 1 {
+		return first, true
+	}
+	if o.Step > (maxNumber-first)/(count-1) {
+		return 0, false
+	}
+	return first + (count-1)*o.Step, true
+}
+
+// nsOptionsCache holds the namespace options looked up from the remote DB
+// for a short time, so not every claim hits the DB
+type nsOptionsCache struct {
+	secret []byte // the obfuscation key
+	remote remoteDB
+	opts   *ttlCache
+}
+
+// newNSOptionsCache returns a namespace options cache using the remote DB of the config
+func newNSOptionsCache(config *configuration) *nsOptionsCache {
+	ttl, err := time.ParseDuration(config.Server.API.OptionsCacheTTL)
+	log.OnErr(err).Fatalf("[config] options cache ttl: %v", err)
+
+	return &nsOptionsCache{
+		secret: []byte(config.Server.API.ObfuscationKey),
+		remote: config.Datastore.RemoteDB,
+		opts:   newTTLCache(config.Server.API.CacheSize, ttl),
+	}
+}
+
+// Get returns the options for the namespace. A period namespace has the
+// options of its namespace, with the period in its prefix and suffix.
+func (oc *nsOptionsCache) Get(ns string) (opts nsOptions, err error) {
+	ns, period := splitPeriod(ns)
+	if len(period) > 0 {
+		defer func() {
+			label := periodLabel(period)
+			opts.Prefix = strings.Replace(opts.Prefix, periodPlaceholder, label, -1)
+			opts.Suffix = strings.Replace(opts.Suffix, periodPlaceholder, label, -1)
+		}()
+	}
+
+	if cached, ok := oc.opts.Get(ns); ok {
+		return cached.(nsOptions), nil
+	}
+
+	raw, err := oc.remote.Options(ns)
+	if err != nil {
+		return nsOptions{}, err
+	}
+
+	opts, err = parseNSOptions(raw)
+	if err != nil {
+		return nsOptions{}, err
+	}
+	if opts.Obfuscate > 0 {
+		if len(oc.secret) == 0 {
+			return nsOptions{}, errNoObfuscationKey
+		}
+		opts.keys = newFeistelKeys(oc.secret, ns)
+	}
+
+	oc.opts.Set(ns, opts)
+
+	return opts, nil
+}
+
+// Drop removes the namespace from the cache so the next Get is from the remote DB
+func (oc *nsOptionsCache) Drop(ns string) {
+	oc.opts.Drop(ns)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestParseNSOptionsRanges(t *testing.T) {
+	max := strconv.FormatUint(math.MaxInt64, 10)
+
+	for name, tc := range map[string]struct {
+		raw  map[string]string
+		want string // the error, empty when the options are fine
+	}{
+		"zero step":            {map[string]string{optStep: "0"}, "option step: " + errZeroStep.Error()},
+		"step past int64":      {map[string]string{optStart: max, optStep: "1"}, "option step: " + errStepRange.Error()},
+		"big start and step":   {map[string]string{optStart: "4611686018427387904", optStep: "4611686018427387904"}, "option step: " + errStepRange.Error()},
+		"start of 1<<63":       {map[string]string{optStart: "9223372036854775808"}, "option start: " + errNumberRange.Error()},
+		"step of 1<<63":        {map[string]string{optStep: "9223372036854775808"}, "option step: " + errNumberRange.Error()},
+		"max of 1<<63":         {map[string]string{optMax: "9223372036854775808"}, "option max: " + errNumberRange.Error()},
+		"max below start":      {map[string]string{optStart: "10", optMax: "5"}, "option max: " + errMaxBelowStart.Error()},
+		"highest second value": {map[string]string{optStart: "4611686018427387904", optStep: "4611686018427387903"}, ""},
+		"refuse at int64":      {map[string]string{optMax: max}, ""},
+		"wrap at int64":        {map[string]string{optMax: max, optOnMax: onMaxWrap}, ""},
+	} {
+		_, err := parseNSOptions(tc.raw)
+		var got string
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %q, want %q", name, got, tc.want)
+		}
+	}
+}
+
+func TestNSOptionsNextOverflow(t *testing.T) {
+	opts, err := parseNSOptions(map[string]string{optStep: "10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct{ n, want uint64 }{
+		{0, 0},
+		{5, 10},
+		{10, 10},
+		{math.MaxUint64 - 20, math.MaxUint64 - 15},
+		{math.MaxUint64 - 3, math.MaxUint64}, // the next number would go past the highest uint64
+	} {
+		if got := opts.next(tc.n); got != tc.want {
+			t.Errorf("next(%d): got %d, want %d", tc.n, got, tc.want)
+		}
+	}
+	if opts.fits(math.MaxUint64) {
+		t.Error("the highest uint64 is in the sequence")
+	}
+}
+
+func TestNSOptionsEndPastInt64(t *testing.T) {
+	opts, err := parseNSOptions(map[string]string{optStep: "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if last, ok := opts.end(math.MaxInt64-4, 3); !ok || last != math.MaxInt64 {
+		t.Errorf("end: got %d %v, want %d", last, ok, uint64(math.MaxInt64))
+	}
+	if _, ok := opts.end(math.MaxInt64-4, 4); ok {
+		t.Error("a range past the highest int64 was given an end")
+	}
+	if _, ok := opts.end(math.MaxInt64+1, 1); ok {
+		t.Error("a number past the highest int64 was given an end")
+	}
+}
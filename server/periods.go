@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the reset periods of a namespace
+const (
+	resetDaily   = "daily"
+	resetMonthly = "monthly"
+	resetYearly  = "yearly"
+)
+
+// periodSep joins a namespace and a period, i.e: pub/invoices@2026. It can't
+// be in a namespace path, so a period namespace never clashes with another one.
+const periodSep = "@"
+
+// periodPlaceholder is swapped for the period in a prefix or suffix
+const periodPlaceholder = "{period}"
+
+// splitPeriod returns the namespace and the period of a period namespace,
+// the period is empty for any other namespace
+func splitPeriod(ns string) (string, string) {
+	if i := strings.LastIndex(ns, periodSep); i >= 0 {
+		return ns[:i], ns[i+len(periodSep):]
+	}
+	return ns, ""
+}
+
+// periodLabel returns the period as it's written out, i.e: 202610 is 2026-10
+func periodLabel(period string) string {
+	switch len(period) {
+	case 6:
+		return period[:4] + "-" + period[4:]
+	case 8:
+		return period[:4] + "-" + period[4:6] + "-" + period[6:]
+	}
+	return period
+}
+
+// period returns the period of the namespace at the time, in its time zone,
+// with the time that the period starts and ends
+func (o nsOptions) period(t time.Time) (period string, start, end time.Time) {
+	loc := o.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	y, m, d := t.In(loc).Date()
+	switch o.Reset {
+	case resetDaily:
+		start = time.Date(y, m, d, 0, 0, 0, 0, loc)
+		return start.Format("20060102"), start, start.AddDate(0, 0, 1)
+	case resetMonthly:
+		start = time.Date(y, m, 1, 0, 0, 0, 0, loc)
+		return start.Format("200601"), start, start.AddDate(0, 1, 0)
+	case resetYearly:
+		start = time.Date(y, 1, 1, 0, 0, 0, 0, loc)
+		return start.Format("2006"), start, start.AddDate(1, 0, 0)
+	}
+	return "", t, t
+}
+
+// periodTracker picks the period namespace that a claim goes to, for the
+// namespaces that reset. The servers don't have exactly the same time, so
+// close to a rollover the remote DB decides: the first server to claim in
+// a new period records it, and the others move to it even if their clock
+// hasn't. A namespace never goes back to an earlier period.
+type periodTracker struct {
+	sync.Mutex
+
+	skew    time.Duration // how far apart the server clocks can be
+	remote  remoteDB
+	options *nsOptionsCache
+	seen    *ttlCache // the latest period of each namespace
+}
+
+// newPeriodTracker returns a period tracker using the remote DB of the config
+func newPeriodTracker(config *configuration) *periodTracker {
+	skew, err := time.ParseDuration(config.Server.API.PeriodSkew)
+	log.OnErr(err).Fatalf("[config] period skew: %v", err)
+
+	return &periodTracker{
+		skew:    skew,
+		remote:  config.Datastore.RemoteDB,
+		options: config.Web.options,
+		seen:    newTTLCache(config.Server.API.CacheSize, 0),
+	}
+}
+
+// latest returns the latest period recorded for the namespace, a namespace
+// that was dropped from the cache looks at the remote DB near a rollover
+func (pt *periodTracker) latest(ns string) string {
+	if period, ok := pt.seen.Get(ns); ok {
+		return period.(string)
+	}
+	return ""
+}
+
+// namespace returns the namespace of the current period for a namespace that
+// resets, i.e: pub/invoices@2026, any other namespace is returned as it is
+func (pt *periodTracker) namespace(ns string) (string, error) {
+	if strings.Contains(ns, periodSep) {
+		return ns, nil // already a period
+	}
+
+	opts, err := pt.options.Get(ns)
+	if err != nil {
+		return ns, ErrInternalService{fmt.Errorf("[period] options: %v", err)}
+	}
+	if len(opts.Reset) == 0 {
+		return ns, nil
+	}
+
+	now := time.Now()
+	period, start, end := opts.period(now)
+
+	seen := pt.latest(ns)
+
+	if period < seen {
+		period = seen // another server has moved on, this clock is behind
+	}
+
+	if now.Sub(start) < pt.skew || end.Sub(now) < pt.skew {
+		latest, err := pt.remote.Period(ns)
+		if err != nil {
+			return ns, ErrInternalService{fmt.Errorf("[period] latest: %v", err)}
+		}
+		if latest > period {
+			period = latest
+		}
+	}
+
+	if period > seen {
+		if err := pt.remote.SetPeriod(ns, period); err != nil {
+			return ns, ErrInternalService{fmt.Errorf("[period] record: %v", err)}
+		}
+
+		pt.Lock()
+		if period > pt.latest(ns) {
+			pt.seen.Set(ns, period)
+		}
+		pt.Unlock()
+	}
+
+	return ns + periodSep + period, nil
+}
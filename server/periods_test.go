@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNSOptionsPeriod(t *testing.T) {
+	east := time.FixedZone("east", 10*60*60)
+	at := time.Date(2026, 12, 31, 20, 30, 0, 0, time.UTC) // 2027-01-01 06:30 in the east
+
+	for _, tc := range []struct {
+		reset      string
+		loc        *time.Location
+		want       string
+		start, end time.Time
+	}{
+		{resetDaily, nil, "20261231", time.Date(2026, 12, 31, 0, 0, 0, 0, time.UTC), time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{resetMonthly, nil, "202612", time.Date(2026, 12, 1, 0, 0, 0, 0, time.UTC), time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{resetYearly, nil, "2026", time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{resetDaily, east, "20270101", time.Date(2027, 1, 1, 0, 0, 0, 0, east), time.Date(2027, 1, 2, 0, 0, 0, 0, east)},
+		{resetYearly, east, "2027", time.Date(2027, 1, 1, 0, 0, 0, 0, east), time.Date(2028, 1, 1, 0, 0, 0, 0, east)},
+	} {
+		period, start, end := nsOptions{Reset: tc.reset, Location: tc.loc}.period(at)
+		if period != tc.want || !start.Equal(tc.start) || !end.Equal(tc.end) {
+			t.Errorf("%s %v: got %s %v-%v, want %s %v-%v", tc.reset, tc.loc, period, start, end, tc.want, tc.start, tc.end)
+		}
+	}
+}
+
+// testPeriodTracker swaps in a period tracker that always asks the remote
+// DB for the latest period, as if every claim was close to a rollover
+func testPeriodTracker(t *testing.T) {
+	web := testConfig(t).Web
+	prev := web.periods
+	web.periods = &periodTracker{skew: 400 * 24 * time.Hour, remote: web.remote, options: web.options, seen: newTTLCache(10, 0)}
+	t.Cleanup(func() { web.periods = prev })
+}
+
+func TestPeriodRollover(t *testing.T) {
+	web, remote := testConfig(t).Web, testRemoteDB(t)
+	ns := testNS(t, "pub/")
+	remote.SetOptions(ns, map[string]string{optReset: resetYearly, optStart: "100"})
+	testPeriodTracker(t)
+
+	year := ns + periodSep + strconv.Itoa(time.Now().UTC().Year())
+	for _, want := range []uint64{100, 101} {
+		c, err := web.claim(ns, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.NS != year || c.First != want {
+			t.Errorf("claim: got %s %d, want %s %d", c.NS, c.First, year, want)
+		}
+	}
+
+	// another server has claimed in the next period, so this one moves to it
+	// and starts again at the start, and never goes back
+	if err := remote.SetPeriod(ns, "9999"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []uint64{100, 101} {
+		c, err := web.claim(ns, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.NS != ns+periodSep+"9999" || c.First != want {
+			t.Errorf("rollover: got %s %d, want %s@9999 %d", c.NS, c.First, ns, want)
+		}
+	}
+	if v, _ := remote.Get([]byte(year)); string(v) != "101" {
+		t.Errorf("the earlier period was moved to %s", v)
+	}
+}
+
+func TestPeriodIdempotent(t *testing.T) {
+	web, remote := testConfig(t).Web, testRemoteDB(t)
+	ns := testNS(t, "pub/")
+	remote.SetOptions(ns, map[string]string{optReset: resetYearly})
+	testPeriodTracker(t)
+
+	a, err := web.claimIdempotent(ns, 1, "10.0.0.1", "key-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.SetPeriod(ns, "9999"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a retry after the rollover gets back the claim of the earlier period
+	again, err := web.claimIdempotent(ns, 1, "10.0.0.1", "key-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.NS != a.NS || again.Last != a.Last {
+		t.Errorf("retry: got %s %d, want %s %d", again.NS, again.Last, a.NS, a.Last)
+	}
+
+	b, err := web.claimIdempotent(ns, 1, "10.0.0.1", "key-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.NS != ns+periodSep+"9999" {
+		t.Errorf("new key: got %s, want the new period", b.NS)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimitSweep is how often the buckets that have filled back up are dropped
+const rateLimitSweep = time.Minute
+
+// rateLimit is a token bucket setting, i.e: rate = "10/s" with a burst of 20
+// lets a client make 20 requests at once, then 10 requests a second after that
+type rateLimit struct {
+	Rate  string `toml:"rate"` // the requests allowed for a time, i.e: "10/s", "600/m" or "5/10s"
+	Burst int    `toml:"burst"`
+}
+
+// serverRateLimits are the rate limits of the public API, each limit is
+// kept by every server on its own
+type serverRateLimits struct {
+	ForwardedFor bool      `toml:"forwarded_for"` // use the X-Forwarded-For header for the client IP, only behind a trusted proxy
+	IP           rateLimit `toml:"ip"`
+	Domain       rateLimit `toml:"domain"`
+	Namespace    rateLimit `toml:"namespace"`
+}
+
+// parseRate returns the tokens added a second for a rate like "10/s"
+func parseRate(rate string) (float64, error) {
+	rr := strings.Split(rate, "/")
+	if len(rr) != 2 {
+		return 0, fmt.Errorf("%q should be like \"10/s\"", rate)
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(rr[0]), 64)
+	if err != nil {
+		return 0, err
+	}
+
+	per := strings.TrimSpace(rr[1])
+	if len(per) > 0 && (per[0] < '0' || per[0] > '9') {
+		per = "1" + per
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 || d <= 0 {
+		return 0, fmt.Errorf("%q must be more than zero", rate)
+	}
+	return n / d.Seconds(), nil
+}
+
+// tokenBucket is the bucket of a single client, domain or namespace
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// tokenBuckets are the token buckets of one kind of rate limit
+type tokenBuckets struct {
+	sync.Mutex
+
+	rate    float64 // the tokens added a second
+	burst   float64 // the most tokens a bucket holds
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+// newTokenBuckets returns the token buckets for a rate limit, or nil if there is no rate
+func newTokenBuckets(name string, limit rateLimit) *tokenBuckets {
+	if len(limit.Rate) == 0 {
+		return nil
+	}
+
+	rate, err := parseRate(limit.Rate)
+	log.OnErr(err).Fatalf("[config] %s rate limit: %v", name, err)
+
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = math.Max(1, math.Ceil(rate))
+	}
+
+	return &tokenBuckets{rate: rate, burst: burst, buckets: make(map[string]*tokenBucket), swept: time.Now()}
+}
+
+// bucket returns the bucket of the key filled up to now, the lock has to be held
+func (tb *tokenBuckets) bucket(key string, now time.Time) *tokenBucket {
+	if now.Sub(tb.swept) > rateLimitSweep {
+		full := time.Duration(tb.burst / tb.rate * float64(time.Second))
+		for k, b := range tb.buckets {
+			if now.Sub(b.last) >= full {
+				delete(tb.buckets, k) // a new bucket is the same as a full one
+			}
+		}
+		tb.swept = now
+	}
+
+	b, ok := tb.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: tb.burst, last: now}
+		tb.buckets[key] = b
+	}
+
+	b.tokens = math.Min(tb.burst, b.tokens+now.Sub(b.last).Seconds()*tb.rate)
+	b.last = now
+	return b
+}
+
+// cost returns the tokens that n numbers take, a batch bigger than the burst
+// empties the bucket rather than never getting through
+func (tb *tokenBuckets) cost(n uint64) float64 {
+	return math.Min(tb.burst, float64(n))
+}
+
+// rateLimiter holds the rate limits of the public API
+type rateLimiter struct {
+	forwardedFor bool
+
+	ip        *tokenBuckets
+	domain    *tokenBuckets
+	namespace *tokenBuckets
+}
+
+// newRateLimiter returns the rate limiter for the public API of the config
+func newRateLimiter(config *configuration) *rateLimiter {
+	rl := config.Server.API.RateLimits
+	return &rateLimiter{
+		forwardedFor: rl.ForwardedFor,
+		ip:           newTokenBuckets("ip", rl.IP),
+		domain:       newTokenBuckets("domain", rl.Domain),
+		namespace:    newTokenBuckets("namespace", rl.Namespace),
+	}
+}
+
+// clientIP returns the IP of the client that made the request. Behind a
+// proxy it's the last X-Forwarded-For entry, which the proxy added, as the
+// entries before it come from the client and can be anything.
+func (rl *rateLimiter) clientIP(r *http.Request) string {
+	if rl.forwardedFor {
+		if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+			entries := strings.Split(fwd[len(fwd)-1], ",")
+			if ip := strings.TrimSpace(entries[len(entries)-1]); len(ip) > 0 {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// take takes a token for each of the n numbers from the bucket of each key,
+// the keys are the client IP, the API domain and the namespace. Every bucket
+// is checked before any is taken from, so a request that is turned away
+// doesn't use up the tokens of the other limits. If a bucket doesn't have
+// enough then it returns how long until it will.
+func (rl *rateLimiter) take(ip, domain, ns string, n uint64, now time.Time) (bool, time.Duration) {
+	var limits []*tokenBuckets
+	var buckets []*tokenBucket
+	for _, limit := range []struct {
+		buckets *tokenBuckets
+		key     string
+	}{
+		{rl.ip, ip},
+		{rl.domain, domain},
+		{rl.namespace, ns},
+	} {
+		if limit.buckets == nil {
+			continue
+		}
+		limit.buckets.Lock() // always locked in the same order
+		defer limit.buckets.Unlock()
+
+		limits = append(limits, limit.buckets)
+		buckets = append(buckets, limit.buckets.bucket(limit.key, now))
+	}
+
+	var wait time.Duration
+	for i, b := range buckets {
+		if cost := limits[i].cost(n); b.tokens < cost {
+			if retry := time.Duration((cost - b.tokens) / limits[i].rate * float64(time.Second)); retry > wait {
+				wait = retry
+			}
+		}
+	}
+	if wait > 0 {
+		return false, wait
+	}
+
+	for i, b := range buckets {
+		b.tokens -= limits[i].cost(n)
+	}
+	return true, 0
+}
+
+// UseRateLimits only lets requests through when the client IP, the API domain
+// and the namespace are all within their rate limits, otherwise it responds
+// with a 429 Too Many Requests and a Retry-After header. Each number asked
+// for with ?count= takes a token.
+func (web *webServer) UseRateLimits(prefix string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ns, _ := namespace(prefix, r)
+
+			count, err := web.batchCount(r)
+			if err != nil {
+				count = 1 // it's turned away by the handler
+			}
+
+			ip, domain := web.limits.clientIP(r), strings.ToLower(strings.Split(r.Host, ":")[0])
+			if ok, retry := web.limits.take(ip, domain, ns, count, time.Now()); !ok {
+				w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(retry.Seconds())), 10))
+				responseOnErr(w, ErrTooManyRequests{errRateLimited})
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	for rate, want := range map[string]float64{"10/s": 10, "600/m": 10, "5/10s": 0.5} {
+		if got, err := parseRate(rate); err != nil || got != want {
+			t.Errorf("%s: got %v %v, want %v", rate, got, err, want)
+		}
+	}
+	for _, rate := range []string{"10", "x/s", "0/s", "10/0s"} {
+		if _, err := parseRate(rate); err == nil {
+			t.Errorf("%s: no error", rate)
+		}
+	}
+}
+
+func TestClientIPForwardedFor(t *testing.T) {
+	rl := &rateLimiter{forwardedFor: true}
+
+	// the entries before the proxy's can be anything the client sent
+	r := httptest.NewRequest("GET", "/pub/ns", nil)
+	r.Header.Add("X-Forwarded-For", "1.1.1.1, 2.2.2.2")
+	r.Header.Add("X-Forwarded-For", "3.3.3.3")
+	if ip := rl.clientIP(r); ip != "3.3.3.3" {
+		t.Errorf("got %s, want 3.3.3.3", ip)
+	}
+
+	rl.forwardedFor = false
+	if ip := rl.clientIP(r); ip != "192.0.2.1" {
+		t.Errorf("got %s, want the remote address", ip)
+	}
+}
+
+func TestRateLimitCountsNumbers(t *testing.T) {
+	rl := &rateLimiter{ip: newTokenBuckets("ip", rateLimit{Rate: "1/s", Burst: 10})}
+	now := time.Now()
+
+	if ok, _ := rl.take("a", "", "", 4, now); !ok {
+		t.Fatal("4 of 10 tokens: turned away")
+	}
+	if ok, retry := rl.take("a", "", "", 7, now); ok || retry != time.Second {
+		t.Errorf("7 of 6 tokens: got %v after %v, want a second to wait", ok, retry)
+	}
+
+	// a batch bigger than the burst waits for the bucket to fill
+	if ok, _ := rl.take("b", "", "", 100, now); !ok {
+		t.Error("100 of 10 tokens: turned away with a full bucket")
+	}
+}
+
+func TestRateLimitTakesAllOrNothing(t *testing.T) {
+	rl := &rateLimiter{
+		ip:        newTokenBuckets("ip", rateLimit{Rate: "1/s", Burst: 2}),
+		namespace: newTokenBuckets("namespace", rateLimit{Rate: "1/s", Burst: 1}),
+	}
+	now := time.Now()
+
+	if ok, _ := rl.take("a", "", "ns", 1, now); !ok {
+		t.Fatal("first request turned away")
+	}
+
+	// the namespace is empty, so the IP bucket is left alone
+	for i := 0; i < 3; i++ {
+		if ok, _ := rl.take("a", "", "ns", 1, now); ok {
+			t.Fatal("the namespace limit let a request through")
+		}
+	}
+	if ok, _ := rl.take("a", "", "other", 1, now); !ok {
+		t.Error("turned away requests took tokens from the IP bucket")
+	}
+}
@@ -1,6 +1,11 @@
 package main
 
-import "sort"
+import (
+	"database/sql"
+	"sort"
+	"strings"
+	"time"
+)
 
 // remoteDBRegister is the global registry for remoteDB implementations
 var remoteDBRegister = map[string]func() remoteDBSetup{}
@@ -9,14 +14,78 @@ var remoteDBRegister = map[string]func() remoteDBSetup{}
 // remoteDB implementation requires
 type remoteDB interface {
 	Keys() ([]string, error)
+	KeysPage(string, string, int) ([]nsValue, error)
 	HasKey(string) bool
 
 	Get([]byte) ([]byte, error)
 	Set([]byte, []byte) error
+	Claim(string, uint64, uint64) (bool, error)
+
+	APIKey(string) ([]string, error)
+
+	Retire(string, tombstone) error
+	Tombstone(string) (*tombstone, error)
+
+	Options(string) (map[string]string, error)
+	SetOptions(string, map[string]string) error
+
+	Idempotent(string, string, time.Time) (*idemRecord, error)
+	SetIdempotent(string, string, idemRecord) error
+	PruneIdempotent(time.Time) error
+
+	Cycle(string) (uint64, error)
+	SetCycle(string, uint64) error
+
+	Period(string) (string, error)
+	SetPeriod(string, string) error
+
+	ClaimLease(lease) (bool, error)
+	Reservation(string) (*lease, error)
+	Reusable(string, time.Time) (*lease, error)
+	TakeLease(lease, lease, time.Time) (bool, error)
+	EndLease(string, string, time.Time) (bool, error)
+
+	ClaimAllocation(allocation) (bool, error)
+	Allocation(string) (*allocation, error)
+	Release(allocation) (bool, error)
+	LowestReleased(string) (uint64, uint64, bool, error)
+	TakeReleased(allocation) (bool, error)
+
+	Issued(string, uint64) (bool, error)
+
+	Thresholds(string) ([]threshold, error)
+	SetThreshold(threshold) error
+	QueueWebhook(threshold, uint64) (bool, error)
+	DueWebhooks(time.Time, int, int) ([]webhookDelivery, error)
+	LeaseWebhook(uint64, int, time.Time) (bool, error)
+	WebhookDelivered(uint64) error
 
 	remoteDBSetup
 }
 
+// nsValue is a namespace and its current highest value
+type nsValue struct {
+	Namespace string
+	Value     uint64
+}
+
+// likePrefix returns a SQL LIKE pattern that matches everything starting
+// with the prefix, the LIKE wildcards in the prefix are escaped
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix) + "%"
+}
+
+// sqlExecer runs a statement on a sql.DB, or as part of a sql.Tx
+type sqlExecer interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+}
+
+// tombstone marks a namespace as retired
+type tombstone struct {
+	Value    uint64 // the highest value of the namespace when it was retired
+	Recreate bool   // if the namespace can be claimed again, starting above the value
+}
+
 // remoteDBSetup is the interface for setting
 // up a remoteDB object
 type remoteDBSetup interface {
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/jackc/pgx/stdlib"
@@ -27,6 +28,7 @@ type crDB struct {
 		DSN string `toml:"dsn"`
 	} `toml:"crdb"`
 
+	mu   sync.RWMutex // guards keys, which is read on every claim
 	keys map[string]struct{}
 
 	*sql.DB
@@ -40,11 +42,157 @@ const crdbTableCreate = `
 CREATE TABLE IF NOT EXISTS keys (
 	id SERIAL PRIMARY KEY,
 	namespace STRING NOT NULL,
+	first INT NULL,
 	value INT NOT NULL,
 	created TIMESTAMP NOT NULL,
+	INDEX ns_idx (namespace),
+	INDEX ns_value_idx (namespace, value)
+);`
+
+// crdbKeysFirstAdd is the SQL for adding the first column to a keys table made
+// before there was one, a range of numbers claimed at once is kept as the first
+// and last (value) numbers of the range, a row without a first is a single number
+const crdbKeysFirstAdd = `ALTER TABLE keys ADD COLUMN IF NOT EXISTS first INT NULL;`
+
+// crdbAPIKeysTableCreate is the SQL for setting up the
+// API keys table on startup, the keys are stored as SHA256 hex
+const crdbAPIKeysTableCreate = `
+CREATE TABLE IF NOT EXISTS apikeys (
+	id SERIAL PRIMARY KEY,
+	apikey STRING NOT NULL,
+	prefix STRING NOT NULL,
+	created TIMESTAMP NOT NULL,
+	INDEX apikey_idx (apikey)
+);`
+
+// crdbTombstonesTableCreate is the SQL for setting up the
+// tombstones table on startup, for retired namespaces
+const crdbTombstonesTableCreate = `
+CREATE TABLE IF NOT EXISTS tombstones (
+	id SERIAL PRIMARY KEY,
+	namespace STRING NOT NULL,
+	value INT NOT NULL,
+	recreate BOOL NOT NULL,
+	created TIMESTAMP NOT NULL,
+	INDEX ns_idx (namespace)
+);`
+
+// crdbOptionsTableCreate is the SQL for setting up the
+// per namespace options table on startup
+const crdbOptionsTableCreate = `
+CREATE TABLE IF NOT EXISTS options (
+	id SERIAL PRIMARY KEY,
+	namespace STRING NOT NULL,
+	name STRING NOT NULL,
+	value STRING NOT NULL,
+	created TIMESTAMP NOT NULL,
+	INDEX ns_idx (namespace)
+);`
+
+// crdbIdempotencyTableCreate is the SQL for setting up the
+// idempotency keys table on startup
+const crdbIdempotencyTableCreate = `
+CREATE TABLE IF NOT EXISTS idempotency (
+	id SERIAL PRIMARY KEY,
+	idemkey STRING NOT NULL,
+	namespace STRING NOT NULL,
+	first INT NOT NULL,
+	last INT NOT NULL,
+	serverid STRING NOT NULL,
+	ts STRING NOT NULL,
+	created TIMESTAMP NOT NULL,
+	INDEX idem_idx (idemkey, namespace),
+	INDEX created_idx (created)
+);`
+
+// crdbCyclesTableCreate is the SQL for setting up the
+// cycles table on startup, for namespaces that wrap at their max
+const crdbCyclesTableCreate = `
+CREATE TABLE IF NOT EXISTS cycles (
+	id SERIAL PRIMARY KEY,
+	namespace STRING NOT NULL,
+	cycle INT NOT NULL,
+	created TIMESTAMP NOT NULL,
+	UNIQUE INDEX ns_cycle_idx (namespace, cycle)
+);`
+
+// crdbPeriodsTableCreate is the SQL for setting up the
+// periods table on startup, for namespaces that reset each period
+const crdbPeriodsTableCreate = `
+CREATE TABLE IF NOT EXISTS periods (
+	id SERIAL PRIMARY KEY,
+	namespace STRING NOT NULL,
+	period STRING NOT NULL,
+	created TIMESTAMP NOT NULL,
+	UNIQUE INDEX ns_period_idx (namespace, period)
+);`
+
+// crdbReservationsTableCreate is the SQL for setting up the reservations
+// table on startup, for gapless namespaces. There is one row for each number
+// that has been reserved, the tokens are stored as SHA256 hex.
+const crdbReservationsTableCreate = `
+CREATE TABLE IF NOT EXISTS reservations (
+	id SERIAL PRIMARY KEY,
+	namespace STRING NOT NULL,
+	number INT NOT NULL,
+	token STRING NOT NULL,
+	state STRING NOT NULL,
+	expires TIMESTAMP NOT NULL,
+	created TIMESTAMP NOT NULL,
+	updated TIMESTAMP NOT NULL,
+	UNIQUE INDEX ns_number_idx (namespace, number),
+	INDEX token_idx (token),
+	INDEX ns_state_idx (namespace, state, number)
+);`
+
+// crdbReleasedTableCreate is the SQL for setting up the released table on
+// startup, for allocator namespaces. A new number is generation 0 and each
+// release of it is the next generation, the owner is the hashed token of
+// the acquire that took it.
+const crdbReleasedTableCreate = `
+CREATE TABLE IF NOT EXISTS released (
+	id SERIAL PRIMARY KEY,
+	namespace STRING NOT NULL,
+	number INT NOT NULL,
+	generation INT NOT NULL,
+	taken BOOL NOT NULL,
+	owner STRING NOT NULL DEFAULT '',
+	created TIMESTAMP NOT NULL,
+	UNIQUE INDEX ns_number_gen_idx (namespace, number, generation),
+	INDEX ns_taken_idx (namespace, taken, number),
+	INDEX owner_idx (owner)
+);`
+
+// crdbThresholdsTableCreate is the SQL for setting up the
+// threshold webhook rules table on startup
+const crdbThresholdsTableCreate = `
+CREATE TABLE IF NOT EXISTS thresholds (
+	id SERIAL PRIMARY KEY,
+	namespace STRING NOT NULL,
+	value INT NOT NULL,
+	url STRING NOT NULL,
+	created TIMESTAMP NOT NULL,
 	INDEX ns_idx (namespace)
 );`
 
+// crdbWebhooksTableCreate is the SQL for setting up the
+// queued webhooks table on startup, a threshold is only queued once
+const crdbWebhooksTableCreate = `
+CREATE TABLE IF NOT EXISTS webhooks (
+	id SERIAL PRIMARY KEY,
+	threshold_id INT NOT NULL,
+	namespace STRING NOT NULL,
+	threshold INT NOT NULL,
+	value INT NOT NULL,
+	url STRING NOT NULL,
+	attempts INT NOT NULL,
+	next_attempt TIMESTAMP NOT NULL,
+	delivered TIMESTAMP NULL,
+	created TIMESTAMP NOT NULL,
+	UNIQUE INDEX threshold_idx (threshold_id),
+	INDEX due_idx (delivered, next_attempt)
+);`
+
 // Setup does the setup of the remoteDB
 func (c *crDB) Setup(config *configuration) remoteDB {
 
@@ -75,6 +223,69 @@ func (c *crDB) Setup(config *configuration) remoteDB {
 	_, err = stmtT.Exec()
 	log.OnErr(err).Fatalf("[crdb] create table exec: %v", err)
 
+	_, err = c.DB.Exec(crdbKeysFirstAdd)
+	log.OnErr(err).Fatalf("[crdb] keys first column add: %v", err)
+
+	stmtK, err := c.DB.Prepare(strings.TrimSpace(crdbAPIKeysTableCreate))
+	log.OnErr(err).Fatalf("[crdb] create apikeys table prep: %v", err)
+
+	_, err = stmtK.Exec()
+	log.OnErr(err).Fatalf("[crdb] create apikeys table exec: %v", err)
+
+	stmtS, err := c.DB.Prepare(strings.TrimSpace(crdbTombstonesTableCreate))
+	log.OnErr(err).Fatalf("[crdb] create tombstones table prep: %v", err)
+
+	_, err = stmtS.Exec()
+	log.OnErr(err).Fatalf("[crdb] create tombstones table exec: %v", err)
+
+	stmtO, err := c.DB.Prepare(strings.TrimSpace(crdbOptionsTableCreate))
+	log.OnErr(err).Fatalf("[crdb] create options table prep: %v", err)
+
+	_, err = stmtO.Exec()
+	log.OnErr(err).Fatalf("[crdb] create options table exec: %v", err)
+
+	stmtI, err := c.DB.Prepare(strings.TrimSpace(crdbIdempotencyTableCreate))
+	log.OnErr(err).Fatalf("[crdb] create idempotency table prep: %v", err)
+
+	_, err = stmtI.Exec()
+	log.OnErr(err).Fatalf("[crdb] create idempotency table exec: %v", err)
+
+	stmtC, err := c.DB.Prepare(strings.TrimSpace(crdbCyclesTableCreate))
+	log.OnErr(err).Fatalf("[crdb] create cycles table prep: %v", err)
+
+	_, err = stmtC.Exec()
+	log.OnErr(err).Fatalf("[crdb] create cycles table exec: %v", err)
+
+	stmtP, err := c.DB.Prepare(strings.TrimSpace(crdbPeriodsTableCreate))
+	log.OnErr(err).Fatalf("[crdb] create periods table prep: %v", err)
+
+	_, err = stmtP.Exec()
+	log.OnErr(err).Fatalf("[crdb] create periods table exec: %v", err)
+
+	stmtR, err := c.DB.Prepare(strings.TrimSpace(crdbReservationsTableCreate))
+	log.OnErr(err).Fatalf("[crdb] create reservations table prep: %v", err)
+
+	_, err = stmtR.Exec()
+	log.OnErr(err).Fatalf("[crdb] create reservations table exec: %v", err)
+
+	stmtL, err := c.DB.Prepare(strings.TrimSpace(crdbReleasedTableCreate))
+	log.OnErr(err).Fatalf("[crdb] create released table prep: %v", err)
+
+	_, err = stmtL.Exec()
+	log.OnErr(err).Fatalf("[crdb] create released table exec: %v", err)
+
+	stmtH, err := c.DB.Prepare(strings.TrimSpace(crdbThresholdsTableCreate))
+	log.OnErr(err).Fatalf("[crdb] create thresholds table prep: %v", err)
+
+	_, err = stmtH.Exec()
+	log.OnErr(err).Fatalf("[crdb] create thresholds table exec: %v", err)
+
+	stmtW, err := c.DB.Prepare(strings.TrimSpace(crdbWebhooksTableCreate))
+	log.OnErr(err).Fatalf("[crdb] create webhooks table prep: %v", err)
+
+	_, err = stmtW.Exec()
+	log.OnErr(err).Fatalf("[crdb] create webhooks table exec: %v", err)
+
 	return c
 }
 
@@ -89,17 +300,26 @@ func (c *crDB) configDisplay(padd int, config *configuration) {
 
 // HashKey returns if the key is in the DB
 func (c *crDB) HasKey(key string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
 	_, ok := c.keys[key]
 	return ok
 }
 
-// Keys is the list of unique keys (namespaces) found within the database
+// Keys is the list of unique keys (namespaces) found within the database,
+// retired namespaces are left out unless they have been claimed again
 func (c *crDB) Keys() (out []string, err error) {
-	sql := "SELECT DISTINCT namespace FROM keys"
+	sql := "SELECT k.namespace FROM keys k " +
+		"LEFT JOIN tombstones t ON t.namespace=k.namespace " +
+		"GROUP BY k.namespace HAVING MAX(k.value) > COALESCE(MAX(t.value), -1)"
 	rows, err := c.DB.Query(sql)
 	if err != nil {
 		return nil, fmt.Errorf("[crdb] keys: %v", err)
 	}
+	defer rows.Close()
+
+	keys := make(map[string]struct{})
 	for rows.Next() {
 		var ns string
 		err = rows.Scan(&ns)
@@ -107,9 +327,37 @@ func (c *crDB) Keys() (out []string, err error) {
 			return nil, fmt.Errorf("[crdb] keys row: %v", err)
 		}
 		out = append(out, ns)
-		c.keys[ns] = struct{}{}
+		keys[ns] = struct{}{}
+	}
+	c.mu.Lock()
+	c.keys = keys // swap in the new keys, so retired keys are dropped
+	c.mu.Unlock()
+	return out, rows.Err()
+}
+
+// KeysPage is a page of the unique keys (namespaces) and their current value, in
+// namespace order. Only namespaces that start with the prefix and come after the
+// after namespace are returned, retired namespaces are left out.
+func (c *crDB) KeysPage(prefix, after string, limit int) (out []nsValue, err error) {
+	sql := "SELECT k.namespace, MAX(k.value) FROM keys k " +
+		"LEFT JOIN tombstones t ON t.namespace=k.namespace " +
+		"WHERE k.namespace LIKE $1 AND k.namespace>$2 " +
+		"GROUP BY k.namespace HAVING MAX(k.value) > COALESCE(MAX(t.value), -1) " +
+		"ORDER BY k.namespace LIMIT $3"
+	rows, err := c.DB.Query(sql, likePrefix(prefix), after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("[crdb] keys page: %v", err)
 	}
-	return out, err
+	defer rows.Close()
+
+	for rows.Next() {
+		var nv nsValue
+		if err = rows.Scan(&nv.Namespace, &nv.Value); err != nil {
+			return nil, fmt.Errorf("[crdb] keys page row: %v", err)
+		}
+		out = append(out, nv)
+	}
+	return out, rows.Err()
 }
 
 // Get returns the value for a given key (namespace)
@@ -143,3 +391,505 @@ func (c *crDB) Set(key, val []byte) error {
 	}
 	return nil
 }
+
+// Claim saves the range of numbers from first to last (value) for a given key
+// (namespace), it returns false without saving anything if any number of the
+// range is in a range that has already been saved, or if the latest tombstone
+// of the namespace doesn't let it be claimed again from first
+func (c *crDB) Claim(ns string, first, last uint64) (bool, error) {
+	return crdbClaim(c.DB, ns, first, last)
+}
+
+// crdbClaim saves a claimed range, see Claim
+func crdbClaim(db sqlExecer, ns string, first, last uint64) (bool, error) {
+	sql := "INSERT INTO keys (namespace, first, value, created) SELECT $1, $2, $3, $4 " +
+		"WHERE NOT EXISTS(SELECT 1 FROM keys WHERE namespace=$1 AND value>=$2 AND COALESCE(first, value)<=$3) " +
+		"AND NOT EXISTS(SELECT 1 FROM (SELECT value, recreate FROM tombstones WHERE namespace=$1 " +
+		"ORDER BY created DESC, id DESC LIMIT 1) t WHERE t.recreate=false OR t.value>=$2)"
+	res, err := db.Exec(sql, ns, first, last, time.Now())
+	if err != nil {
+		return false, fmt.Errorf("[crdb] claim: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("[crdb] claim result: %v", err)
+	}
+	return n == 1, nil
+}
+
+// ClaimLease saves a single number of a gapless namespace along with its
+// reservation in one transaction, so a claimed number always has a lease
+func (c *crDB) ClaimLease(l lease) (bool, error) {
+	tx, err := c.DB.Begin()
+	if err != nil {
+		return false, fmt.Errorf("[crdb] claim lease begin: %v", err)
+	}
+	defer tx.Rollback()
+
+	if ok, err := crdbClaim(tx, l.Namespace, l.Number, l.Number); err != nil || !ok {
+		return false, err
+	}
+
+	sql := "INSERT INTO reservations (namespace, number, token, state, expires, created, updated) VALUES ($1, $2, $3, $4, $5, $6, $6)"
+	if _, err := tx.Exec(sql, l.Namespace, l.Number, l.Token, l.State, l.Expires, time.Now()); err != nil {
+		return false, fmt.Errorf("[crdb] claim lease reserve: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("[crdb] claim lease commit: %v", err)
+	}
+	return true, nil
+}
+
+// ClaimAllocation claims a new number of an allocator namespace and saves
+// it as taken by its owner in the same transaction, it returns false
+// without saving either when the number has already been claimed
+func (c *crDB) ClaimAllocation(a allocation) (bool, error) {
+	tx, err := c.DB.Begin()
+	if err != nil {
+		return false, fmt.Errorf("[crdb] claim allocation begin: %v", err)
+	}
+	defer tx.Rollback()
+
+	if ok, err := crdbClaim(tx, a.Namespace, a.Number, a.Number); err != nil || !ok {
+		return false, err
+	}
+
+	sql := "INSERT INTO released (namespace, number, generation, taken, owner, created) VALUES ($1, $2, 0, true, $3, $4)"
+	if _, err := tx.Exec(sql, a.Namespace, a.Number, a.Owner, time.Now()); err != nil {
+		return false, fmt.Errorf("[crdb] claim allocation owner: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("[crdb] claim allocation commit: %v", err)
+	}
+	return true, nil
+}
+
+// APIKey returns the namespace prefixes that the (hashed) API key is allowed to use
+func (c *crDB) APIKey(key string) (out []string, err error) {
+	sql := "SELECT prefix FROM apikeys WHERE apikey=$1"
+	rows, err := c.DB.Query(sql, key)
+	if err != nil {
+		return nil, fmt.Errorf("[crdb] apikey: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var prefix string
+		if err = rows.Scan(&prefix); err != nil {
+			return nil, fmt.Errorf("[crdb] apikey row: %v", err)
+		}
+		out = append(out, prefix)
+	}
+	return out, rows.Err()
+}
+
+// Retire writes a tombstone for the namespace
+func (c *crDB) Retire(ns string, ts tombstone) error {
+	sql := "INSERT INTO tombstones (namespace, value, recreate, created) VALUES ($1, $2, $3, $4)"
+	_, err := c.DB.Exec(sql, ns, ts.Value, ts.Recreate, time.Now())
+	if err != nil {
+		return fmt.Errorf("[crdb] retire: %v", err)
+	}
+	c.mu.Lock()
+	delete(c.keys, ns)
+	c.mu.Unlock()
+	return nil
+}
+
+// Tombstone returns the latest tombstone for the namespace, or nil if
+// the namespace has never been retired
+func (c *crDB) Tombstone(ns string) (*tombstone, error) {
+	sql := "SELECT value, recreate FROM tombstones WHERE namespace=$1 ORDER BY created DESC, id DESC LIMIT 1"
+	rows, err := c.DB.Query(sql, ns)
+	if err != nil {
+		return nil, fmt.Errorf("[crdb] tombstone: %v", err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	ts := new(tombstone)
+	if err = rows.Scan(&ts.Value, &ts.Recreate); err != nil {
+		return nil, fmt.Errorf("[crdb] tombstone row: %v", err)
+	}
+	return ts, nil
+}
+
+// Options returns the latest value of each option set for the namespace
+func (c *crDB) Options(ns string) (map[string]string, error) {
+	sql := "SELECT name, value FROM options WHERE namespace=$1 ORDER BY created, id"
+	rows, err := c.DB.Query(sql, ns)
+	if err != nil {
+		return nil, fmt.Errorf("[crdb] options: %v", err)
+	}
+	defer rows.Close()
+
+	var opts = make(map[string]string)
+	for rows.Next() {
+		var name, val string
+		if err = rows.Scan(&name, &val); err != nil {
+			return nil, fmt.Errorf("[crdb] options row: %v", err)
+		}
+		opts[name] = val // later rows replace earlier ones
+	}
+	return opts, rows.Err()
+}
+
+// SetOptions saves the options for the namespace
+func (c *crDB) SetOptions(ns string, opts map[string]string) error {
+	tx, err := c.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("[crdb] set options: %v", err)
+	}
+
+	sql := "INSERT INTO options (namespace, name, value, created) VALUES ($1, $2, $3, $4)"
+	for name, val := range opts {
+		if _, err = tx.Exec(sql, ns, name, val, time.Now()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("[crdb] set options %s: %v", name, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("[crdb] set options commit: %v", err)
+	}
+	return nil
+}
+
+// Idempotent returns the claim made for the idempotency key of the namespace
+// since the time passed in, or nil if there wasn't a claim
+func (c *crDB) Idempotent(key, ns string, since time.Time) (*idemRecord, error) {
+	sql := "SELECT namespace, first, last, serverid, ts FROM idempotency " +
+		"WHERE idemkey=$1 AND (namespace=$2 OR namespace LIKE $3) AND created>$4 ORDER BY created, id LIMIT 1"
+	rows, err := c.DB.Query(sql, key, ns, likePrefix(ns+periodSep), since) // a claim may be in a period of the namespace
+	if err != nil {
+		return nil, fmt.Errorf("[crdb] idempotent: %v", err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	rec := new(idemRecord)
+	if err = rows.Scan(&rec.NS, &rec.First, &rec.Last, &rec.ServerID, &rec.Timestamp); err != nil {
+		return nil, fmt.Errorf("[crdb] idempotent row: %v", err)
+	}
+	return rec, nil
+}
+
+// PruneIdempotent deletes the claims made for idempotency keys before the time
+func (c *crDB) PruneIdempotent(before time.Time) error {
+	if _, err := c.DB.Exec("DELETE FROM idempotency WHERE created<$1", before); err != nil {
+		return fmt.Errorf("[crdb] prune idempotent: %v", err)
+	}
+	return nil
+}
+
+// SetIdempotent saves the claim made for the idempotency key of the namespace
+func (c *crDB) SetIdempotent(key, ns string, rec idemRecord) error {
+	sql := "INSERT INTO idempotency (idemkey, namespace, first, last, serverid, ts, created) VALUES ($1, $2, $3, $4, $5, $6, $7)"
+	_, err := c.DB.Exec(sql, key, ns, rec.First, rec.Last, rec.ServerID, rec.Timestamp, time.Now())
+	if err != nil {
+		return fmt.Errorf("[crdb] set idempotent: %v", err)
+	}
+	return nil
+}
+
+// Cycle returns the latest cycle recorded for a wrapping namespace, zero
+// if it hasn't wrapped yet
+func (c *crDB) Cycle(ns string) (uint64, error) {
+	sql := "SELECT COALESCE(MAX(cycle), 0) FROM cycles WHERE namespace=$1"
+	var cycle uint64
+	if err := c.DB.QueryRow(sql, ns).Scan(&cycle); err != nil {
+		return 0, fmt.Errorf("[crdb] cycle: %v", err)
+	}
+	return cycle, nil
+}
+
+// SetCycle records that a wrapping namespace has started a new cycle, a
+// cycle that is already recorded is left as it is
+func (c *crDB) SetCycle(ns string, cycle uint64) error {
+	sql := "INSERT INTO cycles (namespace, cycle, created) VALUES ($1, $2, $3) ON CONFLICT (namespace, cycle) DO NOTHING"
+	if _, err := c.DB.Exec(sql, ns, cycle, time.Now()); err != nil {
+		return fmt.Errorf("[crdb] set cycle: %v", err)
+	}
+	return nil
+}
+
+// Period returns the latest period recorded for a namespace that resets,
+// empty if none has been recorded
+func (c *crDB) Period(ns string) (string, error) {
+	sql := "SELECT COALESCE(MAX(period), '') FROM periods WHERE namespace=$1"
+	var period string
+	if err := c.DB.QueryRow(sql, ns).Scan(&period); err != nil {
+		return "", fmt.Errorf("[crdb] period: %v", err)
+	}
+	return period, nil
+}
+
+// SetPeriod records that a namespace that resets has started a new period, a
+// period that is already recorded is left as it is
+func (c *crDB) SetPeriod(ns, period string) error {
+	sql := "INSERT INTO periods (namespace, period, created) VALUES ($1, $2, $3) ON CONFLICT (namespace, period) DO NOTHING"
+	if _, err := c.DB.Exec(sql, ns, period, time.Now()); err != nil {
+		return fmt.Errorf("[crdb] set period: %v", err)
+	}
+	return nil
+}
+
+// Reservation returns the reserved number of the token, nil if there isn't one
+func (c *crDB) Reservation(token string) (*lease, error) {
+	sql := "SELECT namespace, number, token, state, expires FROM reservations WHERE token=$1 LIMIT 1"
+	rows, err := c.DB.Query(sql, token)
+	if err != nil {
+		return nil, fmt.Errorf("[crdb] reservation: %v", err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	l := new(lease)
+	if err = rows.Scan(&l.Namespace, &l.Number, &l.Token, &l.State, &l.Expires); err != nil {
+		return nil, fmt.Errorf("[crdb] reservation row: %v", err)
+	}
+	return l, nil
+}
+
+// Reusable returns the lowest number of the namespace that was aborted or
+// whose lease has expired, nil if there isn't one
+func (c *crDB) Reusable(ns string, now time.Time) (*lease, error) {
+	sql := "SELECT namespace, number, token, state, expires FROM reservations " +
+		"WHERE namespace=$1 AND (state=$2 OR (state=$3 AND expires<$4)) ORDER BY number LIMIT 1"
+	rows, err := c.DB.Query(sql, ns, leaseAborted, leaseReserved, now)
+	if err != nil {
+		return nil, fmt.Errorf("[crdb] reusable: %v", err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	l := new(lease)
+	if err = rows.Scan(&l.Namespace, &l.Number, &l.Token, &l.State, &l.Expires); err != nil {
+		return nil, fmt.Errorf("[crdb] reusable row: %v", err)
+	}
+	return l, nil
+}
+
+// TakeLease gives a reusable number a new lease, it's only taken if it's still
+// reusable with the same token, so only one claim gets the number
+func (c *crDB) TakeLease(from, to lease, now time.Time) (bool, error) {
+	sql := "UPDATE reservations SET token=$1, state=$2, expires=$3, updated=$4 " +
+		"WHERE namespace=$5 AND number=$6 AND token=$7 AND (state=$8 OR (state=$9 AND expires<$4))"
+	res, err := c.DB.Exec(sql, to.Token, to.State, to.Expires, now, from.Namespace, from.Number, from.Token, leaseAborted, leaseReserved)
+	if err != nil {
+		return false, fmt.Errorf("[crdb] take lease: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("[crdb] take lease result: %v", err)
+	}
+	return n == 1, nil
+}
+
+// EndLease commits or aborts the number reserved with the token, only while
+// its lease hasn't expired
+func (c *crDB) EndLease(token, state string, now time.Time) (bool, error) {
+	sql := "UPDATE reservations SET state=$1, updated=$2 WHERE token=$3 AND state=$4 AND expires>$2"
+	res, err := c.DB.Exec(sql, state, now, token, leaseReserved)
+	if err != nil {
+		return false, fmt.Errorf("[crdb] end lease: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("[crdb] end lease result: %v", err)
+	}
+	return n == 1, nil
+}
+
+// Allocation returns the number acquired by the (hashed) owner token, and
+// if it has been released since, nil if there isn't one
+func (c *crDB) Allocation(owner string) (*allocation, error) {
+	sql := "SELECT r.namespace, r.number, r.generation, r.owner, EXISTS(SELECT 1 FROM released n " +
+		"WHERE n.namespace=r.namespace AND n.number=r.number AND n.generation>r.generation) " +
+		"FROM released r WHERE r.owner=$1 AND r.taken=true LIMIT 1"
+	rows, err := c.DB.Query(sql, owner)
+	if err != nil {
+		return nil, fmt.Errorf("[crdb] allocation: %v", err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	a := new(allocation)
+	if err = rows.Scan(&a.Namespace, &a.Number, &a.Generation, &a.Owner, &a.Released); err != nil {
+		return nil, fmt.Errorf("[crdb] allocation row: %v", err)
+	}
+	return a, nil
+}
+
+// Release records the next generation of the acquired number as released,
+// it returns false if it's already been released
+func (c *crDB) Release(a allocation) (bool, error) {
+	sql := "INSERT INTO released (namespace, number, generation, taken, created) VALUES ($1, $2, $3, false, $4) " +
+		"ON CONFLICT (namespace, number, generation) DO NOTHING"
+	res, err := c.DB.Exec(sql, a.Namespace, a.Number, a.Generation+1, time.Now())
+	if err != nil {
+		return false, fmt.Errorf("[crdb] release: %v", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("[crdb] release result: %v", err)
+	}
+	return affected == 1, nil // another server released it at the same time
+}
+
+// LowestReleased returns the lowest number of the namespace that is released
+// and not taken, with its generation
+func (c *crDB) LowestReleased(ns string) (uint64, uint64, bool, error) {
+	sql := "SELECT number, generation FROM released WHERE namespace=$1 AND taken=false ORDER BY number LIMIT 1"
+	rows, err := c.DB.Query(sql, ns)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("[crdb] lowest released: %v", err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return 0, 0, false, rows.Err()
+	}
+
+	var n, gen uint64
+	if err = rows.Scan(&n, &gen); err != nil {
+		return 0, 0, false, fmt.Errorf("[crdb] lowest released row: %v", err)
+	}
+	return n, gen, true, nil
+}
+
+// TakeReleased marks a generation of a released number as taken by its
+// owner, it returns false if it was already taken
+func (c *crDB) TakeReleased(a allocation) (bool, error) {
+	sql := "UPDATE released SET taken=true, owner=$1 WHERE namespace=$2 AND number=$3 AND generation=$4 AND taken=false"
+	res, err := c.DB.Exec(sql, a.Owner, a.Namespace, a.Number, a.Generation)
+	if err != nil {
+		return false, fmt.Errorf("[crdb] take released: %v", err)
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("[crdb] take released result: %v", err)
+	}
+	return rows == 1, nil
+}
+
+// Issued returns if the number has been claimed in the namespace, either
+// on its own or as part of a range
+func (c *crDB) Issued(ns string, n uint64) (bool, error) {
+	sql := "SELECT EXISTS(SELECT 1 FROM keys WHERE namespace=$1 AND value>=$2 AND COALESCE(first, value)<=$2)"
+	var issued bool
+	if err := c.DB.QueryRow(sql, ns, n).Scan(&issued); err != nil {
+		return false, fmt.Errorf("[crdb] issued: %v", err)
+	}
+	return issued, nil
+}
+
+// Thresholds returns the threshold rules of the namespace, the latest row
+// for each threshold value is the rule and an empty url means it was removed
+func (c *crDB) Thresholds(ns string) (out []threshold, err error) {
+	sql := "SELECT t.id, t.value, t.url FROM thresholds t " +
+		"WHERE t.namespace=$1 AND t.url<>'' AND t.id=(" +
+		"SELECT MAX(l.id) FROM thresholds l WHERE l.namespace=t.namespace AND l.value=t.value) " +
+		"ORDER BY t.value"
+	rows, err := c.DB.Query(sql, ns)
+	if err != nil {
+		return nil, fmt.Errorf("[crdb] thresholds: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t = threshold{Namespace: ns}
+		if err = rows.Scan(&t.ID, &t.Value, &t.URL); err != nil {
+			return nil, fmt.Errorf("[crdb] thresholds row: %v", err)
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// SetThreshold saves a threshold rule
+func (c *crDB) SetThreshold(t threshold) error {
+	sql := "INSERT INTO thresholds (namespace, value, url, created) VALUES ($1, $2, $3, $4)"
+	_, err := c.DB.Exec(sql, t.Namespace, t.Value, t.URL, time.Now())
+	if err != nil {
+		return fmt.Errorf("[crdb] set threshold: %v", err)
+	}
+	return nil
+}
+
+// QueueWebhook queues the webhook for a threshold that a claimed number
+// has reached, it returns false if the threshold was already queued
+func (c *crDB) QueueWebhook(t threshold, value uint64) (bool, error) {
+	sql := "INSERT INTO webhooks (threshold_id, namespace, threshold, value, url, attempts, next_attempt, created) " +
+		"VALUES ($1, $2, $3, $4, $5, 0, $6, $7) ON CONFLICT (threshold_id) DO NOTHING"
+	now := time.Now()
+	res, err := c.DB.Exec(sql, t.ID, t.Namespace, t.Value, value, t.URL, now, now)
+	if err != nil {
+		return false, fmt.Errorf("[crdb] queue webhook: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("[crdb] queue webhook result: %v", err)
+	}
+	return n == 1, nil
+}
+
+// DueWebhooks returns the webhooks that haven't been delivered and are due for another attempt
+func (c *crDB) DueWebhooks(now time.Time, maxAttempts, limit int) (out []webhookDelivery, err error) {
+	sql := "SELECT id, namespace, threshold, value, url, attempts, created FROM webhooks " +
+		"WHERE delivered IS NULL AND attempts<$1 AND next_attempt<=$2 ORDER BY next_attempt LIMIT $3"
+	rows, err := c.DB.Query(sql, maxAttempts, now, limit)
+	if err != nil {
+		return nil, fmt.Errorf("[crdb] due webhooks: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d webhookDelivery
+		if err = rows.Scan(&d.ID, &d.Namespace, &d.Threshold, &d.Value, &d.URL, &d.Attempts, &d.Created); err != nil {
+			return nil, fmt.Errorf("[crdb] due webhooks row: %v", err)
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+// LeaseWebhook counts an attempt of the webhook and sets when the next one
+// is due, it returns false if another server counted the attempt first
+func (c *crDB) LeaseWebhook(id uint64, attempts int, next time.Time) (bool, error) {
+	sql := "UPDATE webhooks SET attempts=attempts+1, next_attempt=$1 " +
+		"WHERE id=$2 AND attempts=$3 AND delivered IS NULL"
+	res, err := c.DB.Exec(sql, next, id, attempts)
+	if err != nil {
+		return false, fmt.Errorf("[crdb] lease webhook: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("[crdb] lease webhook result: %v", err)
+	}
+	return n == 1, nil
+}
+
+// WebhookDelivered marks the webhook as delivered
+func (c *crDB) WebhookDelivered(id uint64) error {
+	sql := "UPDATE webhooks SET delivered=$1 WHERE id=$2"
+	if _, err := c.DB.Exec(sql, time.Now(), id); err != nil {
+		return fmt.Errorf("[crdb] webhook delivered: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,522 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryIdentifier is the identifier used for DB registration, it's only
+// registered for the tests
+const memoryIdentifier = "memory"
+
+func init() {
+	remoteDBRegister[memoryIdentifier] = func() remoteDBSetup { return newMemoryDB() }
+}
+
+// memoryDB is a remoteDB kept in memory, it follows the same rules as the
+// SQL datastores so the claim paths can be tested without one
+type memoryDB struct {
+	mu sync.Mutex
+
+	keys         map[string][][2]uint64 // the first and last number of each claim
+	apikeys      map[string][]string
+	tombstones   map[string][]tombstone
+	options      map[string]map[string]string
+	idempotency  []memoryIdem
+	cycles       map[string]uint64
+	periods      map[string]string
+	reservations []*lease
+	released     map[string][]memoryRelease
+	thresholds   []threshold
+	webhooks     []*memoryWebhook
+}
+
+type memoryIdem struct {
+	key, ns string
+	rec     idemRecord
+	created time.Time
+}
+
+type memoryRelease struct {
+	number, generation uint64
+	taken              bool
+	owner              string
+}
+
+type memoryWebhook struct {
+	webhookDelivery
+	thresholdID uint64
+	next        time.Time
+	delivered   bool
+}
+
+func newMemoryDB() *memoryDB {
+	return &memoryDB{
+		keys:       make(map[string][][2]uint64),
+		apikeys:    make(map[string][]string),
+		tombstones: make(map[string][]tombstone),
+		options:    make(map[string]map[string]string),
+		cycles:     make(map[string]uint64),
+		periods:    make(map[string]string),
+		released:   make(map[string][]memoryRelease),
+	}
+}
+
+func (m *memoryDB) Setup(*configuration) remoteDB { return m }
+
+// max returns the highest value of the namespace, the lock must be held
+func (m *memoryDB) max(ns string) (max uint64, ok bool) {
+	for _, k := range m.keys[ns] {
+		if !ok || k[1] > max {
+			max, ok = k[1], true
+		}
+	}
+	return max, ok
+}
+
+// live returns if the namespace has a value above its latest tombstone, the lock must be held
+func (m *memoryDB) live(ns string) bool {
+	max, ok := m.max(ns)
+	if !ok {
+		return false
+	}
+	for _, ts := range m.tombstones[ns] {
+		if ts.Value >= max {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *memoryDB) Keys() (out []string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for ns := range m.keys {
+		if m.live(ns) {
+			out = append(out, ns)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func (m *memoryDB) KeysPage(prefix, after string, limit int) (out []nsValue, err error) {
+	keys, _ := m.Keys()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, ns := range keys {
+		if likeMatch(likePrefix(prefix), ns) && ns > after && len(out) < limit {
+			max, _ := m.max(ns)
+			out = append(out, nsValue{Namespace: ns, Value: max})
+		}
+	}
+	return out, nil
+}
+
+// likeMatch returns if the string matches the SQL LIKE pattern, with a
+// backslash escaping the wildcards as the SQL datastores do
+func likeMatch(pattern, s string) bool {
+	var re strings.Builder
+	re.WriteString("(?s)^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case c == '%':
+			re.WriteString(".*")
+		case c == '_':
+			re.WriteString(".")
+		default:
+			re.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	re.WriteString("$")
+	return regexp.MustCompile(re.String()).MatchString(s)
+}
+
+func (m *memoryDB) HasKey(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.live(key)
+}
+
+func (m *memoryDB) Get(key []byte) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	max, ok := m.max(string(key))
+	if !ok {
+		return nil, nil
+	}
+	return []byte(strconv.FormatUint(max, 10)), nil
+}
+
+func (m *memoryDB) Set(key, val []byte) error {
+	v, err := strconv.ParseUint(string(val), 10, 64)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys[string(key)] = append(m.keys[string(key)], [2]uint64{v, v})
+	return nil
+}
+
+func (m *memoryDB) Claim(ns string, first, last uint64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if tss := m.tombstones[ns]; len(tss) > 0 {
+		if ts := tss[len(tss)-1]; !ts.Recreate || ts.Value >= first {
+			return false, nil
+		}
+	}
+	for _, k := range m.keys[ns] {
+		if k[1] >= first && k[0] <= last {
+			return false, nil
+		}
+	}
+	m.keys[ns] = append(m.keys[ns], [2]uint64{first, last})
+	return true, nil
+}
+
+func (m *memoryDB) APIKey(key string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.apikeys[key], nil
+}
+
+func (m *memoryDB) Retire(ns string, ts tombstone) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tombstones[ns] = append(m.tombstones[ns], ts)
+	return nil
+}
+
+func (m *memoryDB) Tombstone(ns string) (*tombstone, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tss := m.tombstones[ns]
+	if len(tss) == 0 {
+		return nil, nil
+	}
+	ts := tss[len(tss)-1]
+	return &ts, nil
+}
+
+func (m *memoryDB) Options(ns string) (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var opts = make(map[string]string)
+	for k, v := range m.options[ns] {
+		opts[k] = v
+	}
+	return opts, nil
+}
+
+func (m *memoryDB) SetOptions(ns string, opts map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.options[ns] == nil {
+		m.options[ns] = make(map[string]string)
+	}
+	for k, v := range opts {
+		m.options[ns][k] = v
+	}
+	return nil
+}
+
+func (m *memoryDB) Idempotent(key, ns string, since time.Time) (*idemRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, idem := range m.idempotency {
+		if idem.key == key && (idem.ns == ns || strings.HasPrefix(idem.ns, ns+periodSep)) && idem.created.After(since) {
+			rec := idem.rec
+			rec.NS = idem.ns
+			return &rec, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *memoryDB) PruneIdempotent(before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.idempotency[:0]
+	for _, idem := range m.idempotency {
+		if !idem.created.Before(before) {
+			kept = append(kept, idem)
+		}
+	}
+	m.idempotency = kept
+	return nil
+}
+
+func (m *memoryDB) SetIdempotent(key, ns string, rec idemRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.idempotency = append(m.idempotency, memoryIdem{key: key, ns: ns, rec: rec, created: time.Now()})
+	return nil
+}
+
+func (m *memoryDB) Cycle(ns string) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cycles[ns], nil
+}
+
+func (m *memoryDB) SetCycle(ns string, cycle uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cycle > m.cycles[ns] {
+		m.cycles[ns] = cycle
+	}
+	return nil
+}
+
+func (m *memoryDB) Period(ns string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.periods[ns], nil
+}
+
+func (m *memoryDB) SetPeriod(ns, period string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if period > m.periods[ns] {
+		m.periods[ns] = period
+	}
+	return nil
+}
+
+func (m *memoryDB) ClaimLease(l lease) (bool, error) {
+	if ok, err := m.Claim(l.Namespace, l.Number, l.Number); err != nil || !ok {
+		return false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reservations = append(m.reservations, &l)
+	return true, nil
+}
+
+func (m *memoryDB) Reservation(token string) (*lease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, l := range m.reservations {
+		if l.Token == token {
+			found := *l
+			return &found, nil
+		}
+	}
+	return nil, nil
+}
+
+// reusable returns if the lease can be given out again, the lock must be held
+func reusable(l *lease, now time.Time) bool {
+	return l.State == leaseAborted || (l.State == leaseReserved && l.Expires.Before(now))
+}
+
+func (m *memoryDB) Reusable(ns string, now time.Time) (*lease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var low *lease
+	for _, l := range m.reservations {
+		if l.Namespace == ns && reusable(l, now) && (low == nil || l.Number < low.Number) {
+			low = l
+		}
+	}
+	if low == nil {
+		return nil, nil
+	}
+	found := *low
+	return &found, nil
+}
+
+func (m *memoryDB) TakeLease(from, to lease, now time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, l := range m.reservations {
+		if l.Namespace == from.Namespace && l.Number == from.Number && l.Token == from.Token && reusable(l, now) {
+			l.Token, l.State, l.Expires = to.Token, to.State, to.Expires
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *memoryDB) EndLease(token, state string, now time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, l := range m.reservations {
+		if l.Token == token && l.State == leaseReserved && l.Expires.After(now) {
+			l.State = state
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *memoryDB) ClaimAllocation(a allocation) (bool, error) {
+	if ok, err := m.Claim(a.Namespace, a.Number, a.Number); err != nil || !ok {
+		return false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.released[a.Namespace] = append(m.released[a.Namespace], memoryRelease{number: a.Number, taken: true, owner: a.Owner})
+	return true, nil
+}
+
+func (m *memoryDB) Allocation(owner string) (*allocation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for ns, rr := range m.released {
+		for _, r := range rr {
+			if r.taken && r.owner == owner {
+				a := &allocation{Namespace: ns, Number: r.number, Generation: r.generation, Owner: owner}
+				for _, next := range rr {
+					a.Released = a.Released || (next.number == r.number && next.generation > r.generation)
+				}
+				return a, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (m *memoryDB) Release(a allocation) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range m.released[a.Namespace] {
+		if r.number == a.Number && r.generation == a.Generation+1 {
+			return false, nil
+		}
+	}
+	m.released[a.Namespace] = append(m.released[a.Namespace], memoryRelease{number: a.Number, generation: a.Generation + 1})
+	return true, nil
+}
+
+func (m *memoryDB) LowestReleased(ns string) (uint64, uint64, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var low *memoryRelease
+	for i, r := range m.released[ns] {
+		if !r.taken && (low == nil || r.number < low.number) {
+			low = &m.released[ns][i]
+		}
+	}
+	if low == nil {
+		return 0, 0, false, nil
+	}
+	return low.number, low.generation, true, nil
+}
+
+func (m *memoryDB) TakeReleased(a allocation) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, r := range m.released[a.Namespace] {
+		if r.number == a.Number && r.generation == a.Generation && !r.taken {
+			m.released[a.Namespace][i].taken = true
+			m.released[a.Namespace][i].owner = a.Owner
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *memoryDB) Issued(ns string, n uint64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, k := range m.keys[ns] {
+		if k[0] <= n && n <= k[1] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *memoryDB) Thresholds(ns string) (out []threshold, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var latest = make(map[uint64]threshold)
+	for _, t := range m.thresholds {
+		if t.Namespace == ns {
+			latest[t.Value] = t
+		}
+	}
+	for _, t := range latest {
+		if len(t.URL) > 0 {
+			out = append(out, t)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Value < out[j].Value })
+	return out, nil
+}
+
+func (m *memoryDB) SetThreshold(t threshold) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t.ID = uint64(len(m.thresholds) + 1)
+	m.thresholds = append(m.thresholds, t)
+	return nil
+}
+
+func (m *memoryDB) QueueWebhook(t threshold, value uint64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, wh := range m.webhooks {
+		if wh.thresholdID == t.ID {
+			return false, nil
+		}
+	}
+	now := time.Now()
+	m.webhooks = append(m.webhooks, &memoryWebhook{
+		webhookDelivery: webhookDelivery{
+			ID:        uint64(len(m.webhooks) + 1),
+			Namespace: t.Namespace,
+			Threshold: t.Value,
+			Value:     value,
+			URL:       t.URL,
+			Created:   now,
+		},
+		thresholdID: t.ID,
+		next:        now,
+	})
+	return true, nil
+}
+
+func (m *memoryDB) DueWebhooks(now time.Time, maxAttempts, limit int) (out []webhookDelivery, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, wh := range m.webhooks {
+		if !wh.delivered && wh.Attempts < maxAttempts && !wh.next.After(now) && len(out) < limit {
+			out = append(out, wh.webhookDelivery)
+		}
+	}
+	return out, nil
+}
+
+func (m *memoryDB) LeaseWebhook(id uint64, attempts int, next time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, wh := range m.webhooks {
+		if wh.ID == id && wh.Attempts == attempts && !wh.delivered {
+			wh.Attempts, wh.next = wh.Attempts+1, next
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *memoryDB) WebhookDelivered(id uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, wh := range m.webhooks {
+		if wh.ID == id {
+			wh.delivered = true
+		}
+	}
+	return nil
+}
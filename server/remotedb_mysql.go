@@ -5,9 +5,10 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
 // MySQLIdentifier is the identifier used for DB registration
@@ -26,6 +27,7 @@ type mysqlDB struct {
 		DSN string `toml:"dsn"`
 	} `toml:"mysql"`
 
+	mu   sync.RWMutex // guards keys, which is read on every claim
 	keys map[string]struct{}
 
 	*sql.DB
@@ -39,13 +41,184 @@ const mysqlTableCreate = `
 CREATE TABLE IF NOT EXISTS keys (
 	id INT UNSIGNED NOT NULL AUTO_INCREMENT,
 	namespace TINYTEXT NOT NULL,
+	first BIGINT NULL,
 	value BIGINT NOT NULL,
 	created DATETIME NOT NULL,
 	PRIMARY KEY (id),
+	INDEX (namespace(255)),
+	INDEX (namespace(255), value)
+)
+ENGINE=InnoDB;`
+
+// mysqlKeysFirstColumn is the SQL for finding if the keys table has the first
+// column, a range of numbers claimed at once is kept as the first and last
+// (value) numbers of the range, a row without a first is a single number
+const mysqlKeysFirstColumn = "SELECT COUNT(*) FROM `information_schema`.`COLUMNS` " +
+	"WHERE `TABLE_SCHEMA`=DATABASE() AND `TABLE_NAME`='keys' AND `COLUMN_NAME`='first'"
+
+// mysqlKeysFirstAdd is the SQL for adding the first column to a keys table
+// made before there was one
+const mysqlKeysFirstAdd = "ALTER TABLE `keys` ADD COLUMN `first` BIGINT NULL AFTER `namespace`"
+
+// mysqlAPIKeysTableCreate is the SQL for setting up the
+// API keys table on startup, the keys are stored as SHA256 hex
+const mysqlAPIKeysTableCreate = `
+CREATE TABLE IF NOT EXISTS apikeys (
+	id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+	apikey CHAR(64) NOT NULL,
+	prefix TINYTEXT NOT NULL,
+	created DATETIME NOT NULL,
+	PRIMARY KEY (id),
+	INDEX (apikey)
+)
+ENGINE=InnoDB;`
+
+// mysqlTombstonesTableCreate is the SQL for setting up the
+// tombstones table on startup, for retired namespaces
+const mysqlTombstonesTableCreate = `
+CREATE TABLE IF NOT EXISTS tombstones (
+	id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+	namespace TINYTEXT NOT NULL,
+	value BIGINT NOT NULL,
+	recreate BOOL NOT NULL,
+	created DATETIME NOT NULL,
+	PRIMARY KEY (id),
+	INDEX (namespace(255))
+)
+ENGINE=InnoDB;`
+
+// mysqlOptionsTableCreate is the SQL for setting up the
+// per namespace options table on startup
+const mysqlOptionsTableCreate = `
+CREATE TABLE IF NOT EXISTS options (
+	id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+	namespace TINYTEXT NOT NULL,
+	name VARCHAR(64) NOT NULL,
+	value TEXT NOT NULL,
+	created DATETIME NOT NULL,
+	PRIMARY KEY (id),
+	INDEX (namespace(255))
+)
+ENGINE=InnoDB;`
+
+// mysqlIdempotencyTableCreate is the SQL for setting up the
+// idempotency keys table on startup
+const mysqlIdempotencyTableCreate = `
+CREATE TABLE IF NOT EXISTS idempotency (
+	id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+	idemkey VARCHAR(255) NOT NULL,
+	namespace TINYTEXT NOT NULL,
+	first BIGINT NOT NULL,
+	last BIGINT NOT NULL,
+	serverid VARCHAR(64) NOT NULL,
+	ts VARCHAR(32) NOT NULL,
+	created DATETIME NOT NULL,
+	PRIMARY KEY (id),
+	INDEX (idemkey, namespace(255)),
+	INDEX (created)
+)
+ENGINE=InnoDB;`
+
+// mysqlCyclesTableCreate is the SQL for setting up the
+// cycles table on startup, for namespaces that wrap at their max
+const mysqlCyclesTableCreate = `
+CREATE TABLE IF NOT EXISTS cycles (
+	id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+	namespace TINYTEXT NOT NULL,
+	cycle BIGINT NOT NULL,
+	created DATETIME NOT NULL,
+	PRIMARY KEY (id),
+	UNIQUE (namespace(255), cycle)
+)
+ENGINE=InnoDB;`
+
+// mysqlPeriodsTableCreate is the SQL for setting up the
+// periods table on startup, for namespaces that reset each period
+const mysqlPeriodsTableCreate = `
+CREATE TABLE IF NOT EXISTS periods (
+	id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+	namespace TINYTEXT NOT NULL,
+	period VARCHAR(16) NOT NULL,
+	created DATETIME NOT NULL,
+	PRIMARY KEY (id),
+	UNIQUE (namespace(255), period)
+)
+ENGINE=InnoDB;`
+
+// mysqlReservationsTableCreate is the SQL for setting up the reservations
+// table on startup, for gapless namespaces. There is one row for each number
+// that has been reserved, the tokens are stored as SHA256 hex.
+const mysqlReservationsTableCreate = `
+CREATE TABLE IF NOT EXISTS reservations (
+	id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+	namespace TINYTEXT NOT NULL,
+	number BIGINT NOT NULL,
+	token CHAR(64) NOT NULL,
+	state VARCHAR(16) NOT NULL,
+	expires DATETIME NOT NULL,
+	created DATETIME NOT NULL,
+	updated DATETIME NOT NULL,
+	PRIMARY KEY (id),
+	UNIQUE (namespace(255), number),
+	INDEX (token),
+	INDEX (namespace(255), state, number)
+)
+ENGINE=InnoDB;`
+
+// mysqlReleasedTableCreate is the SQL for setting up the released table on
+// startup, for allocator namespaces. A new number is generation 0 and each
+// release of it is the next generation, the owner is the hashed token of
+// the acquire that took it.
+const mysqlReleasedTableCreate = `
+CREATE TABLE IF NOT EXISTS released (
+	id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+	namespace TINYTEXT NOT NULL,
+	number BIGINT NOT NULL,
+	generation BIGINT NOT NULL,
+	taken TINYINT(1) NOT NULL,
+	owner VARCHAR(64) NOT NULL DEFAULT '',
+	created DATETIME NOT NULL,
+	PRIMARY KEY (id),
+	UNIQUE (namespace(255), number, generation),
+	INDEX (namespace(255), taken, number),
+	INDEX (owner)
+)
+ENGINE=InnoDB;`
+
+// mysqlThresholdsTableCreate is the SQL for setting up the
+// threshold webhook rules table on startup
+const mysqlThresholdsTableCreate = `
+CREATE TABLE IF NOT EXISTS thresholds (
+	id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+	namespace TINYTEXT NOT NULL,
+	value BIGINT NOT NULL,
+	url TEXT NOT NULL,
+	created DATETIME NOT NULL,
+	PRIMARY KEY (id),
 	INDEX (namespace(255))
 )
 ENGINE=InnoDB;`
 
+// mysqlWebhooksTableCreate is the SQL for setting up the
+// queued webhooks table on startup, a threshold is only queued once
+const mysqlWebhooksTableCreate = `
+CREATE TABLE IF NOT EXISTS webhooks (
+	id INT UNSIGNED NOT NULL AUTO_INCREMENT,
+	threshold_id INT UNSIGNED NOT NULL,
+	namespace TINYTEXT NOT NULL,
+	threshold BIGINT NOT NULL,
+	value BIGINT NOT NULL,
+	url TEXT NOT NULL,
+	attempts INT NOT NULL,
+	next_attempt DATETIME NOT NULL,
+	delivered DATETIME NULL,
+	created DATETIME NOT NULL,
+	PRIMARY KEY (id),
+	UNIQUE (threshold_id),
+	INDEX (delivered, next_attempt)
+)
+ENGINE=InnoDB;`
+
 // Setup does the setup of the remoteDB
 func (m *mysqlDB) Setup(config *configuration) remoteDB {
 
@@ -57,8 +230,17 @@ func (m *mysqlDB) Setup(config *configuration) remoteDB {
 
 	m.keys = make(map[string]struct{})
 
-	var err error
-	m.DB, err = sql.Open("mysql", m.mysqlConfig.DSN)
+	// the DATETIME columns are scanned into time.Time, which the driver only
+	// does with parseTime, times are written and read back in the loc of the
+	// DSN (UTC when it isn't set) so they compare the same both ways
+	dsn, err := mysql.ParseDSN(m.mysqlConfig.DSN)
+	log.OnErr(err).Fatalf("[mysql] dsn: %v", err)
+	dsn.ParseTime = true
+	if dsn.Loc == nil {
+		dsn.Loc = time.UTC
+	}
+
+	m.DB, err = sql.Open("mysql", dsn.FormatDSN())
 	log.OnErr(err).Fatalf("[mysql] connect: %v", err)
 
 	err = m.DB.Ping()
@@ -70,6 +252,75 @@ func (m *mysqlDB) Setup(config *configuration) remoteDB {
 	_, err = stmt.Exec()
 	log.OnErr(err).Fatalf("[mysql] create exec: %v", err)
 
+	var hasFirst int
+	err = m.DB.QueryRow(mysqlKeysFirstColumn).Scan(&hasFirst)
+	log.OnErr(err).Fatalf("[mysql] keys first column: %v", err)
+
+	if hasFirst == 0 {
+		_, err = m.DB.Exec(mysqlKeysFirstAdd)
+		log.OnErr(err).Fatalf("[mysql] keys first column add: %v", err)
+	}
+
+	stmtK, err := m.DB.Prepare(strings.TrimSpace(mysqlAPIKeysTableCreate))
+	log.OnErr(err).Fatalf("[mysql] create apikeys prep: %v", err)
+
+	_, err = stmtK.Exec()
+	log.OnErr(err).Fatalf("[mysql] create apikeys exec: %v", err)
+
+	stmtT, err := m.DB.Prepare(strings.TrimSpace(mysqlTombstonesTableCreate))
+	log.OnErr(err).Fatalf("[mysql] create tombstones prep: %v", err)
+
+	_, err = stmtT.Exec()
+	log.OnErr(err).Fatalf("[mysql] create tombstones exec: %v", err)
+
+	stmtO, err := m.DB.Prepare(strings.TrimSpace(mysqlOptionsTableCreate))
+	log.OnErr(err).Fatalf("[mysql] create options prep: %v", err)
+
+	_, err = stmtO.Exec()
+	log.OnErr(err).Fatalf("[mysql] create options exec: %v", err)
+
+	stmtI, err := m.DB.Prepare(strings.TrimSpace(mysqlIdempotencyTableCreate))
+	log.OnErr(err).Fatalf("[mysql] create idempotency prep: %v", err)
+
+	_, err = stmtI.Exec()
+	log.OnErr(err).Fatalf("[mysql] create idempotency exec: %v", err)
+
+	stmtC, err := m.DB.Prepare(strings.TrimSpace(mysqlCyclesTableCreate))
+	log.OnErr(err).Fatalf("[mysql] create cycles prep: %v", err)
+
+	_, err = stmtC.Exec()
+	log.OnErr(err).Fatalf("[mysql] create cycles exec: %v", err)
+
+	stmtP, err := m.DB.Prepare(strings.TrimSpace(mysqlPeriodsTableCreate))
+	log.OnErr(err).Fatalf("[mysql] create periods prep: %v", err)
+
+	_, err = stmtP.Exec()
+	log.OnErr(err).Fatalf("[mysql] create periods exec: %v", err)
+
+	stmtR, err := m.DB.Prepare(strings.TrimSpace(mysqlReservationsTableCreate))
+	log.OnErr(err).Fatalf("[mysql] create reservations prep: %v", err)
+
+	_, err = stmtR.Exec()
+	log.OnErr(err).Fatalf("[mysql] create reservations exec: %v", err)
+
+	stmtL, err := m.DB.Prepare(strings.TrimSpace(mysqlReleasedTableCreate))
+	log.OnErr(err).Fatalf("[mysql] create released prep: %v", err)
+
+	_, err = stmtL.Exec()
+	log.OnErr(err).Fatalf("[mysql] create released exec: %v", err)
+
+	stmtH, err := m.DB.Prepare(strings.TrimSpace(mysqlThresholdsTableCreate))
+	log.OnErr(err).Fatalf("[mysql] create thresholds prep: %v", err)
+
+	_, err = stmtH.Exec()
+	log.OnErr(err).Fatalf("[mysql] create thresholds exec: %v", err)
+
+	stmtW, err := m.DB.Prepare(strings.TrimSpace(mysqlWebhooksTableCreate))
+	log.OnErr(err).Fatalf("[mysql] create webhooks prep: %v", err)
+
+	_, err = stmtW.Exec()
+	log.OnErr(err).Fatalf("[mysql] create webhooks exec: %v", err)
+
 	return m
 }
 
@@ -84,17 +335,26 @@ func (m *mysqlDB) configDisplay(padd int, config *configuration) {
 
 // HashKey returns if the key is in the DB
 func (m *mysqlDB) HasKey(key string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	_, ok := m.keys[key]
 	return ok
 }
 
-// Keys is the list of unique keys (namespaces) found within the database
+// Keys is the list of unique keys (namespaces) found within the database,
+// retired namespaces are left out unless they have been claimed again
 func (m *mysqlDB) Keys() (out []string, err error) {
-	sql := "SELECT DISTINCT `namespace` FROM `keys`"
+	sql := "SELECT `k`.`namespace` FROM `keys` `k` " +
+		"LEFT JOIN `tombstones` `t` ON `t`.`namespace`=`k`.`namespace` " +
+		"GROUP BY `k`.`namespace` HAVING MAX(`k`.`value`) > COALESCE(MAX(`t`.`value`), -1)"
 	rows, err := m.DB.Query(sql)
 	if err != nil {
 		return nil, fmt.Errorf("[mysql] keys: %v", err)
 	}
+	defer rows.Close()
+
+	keys := make(map[string]struct{})
 	for rows.Next() {
 		var ns string
 		err = rows.Scan(&ns)
@@ -102,9 +362,37 @@ func (m *mysqlDB) Keys() (out []string, err error) {
 			return nil, fmt.Errorf("[mysql] keys row: %v", err)
 		}
 		out = append(out, ns)
-		m.keys[ns] = struct{}{}
+		keys[ns] = struct{}{}
 	}
-	return out, err
+	m.mu.Lock()
+	m.keys = keys // swap in the new keys, so retired keys are dropped
+	m.mu.Unlock()
+	return out, rows.Err()
+}
+
+// KeysPage is a page of the unique keys (namespaces) and their current value, in
+// namespace order. Only namespaces that start with the prefix and come after the
+// after namespace are returned, retired namespaces are left out.
+func (m *mysqlDB) KeysPage(prefix, after string, limit int) (out []nsValue, err error) {
+	sql := "SELECT `k`.`namespace`, MAX(`k`.`value`) FROM `keys` `k` " +
+		"LEFT JOIN `tombstones` `t` ON `t`.`namespace`=`k`.`namespace` " +
+		"WHERE `k`.`namespace` LIKE ? AND `k`.`namespace`>? " +
+		"GROUP BY `k`.`namespace` HAVING MAX(`k`.`value`) > COALESCE(MAX(`t`.`value`), -1) " +
+		"ORDER BY `k`.`namespace` LIMIT ?"
+	rows, err := m.DB.Query(sql, likePrefix(prefix), after, limit)
+	if err != nil {
+		return nil, fmt.Errorf("[mysql] keys page: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var nv nsValue
+		if err = rows.Scan(&nv.Namespace, &nv.Value); err != nil {
+			return nil, fmt.Errorf("[mysql] keys page row: %v", err)
+		}
+		out = append(out, nv)
+	}
+	return out, rows.Err()
 }
 
 // Get returns the value for a given key (namespace)
@@ -138,3 +426,505 @@ func (m *mysqlDB) Set(key, val []byte) error {
 	}
 	return nil
 }
+
+// Claim saves the range of numbers from first to last (value) for a given key
+// (namespace), it returns false without saving anything if any number of the
+// range is in a range that has already been saved, or if the latest tombstone
+// of the namespace doesn't let it be claimed again from first
+func (m *mysqlDB) Claim(ns string, first, last uint64) (bool, error) {
+	return mysqlClaim(m.DB, ns, first, last)
+}
+
+// mysqlClaim saves a claimed range, see Claim
+func mysqlClaim(db sqlExecer, ns string, first, last uint64) (bool, error) {
+	sql := "INSERT INTO `keys` (`namespace`, `first`, `value`, `created`) SELECT ?, ?, ?, ? FROM DUAL " +
+		"WHERE NOT EXISTS(SELECT 1 FROM `keys` WHERE `namespace`=? AND `value`>=? AND COALESCE(`first`, `value`)<=?) " +
+		"AND NOT EXISTS(SELECT 1 FROM (SELECT `value`, `recreate` FROM `tombstones` WHERE `namespace`=? " +
+		"ORDER BY `created` DESC, `id` DESC LIMIT 1) t WHERE t.`recreate`=FALSE OR t.`value`>=?)"
+	res, err := db.Exec(sql, ns, first, last, time.Now(), ns, first, last, ns, first)
+	if err != nil {
+		return false, fmt.Errorf("[mysql] claim: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("[mysql] claim result: %v", err)
+	}
+	return n == 1, nil
+}
+
+// ClaimLease saves a single number of a gapless namespace along with its
+// reservation in one transaction, so a claimed number always has a lease
+func (m *mysqlDB) ClaimLease(l lease) (bool, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return false, fmt.Errorf("[mysql] claim lease begin: %v", err)
+	}
+	defer tx.Rollback()
+
+	if ok, err := mysqlClaim(tx, l.Namespace, l.Number, l.Number); err != nil || !ok {
+		return false, err
+	}
+
+	sql := "INSERT INTO `reservations` (`namespace`, `number`, `token`, `state`, `expires`, `created`, `updated`) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	now := time.Now()
+	if _, err := tx.Exec(sql, l.Namespace, l.Number, l.Token, l.State, l.Expires, now, now); err != nil {
+		return false, fmt.Errorf("[mysql] claim lease reserve: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("[mysql] claim lease commit: %v", err)
+	}
+	return true, nil
+}
+
+// ClaimAllocation claims a new number of an allocator namespace and saves
+// it as taken by its owner in the same transaction, it returns false
+// without saving either when the number has already been claimed
+func (m *mysqlDB) ClaimAllocation(a allocation) (bool, error) {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return false, fmt.Errorf("[mysql] claim allocation begin: %v", err)
+	}
+	defer tx.Rollback()
+
+	if ok, err := mysqlClaim(tx, a.Namespace, a.Number, a.Number); err != nil || !ok {
+		return false, err
+	}
+
+	sql := "INSERT INTO `released` (`namespace`, `number`, `generation`, `taken`, `owner`, `created`) VALUES (?, ?, 0, 1, ?, ?)"
+	if _, err := tx.Exec(sql, a.Namespace, a.Number, a.Owner, time.Now()); err != nil {
+		return false, fmt.Errorf("[mysql] claim allocation owner: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("[mysql] claim allocation commit: %v", err)
+	}
+	return true, nil
+}
+
+// APIKey returns the namespace prefixes that the (hashed) API key is allowed to use
+func (m *mysqlDB) APIKey(key string) (out []string, err error) {
+	sql := "SELECT `prefix` FROM `apikeys` WHERE `apikey`=?"
+	rows, err := m.DB.Query(sql, key)
+	if err != nil {
+		return nil, fmt.Errorf("[mysql] apikey: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var prefix string
+		if err = rows.Scan(&prefix); err != nil {
+			return nil, fmt.Errorf("[mysql] apikey row: %v", err)
+		}
+		out = append(out, prefix)
+	}
+	return out, rows.Err()
+}
+
+// Retire writes a tombstone for the namespace
+func (m *mysqlDB) Retire(ns string, ts tombstone) error {
+	sql := "INSERT INTO `tombstones` (`namespace`, `value`, `recreate`, `created`) VALUES (?, ?, ?, ?)"
+	_, err := m.DB.Exec(sql, ns, ts.Value, ts.Recreate, time.Now())
+	if err != nil {
+		return fmt.Errorf("[mysql] retire: %v", err)
+	}
+	m.mu.Lock()
+	delete(m.keys, ns)
+	m.mu.Unlock()
+	return nil
+}
+
+// Tombstone returns the latest tombstone for the namespace, or nil if
+// the namespace has never been retired
+func (m *mysqlDB) Tombstone(ns string) (*tombstone, error) {
+	sql := "SELECT `value`, `recreate` FROM `tombstones` WHERE `namespace`=? ORDER BY `created` DESC, `id` DESC LIMIT 1"
+	rows, err := m.DB.Query(sql, ns)
+	if err != nil {
+		return nil, fmt.Errorf("[mysql] tombstone: %v", err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	ts := new(tombstone)
+	if err = rows.Scan(&ts.Value, &ts.Recreate); err != nil {
+		return nil, fmt.Errorf("[mysql] tombstone row: %v", err)
+	}
+	return ts, nil
+}
+
+// Options returns the latest value of each option set for the namespace
+func (m *mysqlDB) Options(ns string) (map[string]string, error) {
+	sql := "SELECT `name`, `value` FROM `options` WHERE `namespace`=? ORDER BY `id`"
+	rows, err := m.DB.Query(sql, ns)
+	if err != nil {
+		return nil, fmt.Errorf("[mysql] options: %v", err)
+	}
+	defer rows.Close()
+
+	var opts = make(map[string]string)
+	for rows.Next() {
+		var name, val string
+		if err = rows.Scan(&name, &val); err != nil {
+			return nil, fmt.Errorf("[mysql] options row: %v", err)
+		}
+		opts[name] = val // later rows replace earlier ones
+	}
+	return opts, rows.Err()
+}
+
+// SetOptions saves the options for the namespace
+func (m *mysqlDB) SetOptions(ns string, opts map[string]string) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("[mysql] set options: %v", err)
+	}
+
+	sql := "INSERT INTO `options` (`namespace`, `name`, `value`, `created`) VALUES (?, ?, ?, ?)"
+	for name, val := range opts {
+		if _, err = tx.Exec(sql, ns, name, val, time.Now()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("[mysql] set options %s: %v", name, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("[mysql] set options commit: %v", err)
+	}
+	return nil
+}
+
+// Idempotent returns the claim made for the idempotency key of the namespace
+// since the time passed in, or nil if there wasn't a claim
+func (m *mysqlDB) Idempotent(key, ns string, since time.Time) (*idemRecord, error) {
+	sql := "SELECT `namespace`, `first`, `last`, `serverid`, `ts` FROM `idempotency` " +
+		"WHERE `idemkey`=? AND (`namespace`=? OR `namespace` LIKE ?) AND `created`>? ORDER BY `id` LIMIT 1"
+	rows, err := m.DB.Query(sql, key, ns, likePrefix(ns+periodSep), since) // a claim may be in a period of the namespace
+	if err != nil {
+		return nil, fmt.Errorf("[mysql] idempotent: %v", err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	rec := new(idemRecord)
+	if err = rows.Scan(&rec.NS, &rec.First, &rec.Last, &rec.ServerID, &rec.Timestamp); err != nil {
+		return nil, fmt.Errorf("[mysql] idempotent row: %v", err)
+	}
+	return rec, nil
+}
+
+// PruneIdempotent deletes the claims made for idempotency keys before the time
+func (m *mysqlDB) PruneIdempotent(before time.Time) error {
+	if _, err := m.DB.Exec("DELETE FROM `idempotency` WHERE `created`<?", before); err != nil {
+		return fmt.Errorf("[mysql] prune idempotent: %v", err)
+	}
+	return nil
+}
+
+// SetIdempotent saves the claim made for the idempotency key of the namespace
+func (m *mysqlDB) SetIdempotent(key, ns string, rec idemRecord) error {
+	sql := "INSERT INTO `idempotency` (`idemkey`, `namespace`, `first`, `last`, `serverid`, `ts`, `created`) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	_, err := m.DB.Exec(sql, key, ns, rec.First, rec.Last, rec.ServerID, rec.Timestamp, time.Now())
+	if err != nil {
+		return fmt.Errorf("[mysql] set idempotent: %v", err)
+	}
+	return nil
+}
+
+// Cycle returns the latest cycle recorded for a wrapping namespace, zero
+// if it hasn't wrapped yet
+func (m *mysqlDB) Cycle(ns string) (uint64, error) {
+	sql := "SELECT COALESCE(MAX(`cycle`), 0) FROM `cycles` WHERE `namespace`=?"
+	var cycle uint64
+	if err := m.DB.QueryRow(sql, ns).Scan(&cycle); err != nil {
+		return 0, fmt.Errorf("[mysql] cycle: %v", err)
+	}
+	return cycle, nil
+}
+
+// SetCycle records that a wrapping namespace has started a new cycle, a
+// cycle that is already recorded is left as it is
+func (m *mysqlDB) SetCycle(ns string, cycle uint64) error {
+	sql := "INSERT IGNORE INTO `cycles` (`namespace`, `cycle`, `created`) VALUES (?, ?, ?)"
+	if _, err := m.DB.Exec(sql, ns, cycle, time.Now()); err != nil {
+		return fmt.Errorf("[mysql] set cycle: %v", err)
+	}
+	return nil
+}
+
+// Period returns the latest period recorded for a namespace that resets,
+// empty if none has been recorded
+func (m *mysqlDB) Period(ns string) (string, error) {
+	sql := "SELECT COALESCE(MAX(`period`), '') FROM `periods` WHERE `namespace`=?"
+	var period string
+	if err := m.DB.QueryRow(sql, ns).Scan(&period); err != nil {
+		return "", fmt.Errorf("[mysql] period: %v", err)
+	}
+	return period, nil
+}
+
+// SetPeriod records that a namespace that resets has started a new period, a
+// period that is already recorded is left as it is
+func (m *mysqlDB) SetPeriod(ns, period string) error {
+	sql := "INSERT IGNORE INTO `periods` (`namespace`, `period`, `created`) VALUES (?, ?, ?)"
+	if _, err := m.DB.Exec(sql, ns, period, time.Now()); err != nil {
+		return fmt.Errorf("[mysql] set period: %v", err)
+	}
+	return nil
+}
+
+// Reservation returns the reserved number of the token, nil if there isn't one
+func (m *mysqlDB) Reservation(token string) (*lease, error) {
+	sql := "SELECT `namespace`, `number`, `token`, `state`, `expires` FROM `reservations` WHERE `token`=? LIMIT 1"
+	rows, err := m.DB.Query(sql, token)
+	if err != nil {
+		return nil, fmt.Errorf("[mysql] reservation: %v", err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	l := new(lease)
+	if err = rows.Scan(&l.Namespace, &l.Number, &l.Token, &l.State, &l.Expires); err != nil {
+		return nil, fmt.Errorf("[mysql] reservation row: %v", err)
+	}
+	return l, nil
+}
+
+// Reusable returns the lowest number of the namespace that was aborted or
+// whose lease has expired, nil if there isn't one
+func (m *mysqlDB) Reusable(ns string, now time.Time) (*lease, error) {
+	sql := "SELECT `namespace`, `number`, `token`, `state`, `expires` FROM `reservations` " +
+		"WHERE `namespace`=? AND (`state`=? OR (`state`=? AND `expires`<?)) ORDER BY `number` LIMIT 1"
+	rows, err := m.DB.Query(sql, ns, leaseAborted, leaseReserved, now)
+	if err != nil {
+		return nil, fmt.Errorf("[mysql] reusable: %v", err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	l := new(lease)
+	if err = rows.Scan(&l.Namespace, &l.Number, &l.Token, &l.State, &l.Expires); err != nil {
+		return nil, fmt.Errorf("[mysql] reusable row: %v", err)
+	}
+	return l, nil
+}
+
+// TakeLease gives a reusable number a new lease, it's only taken if it's still
+// reusable with the same token, so only one claim gets the number
+func (m *mysqlDB) TakeLease(from, to lease, now time.Time) (bool, error) {
+	sql := "UPDATE `reservations` SET `token`=?, `state`=?, `expires`=?, `updated`=? " +
+		"WHERE `namespace`=? AND `number`=? AND `token`=? AND (`state`=? OR (`state`=? AND `expires`<?))"
+	res, err := m.DB.Exec(sql, to.Token, to.State, to.Expires, now, from.Namespace, from.Number, from.Token, leaseAborted, leaseReserved, now)
+	if err != nil {
+		return false, fmt.Errorf("[mysql] take lease: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("[mysql] take lease result: %v", err)
+	}
+	return n == 1, nil
+}
+
+// EndLease commits or aborts the number reserved with the token, only while
+// its lease hasn't expired
+func (m *mysqlDB) EndLease(token, state string, now time.Time) (bool, error) {
+	sql := "UPDATE `reservations` SET `state`=?, `updated`=? WHERE `token`=? AND `state`=? AND `expires`>?"
+	res, err := m.DB.Exec(sql, state, now, token, leaseReserved, now)
+	if err != nil {
+		return false, fmt.Errorf("[mysql] end lease: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("[mysql] end lease result: %v", err)
+	}
+	return n == 1, nil
+}
+
+// Allocation returns the number acquired by the (hashed) owner token, and
+// if it has been released since, nil if there isn't one
+func (m *mysqlDB) Allocation(owner string) (*allocation, error) {
+	sql := "SELECT r.`namespace`, r.`number`, r.`generation`, r.`owner`, EXISTS(SELECT 1 FROM `released` n " +
+		"WHERE n.`namespace`=r.`namespace` AND n.`number`=r.`number` AND n.`generation`>r.`generation`) " +
+		"FROM `released` r WHERE r.`owner`=? AND r.`taken`=1 LIMIT 1"
+	rows, err := m.DB.Query(sql, owner)
+	if err != nil {
+		return nil, fmt.Errorf("[mysql] allocation: %v", err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	a := new(allocation)
+	if err = rows.Scan(&a.Namespace, &a.Number, &a.Generation, &a.Owner, &a.Released); err != nil {
+		return nil, fmt.Errorf("[mysql] allocation row: %v", err)
+	}
+	return a, nil
+}
+
+// Release records the next generation of the acquired number as released,
+// it returns false if it's already been released
+func (m *mysqlDB) Release(a allocation) (bool, error) {
+	sql := "INSERT IGNORE INTO `released` (`namespace`, `number`, `generation`, `taken`, `created`) VALUES (?, ?, ?, 0, ?)"
+	res, err := m.DB.Exec(sql, a.Namespace, a.Number, a.Generation+1, time.Now())
+	if err != nil {
+		return false, fmt.Errorf("[mysql] release: %v", err)
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("[mysql] release result: %v", err)
+	}
+	return affected == 1, nil // another server released it at the same time
+}
+
+// LowestReleased returns the lowest number of the namespace that is released
+// and not taken, with its generation
+func (m *mysqlDB) LowestReleased(ns string) (uint64, uint64, bool, error) {
+	sql := "SELECT `number`, `generation` FROM `released` WHERE `namespace`=? AND `taken`=0 ORDER BY `number` LIMIT 1"
+	rows, err := m.DB.Query(sql, ns)
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("[mysql] lowest released: %v", err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return 0, 0, false, rows.Err()
+	}
+
+	var n, gen uint64
+	if err = rows.Scan(&n, &gen); err != nil {
+		return 0, 0, false, fmt.Errorf("[mysql] lowest released row: %v", err)
+	}
+	return n, gen, true, nil
+}
+
+// TakeReleased marks a generation of a released number as taken by its
+// owner, it returns false if it was already taken
+func (m *mysqlDB) TakeReleased(a allocation) (bool, error) {
+	sql := "UPDATE `released` SET `taken`=1, `owner`=? WHERE `namespace`=? AND `number`=? AND `generation`=? AND `taken`=0"
+	res, err := m.DB.Exec(sql, a.Owner, a.Namespace, a.Number, a.Generation)
+	if err != nil {
+		return false, fmt.Errorf("[mysql] take released: %v", err)
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("[mysql] take released result: %v", err)
+	}
+	return rows == 1, nil
+}
+
+// Issued returns if the number has been claimed in the namespace, either
+// on its own or as part of a range
+func (m *mysqlDB) Issued(ns string, n uint64) (bool, error) {
+	sql := "SELECT EXISTS(SELECT 1 FROM `keys` WHERE `namespace`=? AND `value`>=? AND COALESCE(`first`, `value`)<=?)"
+	var issued bool
+	if err := m.DB.QueryRow(sql, ns, n, n).Scan(&issued); err != nil {
+		return false, fmt.Errorf("[mysql] issued: %v", err)
+	}
+	return issued, nil
+}
+
+// Thresholds returns the threshold rules of the namespace, the latest row
+// for each threshold value is the rule and an empty url means it was removed
+func (m *mysqlDB) Thresholds(ns string) (out []threshold, err error) {
+	sql := "SELECT `t`.`id`, `t`.`value`, `t`.`url` FROM `thresholds` `t` " +
+		"WHERE `t`.`namespace`=? AND `t`.`url`<>'' AND `t`.`id`=(" +
+		"SELECT MAX(`l`.`id`) FROM `thresholds` `l` WHERE `l`.`namespace`=`t`.`namespace` AND `l`.`value`=`t`.`value`) " +
+		"ORDER BY `t`.`value`"
+	rows, err := m.DB.Query(sql, ns)
+	if err != nil {
+		return nil, fmt.Errorf("[mysql] thresholds: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t = threshold{Namespace: ns}
+		if err = rows.Scan(&t.ID, &t.Value, &t.URL); err != nil {
+			return nil, fmt.Errorf("[mysql] thresholds row: %v", err)
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+// SetThreshold saves a threshold rule
+func (m *mysqlDB) SetThreshold(t threshold) error {
+	sql := "INSERT INTO `thresholds` (`namespace`, `value`, `url`, `created`) VALUES (?, ?, ?, ?)"
+	_, err := m.DB.Exec(sql, t.Namespace, t.Value, t.URL, time.Now())
+	if err != nil {
+		return fmt.Errorf("[mysql] set threshold: %v", err)
+	}
+	return nil
+}
+
+// QueueWebhook queues the webhook for a threshold that a claimed number
+// has reached, it returns false if the threshold was already queued
+func (m *mysqlDB) QueueWebhook(t threshold, value uint64) (bool, error) {
+	sql := "INSERT IGNORE INTO `webhooks` (`threshold_id`, `namespace`, `threshold`, `value`, `url`, `attempts`, `next_attempt`, `created`) " +
+		"VALUES (?, ?, ?, ?, ?, 0, ?, ?)"
+	now := time.Now()
+	res, err := m.DB.Exec(sql, t.ID, t.Namespace, t.Value, value, t.URL, now, now)
+	if err != nil {
+		return false, fmt.Errorf("[mysql] queue webhook: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("[mysql] queue webhook result: %v", err)
+	}
+	return n == 1, nil
+}
+
+// DueWebhooks returns the webhooks that haven't been delivered and are due for another attempt
+func (m *mysqlDB) DueWebhooks(now time.Time, maxAttempts, limit int) (out []webhookDelivery, err error) {
+	sql := "SELECT `id`, `namespace`, `threshold`, `value`, `url`, `attempts`, `created` FROM `webhooks` " +
+		"WHERE `delivered` IS NULL AND `attempts`<? AND `next_attempt`<=? ORDER BY `next_attempt` LIMIT ?"
+	rows, err := m.DB.Query(sql, maxAttempts, now, limit)
+	if err != nil {
+		return nil, fmt.Errorf("[mysql] due webhooks: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var d webhookDelivery
+		if err = rows.Scan(&d.ID, &d.Namespace, &d.Threshold, &d.Value, &d.URL, &d.Attempts, &d.Created); err != nil {
+			return nil, fmt.Errorf("[mysql] due webhooks row: %v", err)
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+// LeaseWebhook counts an attempt of the webhook and sets when the next one
+// is due, it returns false if another server counted the attempt first
+func (m *mysqlDB) LeaseWebhook(id uint64, attempts int, next time.Time) (bool, error) {
+	sql := "UPDATE `webhooks` SET `attempts`=`attempts`+1, `next_attempt`=? " +
+		"WHERE `id`=? AND `attempts`=? AND `delivered` IS NULL"
+	res, err := m.DB.Exec(sql, next, id, attempts)
+	if err != nil {
+		return false, fmt.Errorf("[mysql] lease webhook: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("[mysql] lease webhook result: %v", err)
+	}
+	return n == 1, nil
+}
+
+// WebhookDelivered marks the webhook as delivered
+func (m *mysqlDB) WebhookDelivered(id uint64) error {
+	sql := "UPDATE `webhooks` SET `delivered`=? WHERE `id`=?"
+	if _, err := m.DB.Exec(sql, time.Now(), id); err != nil {
+		return fmt.Errorf("[mysql] webhook delivered: %v", err)
+	}
+	return nil
+}
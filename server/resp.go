@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// the limits of a single RESP command
+const (
+	respMaxArgs    = 1024
+	respMaxBulkLen = 512 << 10
+)
+
+// respServer speaks enough of the Redis RESP2 protocol (PING, INCR, INCRBY,
+// GET and EXISTS) that apps using Redis INCR for sequences can point at
+// incrr instead. Redis keys are namespaces under the configured prefix.
+type respServer struct {
+	Port   string `toml:"port"`
+	Prefix string `toml:"prefix"`
+
+	*tcpServer
+
+	web *webServer
+}
+
+func (rs *respServer) configDisplay(padd int, config *configuration) {
+	display.Printf(leftpad(padd, "[config] RESP Port:", "%v"), rs.Port)
+	display.Printf(leftpad(padd, "[config] RESP Prefix:", "%v"), rs.Prefix)
+}
+
+// respReply writes RESP2 replies
+type respReply struct{ *bufio.Writer }
+
+func (w respReply) simple(s string) { fmt.Fprintf(w, "+%s\r\n", s) }
+func (w respReply) err(s string)    { fmt.Fprintf(w, "-ERR %s\r\n", s) }
+func (w respReply) integer(n int64) { fmt.Fprintf(w, ":%d\r\n", n) }
+func (w respReply) bulk(s string)   { fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s) }
+func (w respReply) nilBulk()        { fmt.Fprint(w, "$-1\r\n") }
+func (w respReply) uinteger(n uint64) {
+	if n > math.MaxInt64 {
+		w.err("value is out of the range of a Redis integer")
+		return
+	}
+	w.integer(int64(n))
+}
+
+// readRESPCommand reads either a RESP array of bulk strings, or an inline
+// command (which is what a plain TCP client like telnet sends)
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > respMaxArgs {
+		return nil, errRESPProtocol
+	}
+
+	var args = make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errRESPProtocol
+		}
+
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > respMaxBulkLen {
+			return nil, errRESPProtocol
+		}
+
+		buf := make([]byte, size+2) // the bulk string and the \r\n
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// namespace returns the namespace for a Redis key
+func (rs *respServer) namespace(key string) (string, error) {
+	return keyNamespace(rs.Prefix, key)
+}
+
+// serve handles the commands of a single connection until it's closed
+func (rs *respServer) serve(conn net.Conn) {
+	r, w := newReader(conn), respReply{bufio.NewWriter(conn)}
+
+	for {
+		if err := waitCommand(conn, r); err != nil {
+			return // the client went away, or was idle too long
+		}
+
+		args, err := readRESPCommand(r)
+		if err != nil {
+			if err != io.EOF {
+				w.err(err.Error())
+				w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		if quit := rs.command(w, args); quit {
+			w.Flush()
+			return
+		}
+
+		if r.Buffered() == 0 { // let pipelined commands go out together
+			w.Flush()
+		}
+	}
+}
+
+// command runs a single command and writes the reply, it returns true
+// when the connection should be closed
+func (rs *respServer) command(w respReply, args []string) (quit bool) {
+	cmd := strings.ToUpper(args[0])
+
+	switch cmd {
+	case "PING":
+		if len(args) > 1 {
+			w.bulk(args[1])
+			return
+		}
+		w.simple("PONG")
+	case "QUIT":
+		w.simple("OK")
+		return true
+	case "INCR", "INCRBY":
+		var count uint64 = 1
+		if (cmd == "INCR" && len(args) != 2) || (cmd == "INCRBY" && len(args) != 3) {
+			w.err(fmt.Sprintf("wrong number of arguments for '%s' command", strings.ToLower(cmd)))
+			return
+		}
+		if cmd == "INCRBY" {
+			n, err := strconv.ParseUint(args[2], 10, 64)
+			if err != nil || n == 0 || n > rs.web.maxBatch {
+				w.err(fmt.Sprintf("increment must be between 1 and %d", rs.web.maxBatch))
+				return
+			}
+			count = n
+		}
+
+		ns, err := rs.namespace(args[1])
+		if err != nil {
+			w.err(err.Error())
+			return
+		}
+
+		c, err := rs.web.claim(ns, count)
+		if err != nil {
+			log.Printf("[resp] %v", err)
+			w.err(respErrMsg(err))
+			return
+		}
+		w.uinteger(c.Last) // like Redis, the value after the increment
+	case "GET":
+		if len(args) != 2 {
+			w.err("wrong number of arguments for 'get' command")
+			return
+		}
+
+		ns, err := rs.namespace(args[1])
+		if err != nil {
+			w.err(err.Error())
+			return
+		}
+
+		val, _, err := rs.web.current(ns)
+		switch err.(type) {
+		case nil:
+			w.bulk(strconv.FormatUint(val, 10))
+		case ErrNotFound, ErrGone:
+			w.nilBulk()
+		default:
+			log.Printf("[resp] %v", err)
+			w.err(respErrMsg(err))
+		}
+	case "EXISTS":
+		if len(args) < 2 {
+			w.err("wrong number of arguments for 'exists' command")
+			return
+		}
+
+		var n int64
+		for _, key := range args[1:] {
+			ns, err := rs.namespace(key)
+			if err != nil {
+				continue
+			}
+			if _, _, err := rs.web.current(ns); err == nil {
+				n++
+			}
+		}
+		w.integer(n)
+	default:
+		w.err(fmt.Sprintf("unknown command '%s'", args[0]))
+	}
+	return false
+}
+
+// respErrMsg returns the message sent back to a client for an error
+func respErrMsg(err error) string {
+	switch err.(type) {
+	case ErrInternalService:
+		return "internal error"
+	case ErrGone:
+		return errRetired.Error()
+	}
+	return err.Error()
+}
+
+// setupRESPServer sets up the RESP server, if there is no port
+// configured then the RESP protocol is not served
+func setupRESPServer(config *configuration) *respServer {
+	rs := config.Server.RESP
+	if rs == nil || len(rs.Port) == 0 {
+		return nil
+	}
+
+	if len(strings.Split(rs.Port, ":")) != 2 {
+		log.Fatal(`The config resp port is invalid. Should be like ":6379"`)
+	}
+
+	if len(rs.Prefix) == 0 {
+		rs.Prefix = defaultRESPPrefix
+	}
+	if !strings.HasPrefix(rs.Prefix, "pub/") {
+		log.Fatal(`The config resp prefix must be a public namespace, i.e: "pub/"`)
+	}
+
+	rs.web = config.Web
+	rs.tcpServer = &tcpServer{addr: rs.Port, handle: rs.serve}
+
+	config.internal.shutdown = append(config.internal.shutdown, rs)
+	config.internal.listeners = append(config.internal.listeners, rs)
+
+	return rs
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadRESPCommand(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("*2\r\n$4\r\nINCR\r\n$3\r\nfoo\r\nPING hi\r\n"))
+
+	args, err := readRESPCommand(r)
+	if err != nil || strings.Join(args, " ") != "INCR foo" {
+		t.Fatalf("array: got %q %v", args, err)
+	}
+	args, err = readRESPCommand(r)
+	if err != nil || strings.Join(args, " ") != "PING hi" {
+		t.Fatalf("inline: got %q %v", args, err)
+	}
+}
+
+func TestReadRESPCommandLimits(t *testing.T) {
+	for name, in := range map[string]string{
+		"negative args": "*-1\r\n",
+		"too many args": "*1025\r\n",
+		"negative bulk": "*1\r\n$-1\r\n",
+		"too long bulk": "*1\r\n$524289\r\n",
+		"not a bulk":    "*1\r\n:1\r\n",
+	} {
+		if _, err := readRESPCommand(bufio.NewReader(strings.NewReader(in))); err != errRESPProtocol {
+			t.Errorf("%s: got %v, want %v", name, err, errRESPProtocol)
+		}
+	}
+
+	long := strings.Repeat("x", tcpMaxLine+1) + "\r\n"
+	if _, err := readRESPCommand(bufio.NewReaderSize(strings.NewReader(long), tcpMaxLine)); err != errLineTooLong {
+		t.Errorf("long line: got %v, want %v", err, errLineTooLong)
+	}
+}
+
+// testRESPServer starts a RESP server on a random port for the test
+func testRESPServer(t *testing.T) string {
+	config := testConfig(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := &respServer{Prefix: testNS(t, "pub/") + "/", web: config.Web}
+	rs.tcpServer = &tcpServer{handle: rs.serve}
+	go rs.Serve(ln)
+	t.Cleanup(func() { rs.Shutdown() })
+
+	return ln.Addr().String()
+}
+
+func TestRESPClient(t *testing.T) {
+	conn, err := net.Dial("tcp", testRESPServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	for _, tc := range []struct{ send, want string }{
+		{"PING\r\n", "+PONG"},
+		{"*2\r\n$4\r\nINCR\r\n$5\r\norder\r\n", ":0"}, // a namespace starts at zero
+		{"INCR order\r\n", ":1"},
+		{"INCRBY order 10\r\n", ":11"},
+		{"GET order\r\n", "$2"},
+		{"", "11"},
+		{"GET nothing\r\n", "$-1"},
+		{"EXISTS order nothing\r\n", ":1"},
+		{"INCRBY order 0\r\n", "-ERR increment must be between 1 and 5000"},
+		{"NOPE\r\n", "-ERR unknown command 'NOPE'"},
+		{"QUIT\r\n", "+OK"},
+	} {
+		if len(tc.send) > 0 {
+			if _, err := conn.Write([]byte(tc.send)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%q: %v", tc.send, err)
+		}
+		if got := strings.TrimRight(line, "\r\n"); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.send, got, tc.want)
+		}
+	}
+}
+
+func TestRESPClientBadInput(t *testing.T) {
+	addr := testRESPServer(t)
+
+	for name, send := range map[string]string{
+		"negative args": "*-1\r\n",
+		"long line":     strings.Repeat("x", tcpMaxLine+1),
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(send))
+
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || !strings.HasPrefix(line, "-ERR ") {
+			t.Errorf("%s: got %q %v, want an error reply", name, line, err)
+		}
+		conn.Close()
+	}
+
+	// the server is still up after the bad input
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PING\r\n"))
+	if line, _ := bufio.NewReader(conn).ReadString('\n'); line != "+PONG\r\n" {
+		t.Errorf("ping after bad input: got %q", line)
+	}
+}
@@ -114,6 +114,16 @@ func ListenAndServe(config *configuration) (err error) {
 		}(errs)
 	}
 
+	// any other servers only send back an error if they fail, they
+	// are stopped by the shutdown hooks once the HTTP servers are done
+	for _, l := range config.internal.listeners {
+		go func(e chan error, l listener) {
+			if err := l.ListenAndServe(); err != nil {
+				e <- err
+			}
+		}(errs, l)
+	}
+
 	//TODO(njones): Grab both errors and wrap them together, right now we just
 	// return the first one that wins
 	return <-errs
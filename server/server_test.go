@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// testConfigTOML is the config of the server the tests run against, it has
+// no groupcache peers so each claim is handled by the server itself
+const testConfigTOML = `
+environment = "test"
+
+[server]
+force_http = true
+
+[server.ports]
+http = ":0"
+https = ":0"
+
+[server.api]
+domains = ["127.0.0.1"]
+obfuscation_key = "test-obfuscation-key"
+
+[server.admin]
+keys = ["test-admin-key"]
+
+[server.webhooks]
+secret = "test-webhook-secret"
+poll_interval = "50ms"
+
+[groupcache]
+self = "127.0.0.1"
+peer_key = "test-peer-key"
+
+[datastore]
+use_remote_db = "memory"
+
+[datastore.local.bolt]
+cleanup_db_file = true
+`
+
+var testServer struct {
+	once   sync.Once
+	config *configuration
+
+	namespaces uint64 // made by testNS
+}
+
+// testConfig returns the config of the test server, the groupcache groups
+// can only be made once so every test shares the same server
+func testConfig(t *testing.T) *configuration {
+	t.Helper()
+	testServer.once.Do(func() {
+		testServer.config = parseConfiguration(strings.NewReader(testConfigTOML))
+		routeConfiguration(testServer.config)
+	})
+	return testServer.config
+}
+
+// testRemoteDB returns the remoteDB of the test server
+func testRemoteDB(t *testing.T) *memoryDB {
+	return testConfig(t).Datastore.RemoteDB.(*memoryDB)
+}
+
+// testHTTPS starts the HTTPS router of the test server, as plain HTTP
+func testHTTPS(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(testConfig(t).Web.https)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testNS returns a namespace under the prefix for the test. The test server
+// is shared, so each one is new, even when a test is run more than once.
+func testNS(t *testing.T, prefix string) string {
+	n := atomic.AddUint64(&testServer.namespaces, 1)
+	return prefix + t.Name() + "/" + strconv.FormatUint(n, 10)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the bit layout of a snowflake ID, the sign bit is never set so the
+// IDs are also positive int64s
+const (
+	snowflakeNodeBits = 10
+	snowflakeSeqBits  = 12
+	snowflakeTimeBits = 63 - snowflakeNodeBits - snowflakeSeqBits
+
+	snowflakeMaxNode = 1<<snowflakeNodeBits - 1
+	snowflakeMaxSeq  = 1<<snowflakeSeqBits - 1
+)
+
+// the limits of the snowflake clock
+const (
+	snowflakeLease   = time.Second // how far ahead the time is saved in the local DB
+	snowflakeMaxWait = time.Second // the most the clock can go back before IDs are refused
+)
+
+// snowflakeKey is the local DB key of the saved time, it can't clash with
+// a namespace as they can't have an underscore
+var snowflakeKey = []byte("_snowflake")
+
+// snowflakeNodeKey is the local DB key of the node the saved IDs were made with
+var snowflakeNodeKey = []byte("_snowflake_node")
+
+// snowflakeResponse is the JSON body sent back for a snowflake ID, the
+// ID is a string because JSON doesn't support uint64
+type snowflakeResponse struct {
+	ID        string `json:"id"`
+	Timestamp string `json:"timestamp"`
+	Node      int    `json:"node"`
+	Sequence  int    `json:"sequence"`
+	ServerID  string `json:"server_id"`
+	Version   string `json:"version"`
+}
+
+// snowflakeGen makes time sortable IDs of the milliseconds since the epoch,
+// the node number of the server and a sequence for IDs in the same millisecond.
+// Every server makes IDs on its own, so there is no groupcache or remote DB
+// round trip, and they are unique as long as each server has its own node.
+type snowflakeGen struct {
+	sync.Mutex
+
+	epoch time.Time
+	node  uint64
+	local *localDB
+
+	last     uint64 // the millisecond of the last ID
+	seq      uint64 // the sequence of the last ID
+	reserved uint64 // the millisecond saved in the local DB, no ID is made at or below it after a restart
+}
+
+// snowflakeNode returns the node number of the server, which is the node set
+// in the config, or else its place in the sorted groupcache pool so every
+// server works out the same numbers
+func snowflakeNode(node *int, self string, pool []string) (uint64, error) {
+	if node != nil {
+		if *node < 0 || *node > snowflakeMaxNode {
+			return 0, fmt.Errorf("snowflake_node must be between 0 and %d", snowflakeMaxNode)
+		}
+		return uint64(*node), nil
+	}
+
+	if len(pool) == 0 {
+		return 0, nil
+	}
+
+	peers := append([]string(nil), pool...)
+	sort.Strings(peers)
+	for i, peer := range peers {
+		if peer == self {
+			if i > snowflakeMaxNode {
+				return 0, fmt.Errorf("%s is node %d, the most is %d", self, i, snowflakeMaxNode)
+			}
+			return uint64(i), nil
+		}
+	}
+	return 0, fmt.Errorf("%s is not in the groupcache http_pool", self)
+}
+
+// newSnowflakeGen returns a snowflake generator for this server, it picks up
+// from the time saved in the local DB so the IDs made before a restart aren't made again
+func newSnowflakeGen(config *configuration) *snowflakeGen {
+	epoch, err := time.Parse(time.RFC3339, config.Server.API.SnowflakeEpoch)
+	log.OnErr(err).Fatalf("[config] snowflake epoch: %v", err)
+	if epoch.After(time.Now()) {
+		log.Fatalf("[config] snowflake epoch must be in the past")
+	}
+
+	node, err := snowflakeNode(config.Server.API.SnowflakeNode, config.Groupcache.internal.self, config.Groupcache.Pool)
+	log.OnErr(err).Fatalf("[config] snowflake node: %v", err)
+
+	sg := &snowflakeGen{epoch: epoch, node: node, local: config.Datastore.LocalDB}
+	err = sg.keepNode(config.Server.API.SnowflakeNode != nil)
+	log.OnErr(err).Fatalf("[config] snowflake node: %v", err)
+
+	if v := sg.local.Get(snowflakeKey); len(v) > 0 {
+		sg.reserved, err = strconv.ParseUint(string(v), 10, 64)
+		log.OnErr(err).Fatalf("[localDB] snowflake: %v", err)
+		sg.last, sg.seq = sg.reserved, snowflakeMaxSeq // so the next ID is after the saved time
+	}
+	return sg
+}
+
+// keepNode saves the node in the local DB, and refuses a node from the
+// groupcache pool that isn't the one this server made its IDs with, as
+// another server could now have that node and make the same IDs. A node
+// set in the config is the one to use from now on.
+func (sg *snowflakeGen) keepNode(set bool) error {
+	if v := sg.local.Get(snowflakeNodeKey); len(v) > 0 && !set {
+		saved, err := strconv.ParseUint(string(v), 10, 64)
+		if err != nil {
+			return fmt.Errorf("saved node: %v", err)
+		}
+		if saved != sg.node {
+			return fmt.Errorf("this server made IDs as node %d, but it's node %d of the groupcache http_pool, "+
+				"set snowflake_node to the node to use", saved, sg.node)
+		}
+		return nil
+	}
+	return sg.local.Set(snowflakeNodeKey, []byte(strconv.FormatUint(sg.node, 10)))
+}
+
+// millis returns the milliseconds since the epoch
+func (sg *snowflakeGen) millis() uint64 {
+	return uint64(time.Since(sg.epoch) / time.Millisecond)
+}
+
+// next returns a new ID. A clock that goes back is waited out when it's
+// a small step, otherwise IDs are refused until it catches up, as an ID
+// from an earlier time could already have been given out.
+func (sg *snowflakeGen) next() (id, ms, seq uint64, err error) {
+	sg.Lock()
+	defer sg.Unlock()
+
+	ms = sg.millis()
+	if ms < sg.last {
+		behind := time.Duration(sg.last-ms) * time.Millisecond
+		if behind > snowflakeMaxWait {
+			return 0, 0, 0, ErrServiceUnavailable{fmt.Errorf("%v by %v", errClockBackwards, behind)}
+		}
+		log.Warnf("[snowflake] the clock went back %v, waiting for it to catch up", behind)
+		time.Sleep(behind)
+		ms = sg.millis()
+	}
+
+	switch {
+	case ms > sg.last:
+		sg.last, sg.seq = ms, 0
+	case sg.seq < snowflakeMaxSeq:
+		sg.seq++
+	default: // the sequence is used up, so wait for the next millisecond
+		for ms <= sg.last {
+			time.Sleep(100 * time.Microsecond)
+			ms = sg.millis()
+		}
+		sg.last, sg.seq = ms, 0
+	}
+
+	if sg.last >= 1<<snowflakeTimeBits {
+		return 0, 0, 0, ErrServiceUnavailable{errSnowflakeEpoch}
+	}
+
+	if sg.last > sg.reserved { // save the time ahead, so it's not written for every ID
+		reserve := sg.last + uint64(snowflakeLease/time.Millisecond)
+		if err := sg.local.Set(snowflakeKey, []byte(strconv.FormatUint(reserve, 10))); err != nil {
+			return 0, 0, 0, ErrInternalService{fmt.Errorf("[snowflake] save: %v", err)}
+		}
+		sg.reserved = reserve
+	}
+
+	id = sg.last<<(snowflakeNodeBits+snowflakeSeqBits) | sg.node<<snowflakeSeqBits | sg.seq
+	return id, sg.last, sg.seq, nil
+}
+
+// SnowflakeHandler returns a new time sortable ID, with .json it returns a JSON body
+func (web *webServer) SnowflakeHandler(w http.ResponseWriter, r *http.Request) {
+	if !web.canServe {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	id, ms, seq, err := web.snowflake.next()
+	if err != nil {
+		log.Printf("[snowflake] %v", err)
+		responseOnErr(w, err)
+		return
+	}
+
+	if !strings.HasSuffix(r.URL.Path, ".json") {
+		fmt.Fprint(w, id)
+		return
+	}
+
+	body := snowflakeResponse{
+		ID:        strconv.FormatUint(id, 10),
+		Timestamp: web.snowflake.epoch.Add(time.Duration(ms) * time.Millisecond).UTC().Format(time.RFC3339Nano),
+		Node:      int(web.snowflake.node),
+		Sequence:  int(seq),
+		ServerID:  web.serverID,
+		Version:   verSemVer,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("[response] json encode: %v", err)
+	}
+}
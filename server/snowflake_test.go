@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestSnowflakeNode(t *testing.T) {
+	pool := []string{"https://c:443", "https://a:443", "https://b:443"}
+	if node, err := snowflakeNode(nil, "https://b:443", pool); err != nil || node != 1 {
+		t.Errorf("pool: got %d %v, want 1", node, err)
+	}
+	set := 7
+	if node, err := snowflakeNode(&set, "https://b:443", pool); err != nil || node != 7 {
+		t.Errorf("config: got %d %v, want 7", node, err)
+	}
+	set = snowflakeMaxNode + 1
+	if _, err := snowflakeNode(&set, "https://b:443", pool); err == nil {
+		t.Error("a node over the most was allowed")
+	}
+}
+
+func TestSnowflakeKeepNode(t *testing.T) {
+	local := testConfig(t).Datastore.LocalDB
+	saved := local.Get(snowflakeNodeKey)
+	defer local.Set(snowflakeNodeKey, saved)
+
+	if err := (&snowflakeGen{node: 2, local: local}).keepNode(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&snowflakeGen{node: 2, local: local}).keepNode(false); err != nil {
+		t.Errorf("same node: %v", err)
+	}
+
+	// a server whose place in the pool moved could make another server's IDs
+	if err := (&snowflakeGen{node: 3, local: local}).keepNode(false); err == nil {
+		t.Error("a different pool node was allowed")
+	}
+	if err := (&snowflakeGen{node: 3, local: local}).keepNode(true); err != nil {
+		t.Errorf("config node: %v", err)
+	}
+}
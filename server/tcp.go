@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the limits of a connection to one of the protocol servers, a client can sit
+// idle between commands for longer than it can take to send a single command
+const (
+	tcpMaxLine     = 4 << 10
+	tcpIdleTimeout = 5 * time.Minute
+	tcpReadTimeout = 30 * time.Second
+)
+
+// tcpServer is the accept loop shared by the protocol servers that listen
+// on their own TCP port, each connection is handled in its own go routine
+type tcpServer struct {
+	addr   string
+	handle func(net.Conn)
+
+	mu     sync.Mutex
+	ln     net.Listener
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// ListenAndServe listens on the address and handles each connection until
+// the server is shutdown
+func (ts *tcpServer) ListenAndServe() error {
+	ln, err := net.Listen("tcp", ts.addr)
+	if err != nil {
+		return err
+	}
+	return ts.Serve(ln)
+}
+
+// Serve handles each connection of the listener until the server is shutdown
+func (ts *tcpServer) Serve(ln net.Listener) error {
+	ts.mu.Lock()
+	ts.ln, ts.conns = ln, make(map[net.Conn]struct{})
+	ts.mu.Unlock()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			ts.mu.Lock()
+			closed := ts.closed
+			ts.mu.Unlock()
+			if closed {
+				return nil // we're shutting down
+			}
+			return err
+		}
+
+		ts.mu.Lock()
+		ts.conns[conn] = struct{}{}
+		ts.mu.Unlock()
+
+		go func(conn net.Conn) {
+			defer func() {
+				if p := recover(); p != nil { // a bad connection shouldn't take down the server
+					log.Printf("[tcp] %s: panic: %v", conn.RemoteAddr(), p)
+				}
+				conn.Close()
+				ts.mu.Lock()
+				delete(ts.conns, conn)
+				ts.mu.Unlock()
+			}()
+			ts.handle(conn)
+		}(conn)
+	}
+}
+
+// newReader returns the buffered reader for a connection, a line can't be
+// longer than its buffer, see readLine
+func newReader(conn net.Conn) *bufio.Reader {
+	return bufio.NewReaderSize(conn, tcpMaxLine)
+}
+
+// waitCommand waits for the start of the next command on the connection,
+// and then gives the client a shorter deadline to send all of it
+func waitCommand(conn net.Conn, r *bufio.Reader) error {
+	if r.Buffered() == 0 {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		if _, err := r.Peek(1); err != nil {
+			return err
+		}
+	}
+	return conn.SetDeadline(time.Now().Add(tcpReadTimeout)) // the reply has to be read in time too
+}
+
+// readLine reads a line without the \r\n, a line that doesn't fit in the
+// buffer of the reader is an error rather than being read without a limit
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errLineTooLong
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// Shutdown stops listening and closes any open connections
+func (ts *tcpServer) Shutdown() error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.closed = true
+	if ts.ln == nil {
+		return nil
+	}
+	for conn := range ts.conns {
+		conn.Close()
+	}
+	return ts.ln.Close()
+}
+
+// keyNamespace returns the namespace for a key of one of the protocol servers,
+// the key must follow the same rules as a namespace path of the HTTP API
+func keyNamespace(prefix, key string) (string, error) {
+	ns := prefix + key
+	if len(key) == 0 || len(filepath.Ext(ns)) > 0 {
+		return "", errInvalidKey
+	}
+	if err := checkNSPath("/" + ns); err != nil {
+		return "", err
+	}
+	return ns, nil
+}
@@ -0,0 +1,599 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the limits and timings of watching namespaces
+const (
+	watchRenew     = 20 * time.Second // how often a server renews its interest in the namespaces it watches
+	watchExpire    = 3 * watchRenew   // when an interest that hasn't been renewed is forgotten
+	watchKeepAlive = 15 * time.Second // how often an idle event stream is sent a comment
+	watchRecent    = 1000             // the events kept for each watched namespace, for long-polls and reconnects
+	watchBuffer    = 256              // how far a watcher can fall behind before it's dropped
+	watchQueue     = 4096             // the claimed numbers waiting to be sent to the watching servers
+	watchBatch     = 500              // the most events sent to a server in one request
+	watchBodyLimit = 4 << 20
+)
+
+// watchPeerClient is used to send subscriptions and events to the other servers
+var watchPeerClient = &http.Client{Timeout: 5 * time.Second}
+
+// watchEvent is a number, or a range of numbers, that was claimed in a namespace
+type watchEvent struct {
+	Namespace string `json:"namespace"`
+	Number    string `json:"number"`         // a string because JSON doesn't support uint64
+	Last      string `json:"last,omitempty"` // the last number of a range
+	Step      string `json:"step,omitempty"` // the step between the numbers of a range
+	ServerID  string `json:"server_id"`
+	Timestamp string `json:"timestamp"`
+	ID        uint64 `json:"id,omitempty"` // the order the event was delivered in on this server
+
+	num, last, step uint64
+}
+
+// numbers returns each number claimed in the event
+func (ev watchEvent) numbers() []string {
+	if ev.last <= ev.num || ev.step == 0 {
+		return []string{ev.Number}
+	}
+
+	var nums []string
+	for n := ev.num; ; n += ev.step {
+		nums = append(nums, strconv.FormatUint(n, 10))
+		if ev.last-n < ev.step {
+			return nums
+		}
+	}
+}
+
+// parse sets the numbers of an event that was sent from another server
+func (ev *watchEvent) parse() (err error) {
+	if ev.num, err = strconv.ParseUint(ev.Number, 10, 64); err != nil {
+		return err
+	}
+	ev.last, ev.step = ev.num, 1
+	if len(ev.Last) > 0 {
+		if ev.last, err = strconv.ParseUint(ev.Last, 10, 64); err != nil {
+			return err
+		}
+	}
+	if len(ev.Step) > 0 {
+		if ev.step, err = strconv.ParseUint(ev.Step, 10, 64); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watchSubscription is sent to every server in the pool so that they send
+// on the numbers claimed in the namespaces
+type watchSubscription struct {
+	Peer       string   `json:"peer"`
+	Namespaces []string `json:"namespaces"`
+}
+
+// nsWatch is a namespace that is being watched on this server
+type nsWatch struct {
+	subs    map[chan watchEvent]struct{}
+	recent  []watchEvent
+	expires time.Time // when the namespace is dropped once there are no watchers
+}
+
+// watchHub passes the numbers claimed in a namespace to the watchers of it.
+// Numbers are claimed by whichever server owns the key in groupcache, so
+// the owner sends each claimed number to the servers that have said that
+// they have a watcher for the namespace, and to its own watchers.
+type watchHub struct {
+	self    string
+	path    string
+	key     string // the peer key, nothing is sent to the other servers without it
+	peers   []string
+	timeout time.Duration // how long a long-poll waits for a number
+
+	mu       sync.Mutex
+	seq      uint64 // the ID of the last event delivered
+	watched  map[string]*nsWatch
+	interest map[string]map[string]time.Time // namespace -> server -> expires
+
+	events chan watchEvent
+	done   chan struct{}
+	once   sync.Once
+}
+
+// newWatchHub returns a watch hub for the groupcache pool of the config
+func newWatchHub(config *configuration) *watchHub {
+	timeout, err := time.ParseDuration(config.Server.API.WatchTimeout)
+	log.OnErr(err).Fatalf("[config] watch timeout: %v", err)
+
+	h := &watchHub{
+		self:     config.Groupcache.internal.self,
+		path:     config.Groupcache.WatchPath,
+		key:      config.Groupcache.PeerKey,
+		peers:    config.Groupcache.Pool,
+		timeout:  timeout,
+		watched:  make(map[string]*nsWatch),
+		interest: make(map[string]map[string]time.Time),
+		events:   make(chan watchEvent, watchQueue),
+		done:     make(chan struct{}),
+	}
+	go h.send()
+	go h.renew()
+
+	return h
+}
+
+// Shutdown stops sending events and ends any open watches
+func (h *watchHub) Shutdown() error {
+	h.once.Do(func() { close(h.done) })
+	return nil
+}
+
+// claimed is called from the groupcache getter for the range of numbers
+// that it claims, the event is only queued when the namespace is watched on
+// this server or another one, so the getter is never held up by watchers
+func (h *watchHub) claimed(ns string, first, last, step uint64, ctx interface{}) {
+	cr, ok := ctx.(contextResponder)
+	if !ok || !h.watching(ns) {
+		return
+	}
+
+	ev := watchEvent{
+		Namespace: ns,
+		Number:    strconv.FormatUint(first, 10),
+		ServerID:  cr.Data().ServerID,
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		num:       first,
+		last:      last,
+		step:      step,
+	}
+	if last > first {
+		ev.Last, ev.Step = strconv.FormatUint(last, 10), strconv.FormatUint(step, 10)
+	}
+	select {
+	case h.events <- ev:
+	default:
+		log.Printf("[watch] the event queue is full, dropped %s %s", ns, ev.Number)
+	}
+}
+
+// watching returns if the namespace has a watcher on this server, or on
+// another server that has said so
+func (h *watchHub) watching(ns string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	_, ok := h.watched[ns]
+	return ok || len(h.interest[ns]) > 0
+}
+
+// subscribe adds a watcher for the namespace, the recent events are given
+// back so a watcher can catch up. The cancel func must be called once done.
+func (h *watchHub) subscribe(ns string) (chan watchEvent, []watchEvent, func()) {
+	ch := make(chan watchEvent, watchBuffer)
+
+	h.mu.Lock()
+	nw, ok := h.watched[ns]
+	if !ok {
+		nw = &nsWatch{subs: make(map[chan watchEvent]struct{})}
+		h.watched[ns] = nw
+		if len(h.key) > 0 {
+			go h.announce([]string{ns})
+		}
+	}
+	nw.subs[ch] = struct{}{}
+	recent := append([]watchEvent(nil), nw.recent...)
+	h.mu.Unlock()
+
+	cancel := func() {
+		h.mu.Lock()
+		if _, ok := nw.subs[ch]; ok {
+			delete(nw.subs, ch)
+			close(ch)
+		}
+		if len(nw.subs) == 0 {
+			nw.expires = time.Now().Add(watchExpire) // keep the events for the next long-poll
+		}
+		h.mu.Unlock()
+	}
+	return ch, recent, cancel
+}
+
+// deliver passes events to the watchers on this server, each is given the
+// next ID so a watcher can carry on after the last one it saw, which the
+// numbers can't do as they aren't in order when obfuscated or wrapping. A
+// watcher that has fallen too far behind is dropped.
+func (h *watchHub) deliver(events []watchEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, ev := range events {
+		nw, ok := h.watched[ev.Namespace]
+		if !ok {
+			continue
+		}
+		h.seq++
+		ev.ID = h.seq
+
+		nw.recent = append(nw.recent, ev)
+		if len(nw.recent) > watchRecent {
+			nw.recent = nw.recent[len(nw.recent)-watchRecent:]
+		}
+
+		for ch := range nw.subs {
+			select {
+			case ch <- ev:
+			default:
+				delete(nw.subs, ch)
+				close(ch)
+			}
+		}
+	}
+}
+
+// send takes the queued events and sends them to this server's watchers
+// and on to the servers watching the namespaces
+func (h *watchHub) send() {
+	for {
+		select {
+		case <-h.done:
+			return
+		case ev := <-h.events:
+			var batch = []watchEvent{ev}
+		drain:
+			for len(batch) < watchBatch {
+				select {
+				case ev := <-h.events:
+					batch = append(batch, ev)
+				default:
+					break drain
+				}
+			}
+
+			h.deliver(batch)
+			if len(h.key) > 0 {
+				h.fanOut(batch)
+			}
+		}
+	}
+}
+
+// fanOut sends the events to the other servers that are watching the namespaces
+func (h *watchHub) fanOut(events []watchEvent) {
+	var perPeer = make(map[string][]watchEvent)
+
+	now := time.Now()
+	h.mu.Lock()
+	for _, ev := range events {
+		for peer, expires := range h.interest[ev.Namespace] {
+			if now.After(expires) {
+				delete(h.interest[ev.Namespace], peer)
+				continue
+			}
+			perPeer[peer] = append(perPeer[peer], ev)
+		}
+	}
+	h.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for peer, evs := range perPeer {
+		wg.Add(1)
+		go func(peer string, evs []watchEvent) {
+			defer wg.Done()
+			if err := h.post(peer, "/events", evs); err != nil {
+				log.Printf("[watch] events %s: %v", peer, err)
+			}
+		}(peer, evs)
+	}
+	wg.Wait()
+}
+
+// renew tells the other servers which namespaces are still watched on
+// this server, namespaces that are no longer watched are dropped
+func (h *watchHub) renew() {
+	ticker := time.NewTicker(watchRenew)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.done:
+			return
+		case now := <-ticker.C:
+			var nss []string
+
+			h.mu.Lock()
+			for ns, nw := range h.watched {
+				if len(nw.subs) == 0 && now.After(nw.expires) {
+					delete(h.watched, ns)
+					continue
+				}
+				nss = append(nss, ns)
+			}
+			for ns, peers := range h.interest {
+				for peer, expires := range peers {
+					if now.After(expires) {
+						delete(peers, peer)
+					}
+				}
+				if len(peers) == 0 {
+					delete(h.interest, ns)
+				}
+			}
+			h.mu.Unlock()
+
+			if len(nss) > 0 && len(h.key) > 0 {
+				h.announce(nss)
+			}
+		}
+	}
+}
+
+// announce tells every other server in the pool that the namespaces are watched on this server
+func (h *watchHub) announce(nss []string) {
+	sub := watchSubscription{Peer: h.self, Namespaces: nss}
+	for _, peer := range h.peers {
+		if peer == h.self {
+			continue
+		}
+		if err := h.post(peer, "/subscribe", sub); err != nil {
+			log.Printf("[watch] subscribe %s: %v", peer, err)
+		}
+	}
+}
+
+// post sends a JSON body to the watch path of another server
+func (h *watchHub) post(peer, path string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	uri := strings.TrimRight(peer, "/") + h.path + path
+	req, err := http.NewRequest(http.MethodPost, uri, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+h.key)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := watchPeerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// isPeer returns if the server is in the groupcache pool, so events are
+// never sent anywhere else
+func (h *watchHub) isPeer(server string) bool {
+	for _, peer := range h.peers {
+		if peer == server {
+			return true
+		}
+	}
+	return false
+}
+
+// UsePeerKey only lets requests through that have the peer key, so only the
+// servers in the pool can claim numbers through groupcache, and subscribe to
+// and send watch events
+func (web *webServer) UsePeerKey(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := bearerToken(r)
+		if len(key) == 0 {
+			responseOnErr(w, ErrUnauthorized{errNoAPIKey})
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(key), []byte(web.watch.key)) != 1 {
+			responseOnErr(w, ErrForbidden{errNotPeer})
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// WatchSubscribeHandler records the namespaces that another server is watching
+func (web *webServer) WatchSubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	var sub watchSubscription
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, watchBodyLimit)).Decode(&sub); err != nil {
+		responseOnErr(w, ErrBadRequest{err})
+		return
+	}
+	if !web.watch.isPeer(sub.Peer) {
+		responseOnErr(w, ErrForbidden{errNotPeer})
+		return
+	}
+
+	expires := time.Now().Add(watchExpire)
+	web.watch.mu.Lock()
+	for _, ns := range sub.Namespaces {
+		if _, ok := web.watch.interest[ns]; !ok {
+			web.watch.interest[ns] = make(map[string]time.Time)
+		}
+		web.watch.interest[ns][sub.Peer] = expires
+	}
+	web.watch.mu.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// WatchEventsHandler passes the events sent from another server to the watchers on this server
+func (web *webServer) WatchEventsHandler(w http.ResponseWriter, r *http.Request) {
+	var events []watchEvent
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, watchBodyLimit)).Decode(&events); err != nil {
+		responseOnErr(w, ErrBadRequest{err})
+		return
+	}
+
+	for i := range events {
+		if err := events[i].parse(); err != nil {
+			responseOnErr(w, ErrBadRequest{err})
+			return
+		}
+	}
+	web.watch.deliver(events)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveWatch sends the numbers claimed in a namespace as they happen. A
+// client that accepts text/event-stream gets Server-Sent Events, any other
+// client gets a long-poll that returns the next numbers or a 204 No Content
+// once the watch timeout passes. The Last-Event-ID header or the ?after=
+// query gives back the recent events after the one with that ID.
+func (web *webServer) serveWatch(w http.ResponseWriter, r *http.Request, prefix string) {
+	if !web.canServe {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	ns, asJSON := namespace(prefix, r)
+
+	var after uint64
+	var hasAfter bool
+	for _, s := range []string{r.Header.Get("Last-Event-ID"), r.URL.Query().Get("after")} {
+		if len(s) == 0 {
+			continue
+		}
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			responseOnErr(w, ErrBadRequest{fmt.Errorf("after: %v", err)})
+			return
+		}
+		after, hasAfter = n, true
+		break
+	}
+
+	ch, recent, cancel := web.watch.subscribe(ns)
+	defer cancel()
+
+	var missed []watchEvent
+	if hasAfter {
+		for _, ev := range recent {
+			if ev.ID > after {
+				missed = append(missed, ev)
+			}
+		}
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		web.streamWatch(w, r, ch, missed, asJSON)
+		return
+	}
+
+	if len(missed) == 0 {
+		timer := time.NewTimer(web.watch.timeout)
+		defer timer.Stop()
+
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			missed = append(missed, ev)
+		case <-timer.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		case <-web.watch.done:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	// pick up anything else that came in at the same time
+drain:
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				break drain
+			}
+			missed = append(missed, ev)
+		default:
+			break drain
+		}
+	}
+
+	w.Header().Set("Last-Event-ID", strconv.FormatUint(missed[len(missed)-1].ID, 10)) // for the ?after= of the next long-poll
+	if asJSON {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(missed); err != nil {
+			log.Printf("[watch] json encode: %v", err)
+		}
+		return
+	}
+	for _, ev := range missed {
+		for _, num := range ev.numbers() {
+			fmt.Fprintf(w, "%s\n", num)
+		}
+	}
+}
+
+// streamWatch writes the events as Server-Sent Events until the client goes away
+func (web *webServer) streamWatch(w http.ResponseWriter, r *http.Request, ch chan watchEvent, missed []watchEvent, asJSON bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		responseOnErr(w, ErrInternalService{errNoStreaming})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // stop proxies from holding back events
+	w.WriteHeader(http.StatusOK)
+
+	// a range is sent as one event, with a data line for each number
+	write := func(ev watchEvent) {
+		data := ev.numbers()
+		if asJSON {
+			b, _ := json.Marshal(ev)
+			data = []string{string(b)}
+		}
+		fmt.Fprintf(w, "id: %d\nevent: claim\n", ev.ID)
+		for _, d := range data {
+			fmt.Fprintf(w, "data: %s\n", d)
+		}
+		fmt.Fprint(w, "\n")
+	}
+
+	for _, ev := range missed {
+		write(ev)
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				return // fell too far behind, the client can reconnect with Last-Event-ID
+			}
+			write(ev)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-web.watch.done:
+			return
+		}
+		flusher.Flush()
+	}
+}
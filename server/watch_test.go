@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchPeerKey(t *testing.T) {
+	srv := testHTTPS(t)
+	path := testConfig(t).Groupcache.WatchPath
+
+	for _, tc := range []struct {
+		name, path, key, body string
+		want                  int
+	}{
+		{"events without a key", "/events", "", `[]`, http.StatusUnauthorized},
+		{"events with a wrong key", "/events", "nope", `[]`, http.StatusForbidden},
+		{"events with the key", "/events", "test-peer-key", `[]`, http.StatusNoContent},
+		{"subscribe without a key", "/subscribe", "", `{"peer":"http://127.0.0.1:80","namespaces":["pub/a"]}`, http.StatusUnauthorized},
+		{"subscribe for a server outside the pool", "/subscribe", "test-peer-key", `{"peer":"http://10.0.0.1","namespaces":["pub/a"]}`, http.StatusForbidden},
+	} {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+path+tc.path, strings.NewReader(tc.body))
+		if len(tc.key) > 0 {
+			req.Header.Set("Authorization", "Bearer "+tc.key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, resp.StatusCode, tc.want)
+		}
+	}
+}
+
+func TestWatchEventsFromPeer(t *testing.T) {
+	srv := testHTTPS(t)
+	config := testConfig(t)
+
+	ch, _, cancel := config.Web.watch.subscribe("pub/watched")
+	defer cancel()
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+config.Groupcache.WatchPath+"/events",
+		strings.NewReader(`[{"namespace":"pub/watched","number":"7","server_id":"x","timestamp":"1"}]`))
+	req.Header.Set("Authorization", "Bearer test-peer-key")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	select {
+	case ev := <-ch:
+		if ev.Number != "7" {
+			t.Errorf("got number %s, want 7", ev.Number)
+		}
+	case <-time.After(time.Second):
+		t.Error("the event from the peer wasn't delivered")
+	}
+}
+
+func TestWatchRangeEvent(t *testing.T) {
+	config := testConfig(t)
+	ns := testNS(t, "pub/")
+
+	if config.Web.watch.watching(ns) {
+		t.Fatal("an unwatched namespace is watched")
+	}
+	ch, _, cancel := config.Web.watch.subscribe(ns)
+	defer cancel()
+	if !config.Web.watch.watching(ns) {
+		t.Fatal("a watched namespace isn't watched")
+	}
+
+	c, err := config.Web.claim(ns, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case ev := <-ch:
+		nums := ev.numbers()
+		if len(nums) != 5 || ev.Number != strconv.FormatUint(c.First, 10) || nums[4] != strconv.FormatUint(c.Last, 10) {
+			t.Errorf("got %v, want %d-%d in one event", nums, c.First, c.Last)
+		}
+	case <-time.After(time.Second):
+		t.Error("the range wasn't sent")
+	}
+}
+
+func TestWatchEventNumbers(t *testing.T) {
+	for _, tc := range []struct {
+		ev   watchEvent
+		want string
+	}{
+		{watchEvent{Number: "7"}, "7"},
+		{watchEvent{Number: "7", Last: "9"}, "7 8 9"},
+		{watchEvent{Number: "10", Last: "25", Step: "5"}, "10 15 20 25"},
+		{watchEvent{Number: "18446744073709551614", Last: "18446744073709551615"}, "18446744073709551614 18446744073709551615"},
+	} {
+		if err := tc.ev.parse(); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(tc.ev.numbers(), " "); got != tc.want {
+			t.Errorf("%s-%s: got %s, want %s", tc.ev.Number, tc.ev.Last, got, tc.want)
+		}
+	}
+}
+
+func TestWatchAfterID(t *testing.T) {
+	config, srv := testConfig(t), testHTTPS(t)
+	ns := testNS(t, "pub/")
+
+	_, _, cancel := config.Web.watch.subscribe(ns)
+	defer cancel()
+
+	// the numbers go down, as they would when obfuscated or wrapping
+	var events []watchEvent
+	for _, num := range []string{"9", "3", "5"} {
+		ev := watchEvent{Namespace: ns, Number: num}
+		if err := ev.parse(); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+	config.Web.watch.deliver(events)
+
+	_, recent, cancelRecent := config.Web.watch.subscribe(ns)
+	cancelRecent()
+	if len(recent) != 3 {
+		t.Fatalf("got %d recent events, want 3", len(recent))
+	}
+
+	resp, err := http.Get(srv.URL + "/" + ns + "?watch&after=" + strconv.FormatUint(recent[0].ID, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "3\n5\n" {
+		t.Errorf("got %q, want the two numbers after the first event", body)
+	}
+	if id := resp.Header.Get("Last-Event-ID"); id != strconv.FormatUint(recent[2].ID, 10) {
+		t.Errorf("got Last-Event-ID %s, want %d", id, recent[2].ID)
+	}
+}
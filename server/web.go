@@ -39,16 +39,61 @@ type webServer struct {
 	serverID string
 	canServe bool
 
-	cache *groupcache.Group // holds the incrr atomic increment key
+	cache   *groupcache.Group // holds the incrr atomic increment key
+	keys    *apiKeyCache      // holds the API keys looked up from the remote DB
+	options *nsOptionsCache   // holds the namespace options looked up from the remote DB
+	watch   *watchHub         // sends the claimed numbers to the watchers of a namespace
+	hooks   *webhookSender    // queues and sends the threshold webhooks
+	limits  *rateLimiter      // the rate limits of the public API
+	cycles  *cycleTracker     // records the cycles of namespaces that wrap at their max
+	periods *periodTracker    // picks the current period of namespaces that reset
+
+	snowflake *snowflakeGen // makes the time sortable IDs of this server
+
+	idem       *groupcache.Group // holds the claims made for idempotency keys
+	idemWindow time.Duration
+	leaseTTL   time.Duration // how long a reserved number is held before it can be given out again
+
+	alloc *groupcache.Group // acquires the released numbers of allocator namespaces
 
 	APIDomains []string
+	maxBatch   uint64   // the most numbers that can be claimed in one request
 	local      *localDB // holds the local increment key
 	remote     remoteDB // holds the remote (DB) increment key
 
+	adminURL  string
+	adminKeys []string
+	self      string   // this server in the groupcache pool
+	peers     []string // all of the servers in the groupcache pool
+
 	http  *serveHTTP
 	https *serveHTTPS
 }
 
+// nsResponse is the JSON body sent back for namespace requests, the numbers
+// are strings because JSON doesn't support uint64
+type nsResponse struct {
+	Namespace string `json:"namespace"`
+	Number    string `json:"number"`
+	Last      string `json:"last,omitempty"`
+	ID        string `json:"id,omitempty"`      // the number as it's given out, when the namespace has a format
+	LastID    string `json:"last_id,omitempty"` // the last number as it's given out, when the namespace has a format
+	ServerID  string `json:"server_id"`
+	Timestamp string `json:"timestamp"`
+	Source    string `json:"source,omitempty"`
+	Version   string `json:"version"`
+}
+
+// nsValidateResponse is the JSON body of a validated number
+type nsValidateResponse struct {
+	Namespace string `json:"namespace"`
+	ID        string `json:"id"`
+	Number    string `json:"number,omitempty"`
+	Valid     bool   `json:"valid"`  // if the id is in the format of the namespace, with a matching check digit
+	Issued    bool   `json:"issued"` // if the number has been claimed in the namespace
+	Version   string `json:"version"`
+}
+
 // serveHTTP is the struct that holds the state for the HTTP server
 type serveHTTP struct {
 	chi.Router
@@ -67,8 +112,13 @@ type serveHTTPS struct {
 
 // isInDomain checks if a request is within a domain
 func (web *webServer) isInDomain(r *http.Request, domains []string) bool {
+	return inDomain(r.Host, domains)
+}
+
+// inDomain checks if a host (with or without a port) is within a domain
+func inDomain(host string, domains []string) bool {
 	for _, v := range domains {
-		if strings.ToLower(v) == strings.ToLower(strings.Split(r.Host, ":")[0]) {
+		if strings.ToLower(v) == strings.ToLower(strings.Split(host, ":")[0]) {
 			return true
 		}
 	}
@@ -98,137 +148,325 @@ func (web *webServer) PublicNSHandlerCheck(h http.Handler) http.Handler {
 			return
 		}
 
-		base := strings.TrimSuffix(u.Path, filepath.Ext(u.Path))
-
-		if len(strings.Split(u.Path, "/")) > 5 {
-			err = fmt.Errorf("path has too many seperators & %v", err)
+		if err = checkNSPath(u.Path); err != nil {
+			responseOnErr(w, ErrBadRequest{err})
+			return
 		}
 
-		if len(base) > 300 {
-			err = fmt.Errorf("path is too long & %v", err)
-		}
+		h.ServeHTTP(w, r)
+	})
+}
 
-		if len(filepath.Ext(u.Path)) > 0 && filepath.Ext(u.Path) != ".json" {
-			err = fmt.Errorf("path does not support this extension & %v", err)
-		}
+// checkNSPath makes sure that a namespace path falls within valid parameters,
+// these are the same for every way that a namespace can be asked for
+func checkNSPath(path string) (err error) {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
 
-		if utf8.RuneCountInString(base) != len(base) {
-			err = fmt.Errorf("path has non-ASCII character(s) & %v", err)
-		}
+	if len(strings.Split(path, "/")) > 5 {
+		err = fmt.Errorf("path has too many seperators & %v", err)
+	}
 
-		if strings.ContainsAny(base, "~`!@#$%^&*()_+=-{}|[]\\:\";'<>?,.") {
-			err = fmt.Errorf("path has URL special character(s) & %v", err)
-		}
+	if len(base) > 300 {
+		err = fmt.Errorf("path is too long & %v", err)
+	}
 
-		if err != nil {
-			responseOnErr(w, ErrBadRequest{err})
-			return
-		}
+	if len(filepath.Ext(path)) > 0 && filepath.Ext(path) != ".json" {
+		err = fmt.Errorf("path does not support this extension & %v", err)
+	}
 
-		h.ServeHTTP(w, r)
-	})
+	if utf8.RuneCountInString(base) != len(base) {
+		err = fmt.Errorf("path has non-ASCII character(s) & %v", err)
+	}
+
+	if strings.ContainsAny(base, "~`!@#$%^&*()_+=-{}|[]\\:\";'<>?,.") {
+		err = fmt.Errorf("path has URL special character(s) & %v", err)
+	}
+
+	return err
 }
 
 // PublicNSHandler handles all of the api traffic that serves public namespaced keys
 func (web *webServer) PublicNSHandler(w http.ResponseWriter, r *http.Request) {
+	web.serveNS(w, r, "pub/")
+}
+
+// PrivateNSHandler handles all of the api traffic that serves private namespaced keys,
+// the API key has already been checked by the UseAPIKeys middleware
+func (web *webServer) PrivateNSHandler(w http.ResponseWriter, r *http.Request) {
+	web.serveNS(w, r, "priv/")
+}
+
+// serveNS claims the next number(s) for the namespace of the request under the
+// namespace prefix
+func (web *webServer) serveNS(w http.ResponseWriter, r *http.Request, prefix string) {
 	if !web.canServe {
 		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
 	}
 
-	var err error
+	if _, ok := r.URL.Query()["peek"]; ok {
+		web.servePeek(w, r, prefix)
+		return
+	}
+	if _, ok := r.URL.Query()["watch"]; ok {
+		web.serveWatch(w, r, prefix)
+		return
+	}
+	if _, ok := r.URL.Query()["validate"]; ok {
+		web.serveValidate(w, r, prefix)
+		return
+	}
 
-	// 1. See if we have the key locally, and GET that value
-	// 2. If no key locally, see if we have the key remotely
-	// 3. Check that the value is in Groupcache, if not then the key was evicted
-	// 4. Replicas should take care of members joining and leaving the pool
+	count, err := web.batchCount(r)
+	if err != nil {
+		responseOnErr(w, ErrBadRequest{err})
+		return
+	}
 
-	var idxB, idx, hasKey = []byte{}, uint64(0), false
-	ns := "pub/" + chi.URLParam(r, "*") // adds the pub/ prefix back in for consistency
-	if idxB = web.local.Get([]byte(ns)); len(idxB) == 0 {
-		hasKey = web.remote.HasKey(ns)
-		if !hasKey {
-			// if we can't find the key, then we pull the latest...
-			// this should be okay because we should be looking
-			// for pretty old keys, and new keys should be in memory
-			web.remote.Keys()
-			hasKey = web.remote.HasKey(ns)
+	var c claimed
+	ns, asJSON := namespace(prefix, r) // adds the prefix back in for consistency
+	if key := r.Header.Get(defaultIdempotencyHeader); len(key) > 0 {
+		caller := bearerToken(r)
+		if len(caller) == 0 {
+			caller = web.limits.clientIP(r)
 		}
+		c, err = web.claimIdempotent(ns, count, caller, key)
+	} else {
+		c, err = web.claim(ns, count)
+	}
+	if err == nil {
+		err = web.formatIDs(&c)
+	}
+	if err != nil {
+		log.Printf("[%sNS] %v", prefix, err)
+		responseOnErr(w, err)
+		return
 	}
 
-	if len(idxB) > 0 {
-		hasKey = true
-		idx, err = strconv.ParseUint(string(idxB), 10, 64)
-		if err != nil {
-			log.Printf("[public NS] strconv idx: %v", err)
-			responseOnErr(w, ErrInternalService{err})
-			return
-		}
+	if asJSON {
+		responseJSON(w, c)
+		return
+	}
+
+	if count > 1 {
+		fmt.Fprintf(w, "%s-%s", c.FirstID, c.LastID)
+		return
+	}
+	fmt.Fprint(w, c.LastID)
+}
+
+// servePeek returns the highest known value for a namespace without claiming
+// a new number
+func (web *webServer) servePeek(w http.ResponseWriter, r *http.Request, prefix string) {
+	if !web.canServe {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	ns, asJSON := namespace(prefix, r)
+	val, source, err := web.current(ns)
+	if err != nil {
+		log.Printf("[%sNS peek] %v", prefix, err)
+		responseOnErr(w, err)
+		return
+	}
+
+	c := claimed{
+		NS: ns, First: val, Last: val, Source: source,
+		resp: &respContext{ServerID: web.serverID, Timestamp: strconv.FormatInt(time.Now().UnixNano(), 10)},
+	}
+	if err := web.formatIDs(&c); err != nil {
+		log.Printf("[%sNS peek] %v", prefix, err)
+		responseOnErr(w, err)
+		return
+	}
+
+	w.Header().Set(defaultSourceHeader, source)
+	if asJSON {
+		responseJSON(w, c)
+		return
+	}
+	fmt.Fprint(w, c.LastID)
+}
+
+// serveValidate checks a number that was given out by the namespace, i.e: one
+// typed in by a person. The text response is true only when the number is valid
+// and has been issued, the JSON response has the details.
+func (web *webServer) serveValidate(w http.ResponseWriter, r *http.Request, prefix string) {
+	if !web.canServe {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
 	}
 
-RestartCount:
-	max := idx + 10000
-	for ; idx < max; idx++ {
-		var cacheCtx contextEqualizer
-		var respCtx contextResponder
-		var respStr string
-
-		// check remote if don't have local, but do remote OR if you're sending the very first request
-		ts := strconv.FormatInt(time.Now().UnixNano(), 10)
-		if (hasKey && len(idxB) == 0) || (max-idx) == 0 {
-			cacheCtx = &remoteContext{respContext: &respContext{ServerID: web.serverID, Timestamp: ts}}
-			respCtx = &remoteContext{}
-		} else {
-			cacheCtx = &respContext{ServerID: web.serverID, Timestamp: ts}
-			respCtx = &respContext{}
+	id := r.URL.Query().Get("validate")
+	if len(id) == 0 {
+		responseOnErr(w, ErrBadRequest{errNoID})
+		return
+	}
+
+	ns, asJSON := namespace(prefix, r)
+	n, valid, issued, err := web.validate(ns, id)
+	if err != nil {
+		log.Printf("[%sNS validate] %v", prefix, err)
+		responseOnErr(w, err)
+		return
+	}
+
+	if asJSON {
+		body := nsValidateResponse{Namespace: ns, ID: id, Valid: valid, Issued: issued, Version: verSemVer}
+		if valid {
+			body.Number = strconv.FormatUint(n, 10)
 		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			log.Printf("[response] json encode: %v", err)
+		}
+		return
+	}
+	fmt.Fprint(w, valid && issued)
+}
 
-		if err = web.cache.Get(cacheCtx, fmt.Sprintf("%d:%s", idx, ns), groupcache.StringSink(&respStr)); err != nil {
-			log.Printf("[public NS] cache response: %v", err)
-			responseOnErr(w, ErrInternalService{err})
-			return
+// validate returns the number of the id, if the id is valid for the namespace
+// and if the number has been issued according to the remote DB
+func (web *webServer) validate(ns, id string) (n uint64, valid, issued bool, err error) {
+	if ns, err = web.periods.namespace(ns); err != nil { // only the ids of the current period are checked
+		return 0, false, false, err
+	}
+
+	opts, err := web.options.Get(ns)
+	if err != nil {
+		return 0, false, false, ErrInternalService{fmt.Errorf("[validate] options: %v", err)}
+	}
+
+	n, valid = opts.parse(id)
+	if !valid || !opts.obfuscates(n) {
+		return n, false, false, nil
+	}
+
+	seq := opts.deobfuscate(n) // the sequence number is looked up, but never given back
+	if !opts.fits(seq) || (opts.wraps() && seq > opts.Max) {
+		return n, false, false, nil
+	}
+
+	// the history has the claimed numbers, which keep going up past the max
+	// of a namespace that wraps, so once it has wrapped every number of the
+	// sequence has been given out
+	if opts.wraps() {
+		cycle, err := web.remote.Cycle(ns)
+		if err != nil {
+			return n, true, false, ErrInternalService{fmt.Errorf("[validate] cycle: %v", err)}
+		}
+		if cycle > 0 {
+			return n, true, true, nil
 		}
+	}
 
-		if err = json.Unmarshal([]byte(respStr), &respCtx); err != nil {
-			log.Printf("[public NS] json unmarshal: %v", err)
-			responseOnErr(w, ErrInternalService{err})
-			return
+	issued, err = web.remote.Issued(ns, seq)
+	if err != nil {
+		return n, true, false, ErrInternalService{fmt.Errorf("[validate] issued: %v", err)}
+	}
+	return n, true, issued, nil
+}
+
+// current returns the highest known value for a namespace without incrementing
+// it. The local datastore is checked first then the remote datastore, the
+// source that answered is returned with the value
+func (web *webServer) current(ns string) (uint64, string, error) {
+	var source = "local"
+
+	ns, err := web.periods.namespace(ns)
+	if err != nil {
+		return 0, "", err
+	}
+
+	valB := web.local.Get([]byte(ns))
+	if len(valB) == 0 {
+		var err error
+		if valB, err = web.remote.Get([]byte(ns)); err != nil {
+			return 0, "", ErrInternalService{err}
 		}
+		source = "remote"
+	}
 
-		// see if we can claim a number
-		resp := respCtx.Data()
-		ctxAreEqual := cacheCtx.Equal(resp.ServerID, resp.Timestamp)
-
-		if ctxAreEqual && resp.Number == strconv.FormatUint(idx, 10) {
-			// the JSON sent back from Groupcache can "change" type, so we
-			// get the Response() back to figure out what type the response
-			// really was meant to be
-			if skip, ok := respCtx.Response().(contextSkipper); ok {
-				ctxSkipTo, err := skip.SkipTo()
-				if err != nil {
-					responseOnErr(w, ErrInternalService{err})
-					return
-				}
-				idx = ctxSkipTo
-				goto RestartCount // yup, it's been considered and accepted
-			}
+	if len(valB) == 0 {
+		return 0, "", ErrNotFound{errNoNamespaceValue}
+	}
 
-			fmt.Fprintf(w, "%d", idx)
-			return
+	val, err := strconv.ParseUint(string(valB), 10, 64)
+	if err != nil {
+		return 0, "", ErrInternalService{ErrParseUint64(err)}
+	}
+
+	// the remote value is kept after a namespace is retired, so it's only
+	// current if it was claimed again after the tombstone
+	if source == "remote" {
+		ts, err := web.remote.Tombstone(ns)
+		if err != nil {
+			return 0, "", ErrInternalService{err}
+		}
+		if ts != nil && val <= ts.Value {
+			return 0, "", ErrGone{errRetired}
 		}
 	}
 
-	responseOnErr(w, ErrBadRequest{errMaxIncrementRange})
+	opts, err := web.options.Get(ns)
+	if err != nil {
+		return 0, "", ErrInternalService{err}
+	}
+	return opts.obfuscate(opts.number(val)), source, nil // the number given out
 }
 
 // HealthcheckHandler returns 200 OK when things are healthy
 func (web *webServer) HealthcheckHandler(w http.ResponseWriter, r *http.Request) {
 	if !web.canServe {
 		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
 	}
 
 	http.Error(w, http.StatusText(http.StatusOK), http.StatusOK)
 }
 
+// namespace returns the namespace of the request with the prefix added back
+// in, and if the response should be sent back as JSON
+func namespace(prefix string, r *http.Request) (ns string, asJSON bool) {
+	ns = prefix + chi.URLParam(r, "*")
+	if filepath.Ext(ns) == ".json" {
+		return strings.TrimSuffix(ns, ".json"), true
+	}
+	return ns, false
+}
+
+// responseJSON writes the claimed numbers as a JSON body
+func responseJSON(w http.ResponseWriter, c claimed) {
+	var ts string
+	if nano, err := strconv.ParseInt(c.resp.Timestamp, 10, 64); err == nil {
+		ts = time.Unix(0, nano).UTC().Format(time.RFC3339Nano)
+	}
+
+	body := nsResponse{
+		Namespace: c.NS,
+		Number:    strconv.FormatUint(c.First, 10),
+		ServerID:  c.resp.ServerID,
+		Timestamp: ts,
+		Source:    c.Source,
+		Version:   verSemVer,
+	}
+	if c.First != c.Last {
+		body.Last = strconv.FormatUint(c.Last, 10)
+	}
+	if len(c.FirstID) > 0 && c.FirstID != body.Number {
+		body.ID = c.FirstID
+		if c.First != c.Last {
+			body.LastID = c.LastID
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("[response] json encode: %v", err)
+	}
+}
+
 // responseOnErr returns a standard HTTP error code response based on the error type. Wrap
 // errors with a supported type for the expected response
 func responseOnErr(w http.ResponseWriter, err error) {
@@ -237,6 +475,20 @@ func responseOnErr(w http.ResponseWriter, err error) {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 	case ErrBadRequest:
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	case ErrNotFound:
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	case ErrUnauthorized:
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	case ErrForbidden:
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	case ErrConflict:
+		http.Error(w, http.StatusText(http.StatusConflict), http.StatusConflict)
+	case ErrGone:
+		http.Error(w, http.StatusText(http.StatusGone), http.StatusGone)
+	case ErrTooManyRequests:
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+	case ErrServiceUnavailable:
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
 	default:
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
 	}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/incrr-core/core/client"
+)
+
+// testClient returns a client of the test server
+func testClient(t *testing.T, config client.Config) *client.Client {
+	t.Helper()
+	config.Endpoints = []string{testHTTPS(t).URL}
+	c, err := client.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClaimHTTP(t *testing.T) {
+	c, ctx := testClient(t, client.Config{}), context.Background()
+	ns := testNS(t, "pub/")
+
+	b, err := c.Batch(ctx, ns, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Namespace != ns || b.First != 0 || b.Last != 2 {
+		t.Errorf("batch: got %s %d-%d, want %s 0-2", b.Namespace, b.First, b.Last, ns)
+	}
+
+	n, err := c.Next(ctx, ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Number != 3 {
+		t.Errorf("next: got %d, want 3", n.Number)
+	}
+
+	if n, err = c.Peek(ctx, ns); err != nil || n.Number != 3 {
+		t.Errorf("peek: got %d %v, want 3", n.Number, err)
+	}
+}
+
+func TestClaimHTTPPrefetch(t *testing.T) {
+	c, ctx := testClient(t, client.Config{Prefetch: 5}), context.Background()
+	ns := testNS(t, "pub/")
+
+	seen := make(map[uint64]bool)
+	for i := 0; i < 12; i++ {
+		n, err := c.Next(ctx, ns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seen[n.Number] {
+			t.Fatalf("%d was given out twice", n.Number)
+		}
+		seen[n.Number] = true
+	}
+}
+
+func TestClaimHTTPIdempotencyKey(t *testing.T) {
+	srv := testHTTPS(t)
+	ns := testNS(t, "pub/")
+
+	get := func(key string) string {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/"+ns, nil)
+		if len(key) > 0 {
+			req.Header.Set(defaultIdempotencyHeader, key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("got %s %s", resp.Status, body)
+		}
+		return string(body)
+	}
+
+	first := get("key-1")
+	if again := get("key-1"); again != first {
+		t.Errorf("retry: got %s, want %s", again, first)
+	}
+	if next := get(""); next == first {
+		t.Errorf("a claim without the key got %s back", next)
+	}
+}
+
+func TestClaimHTTPGapless(t *testing.T) {
+	c, ctx := testClient(t, client.Config{}), context.Background()
+	ns := testNS(t, "pub/")
+	testRemoteDB(t).SetOptions(ns, map[string]string{optGapless: "true"})
+
+	var serr *client.StatusError
+	if _, err := c.Next(ctx, ns); !errors.As(err, &serr) || serr.StatusCode != http.StatusBadRequest {
+		t.Errorf("next: got %v, want a 400", err)
+	}
+
+	l, err := c.Reserve(ctx, ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.Token) == 0 || l.State != client.StateReserved || l.Expires.IsZero() {
+		t.Errorf("reserve: got %+v", l)
+	}
+
+	done, err := c.Commit(ctx, ns, l.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done.Number != l.Number || done.State != client.StateCommitted {
+		t.Errorf("commit: got %+v, want %d committed", done, l.Number)
+	}
+}
+
+func TestClaimHTTPAllocator(t *testing.T) {
+	c, ctx := testClient(t, client.Config{}), context.Background()
+	ns := testNS(t, "pub/")
+	testRemoteDB(t).SetOptions(ns, map[string]string{optAllocator: "true"})
+
+	a, err := c.Acquire(ctx, ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Token) == 0 || a.State != client.StateAcquired {
+		t.Errorf("acquire: got %+v", a)
+	}
+
+	if _, err := c.Release(ctx, ns, a.Token); err != nil {
+		t.Fatal(err)
+	}
+	again, err := c.Acquire(ctx, ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Number != a.Number || again.Token == a.Token {
+		t.Errorf("acquire again: got %d %s, want %d with a new token", again.Number, again.Token, a.Number)
+	}
+}
+
+func TestGroupcachePeerKey(t *testing.T) {
+	config, srv := testConfig(t), testHTTPS(t)
+	ns := testNS(t, "priv/")
+
+	get := func(key, kind string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+config.Groupcache.BasePath+"incr/0:"+ns, nil)
+		if len(key) > 0 {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		req.Header.Set(config.Groupcache.Header.Kind, kind)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := get("", "local"); code != http.StatusUnauthorized {
+		t.Errorf("no key: got %d, want 401", code)
+	}
+	if code := get("wrong-key", "local"); code != http.StatusForbidden {
+		t.Errorf("wrong key: got %d, want 403", code)
+	}
+	if code := get(config.Groupcache.PeerKey, ""); code == http.StatusOK {
+		t.Error("a claim without a context was served")
+	}
+	if v, _ := testRemoteDB(t).Get([]byte(ns)); len(v) > 0 {
+		t.Errorf("the namespace was claimed up to %s", v)
+	}
+	if code := get(config.Groupcache.PeerKey, "local"); code != http.StatusOK {
+		t.Errorf("peer: got %d, want 200", code)
+	}
+}
+
+func TestGroupcacheBatchCount(t *testing.T) {
+	config, srv := testConfig(t), testHTTPS(t)
+	ns := testNS(t, "pub/")
+
+	for _, count := range []string{"0", "5001", "200000", "not-a-number"} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+config.Groupcache.BasePath+"incr/0:"+ns, nil)
+		req.Header.Set("Authorization", "Bearer "+config.Groupcache.PeerKey)
+		req.Header.Set(config.Groupcache.Header.Kind, "batch")
+		req.Header.Set(config.Groupcache.Header.Count, count)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Errorf("count %s: was served", count)
+		}
+	}
+	if v, _ := testRemoteDB(t).Get([]byte(ns)); len(v) > 0 {
+		t.Errorf("the namespace was claimed up to %s", v)
+	}
+}
+
+func TestClaimHTTPCantServe(t *testing.T) {
+	config, srv := testConfig(t), testHTTPS(t)
+	ns := testNS(t, "pub/")
+
+	config.Web.canServe = false
+	defer func() { config.Web.canServe = true }()
+
+	for _, query := range []string{"", "?count=3", "?peek", "?validate=1"} {
+		resp, err := http.Get(srv.URL + "/" + ns + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("%q: got %d, want 503", query, resp.StatusCode)
+		}
+	}
+	if v, _ := testRemoteDB(t).Get([]byte(ns)); len(v) > 0 {
+		t.Errorf("the namespace was claimed up to %s", v)
+	}
+}
+
+func TestClaimHTTPJSON(t *testing.T) {
+	config, srv := testConfig(t), testHTTPS(t)
+	ns := testNS(t, "pub/")
+	formatted := testNS(t, "pub/")
+	testRemoteDB(t).SetOptions(formatted, map[string]string{optPrefix: "ORD-", optPad: "3"})
+
+	get := func(path string) map[string]interface{} {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+			t.Fatalf("%s: got %s %s", path, resp.Status, resp.Header.Get("Content-Type"))
+		}
+		var body map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	for _, tc := range []struct {
+		path string
+		want map[string]interface{} // the fields that aren't checked on their own below
+	}{
+		{"/" + ns + ".json", map[string]interface{}{"namespace": ns, "number": "0"}},
+		{"/" + ns + ".json?count=3", map[string]interface{}{"namespace": ns, "number": "1", "last": "3"}},
+		{"/" + ns + ".json?peek", map[string]interface{}{"namespace": ns, "number": "3", "source": "local"}},
+		{"/" + formatted + ".json", map[string]interface{}{"namespace": formatted, "number": "0", "id": "ORD-000"}},
+		{"/" + formatted + ".json?count=2", map[string]interface{}{"namespace": formatted, "number": "1", "last": "2", "id": "ORD-001", "last_id": "ORD-002"}},
+	} {
+		body := get(tc.path)
+
+		if body["server_id"] != config.Web.serverID || body["version"] != verSemVer {
+			t.Errorf("%s: got server_id %v version %v", tc.path, body["server_id"], body["version"])
+		}
+		if ts, ok := body["timestamp"].(string); !ok {
+			t.Errorf("%s: got timestamp %v", tc.path, body["timestamp"])
+		} else if _, err := time.Parse(time.RFC3339Nano, ts); err != nil {
+			t.Errorf("%s: timestamp %v", tc.path, err)
+		}
+		delete(body, "server_id")
+		delete(body, "version")
+		delete(body, "timestamp")
+
+		if !reflect.DeepEqual(body, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.path, body, tc.want)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the limits of sending webhooks
+const (
+	webhookBatch      = 100       // the most due webhooks picked up at once
+	webhookMaxBackoff = time.Hour // the longest wait between attempts
+	webhookQueue      = 4096      // the claimed numbers waiting to be checked against the thresholds
+)
+
+// the headers sent with each webhook
+const (
+	webhookDeliveryHeader  = "Incrr-Delivery"
+	webhookSignatureHeader = "Incrr-Signature"
+)
+
+// threshold is a rule that sends a webhook the first time a number at or
+// above the value is claimed in the namespace
+type threshold struct {
+	ID        uint64
+	Namespace string
+	Value     uint64
+	URL       string
+}
+
+// webhookClaim is a claimed number waiting to be checked against the
+// thresholds of its namespace
+type webhookClaim struct {
+	ns string
+	n  uint64
+}
+
+// webhookDelivery is a webhook that has been queued in the remote DB
+// and is sent until the receiver accepts it
+type webhookDelivery struct {
+	ID        uint64
+	Namespace string
+	Threshold uint64
+	Value     uint64 // the number that was claimed at or above the threshold
+	URL       string
+	Attempts  int
+	Created   time.Time
+}
+
+// webhookPayload is the JSON body of a webhook, the numbers are strings
+// because JSON doesn't support uint64
+type webhookPayload struct {
+	ID        string `json:"id"` // the same for every attempt, so receivers can drop repeats
+	Event     string `json:"event"`
+	Namespace string `json:"namespace"`
+	Threshold string `json:"threshold"`
+	Number    string `json:"number"`
+	Timestamp string `json:"timestamp"`
+	Version   string `json:"version"`
+}
+
+// webhookSender queues a webhook when a claimed number passes a threshold
+// of the namespace, and sends the queued webhooks. The queue is kept in the
+// remote DB so any server can send a webhook, and a webhook is sent again
+// until the receiver gives back a 2xx, so it's sent at least once.
+type webhookSender struct {
+	sync.RWMutex
+
+	secret      []byte
+	maxAttempts int
+	timeout     time.Duration
+	poll        time.Duration
+	client      *http.Client
+	remote      remoteDB
+
+	rules *ttlCache           // the threshold rules of each namespace
+	fired map[uint64]struct{} // the thresholds that have already been queued
+
+	claims chan webhookClaim
+	wake   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+// newWebhookSender returns a webhook sender using the remote DB of the config, the
+// webhooks are only sent once there is a secret to sign them with
+func newWebhookSender(config *configuration) *webhookSender {
+	timeout, err := time.ParseDuration(config.Server.Webhooks.Timeout)
+	log.OnErr(err).Fatalf("[config] webhooks timeout: %v", err)
+
+	poll, err := time.ParseDuration(config.Server.Webhooks.PollInterval)
+	log.OnErr(err).Fatalf("[config] webhooks poll interval: %v", err)
+	if poll <= 0 {
+		log.Fatalf("[config] webhooks poll interval must be more than zero")
+	}
+
+	ttl, err := time.ParseDuration(config.Server.API.OptionsCacheTTL)
+	log.OnErr(err).Fatalf("[config] options cache ttl: %v", err)
+
+	ws := &webhookSender{
+		secret:      []byte(config.Server.Webhooks.Secret),
+		maxAttempts: config.Server.Webhooks.MaxAttempts,
+		timeout:     timeout,
+		poll:        poll,
+		client:      &http.Client{Timeout: timeout},
+		remote:      config.Datastore.RemoteDB,
+		rules:       newTTLCache(config.Server.API.CacheSize, ttl),
+		fired:       make(map[uint64]struct{}),
+		claims:      make(chan webhookClaim, webhookQueue),
+		wake:        make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+
+	go ws.check()
+
+	if len(ws.secret) == 0 {
+		log.Warnf("no webhooks secret is set, threshold webhooks are queued but not sent")
+		return ws
+	}
+	go ws.run()
+
+	return ws
+}
+
+// Shutdown stops sending webhooks, any that are due are sent by the
+// other servers or once this server is back
+func (ws *webhookSender) Shutdown() error {
+	ws.once.Do(func() { close(ws.done) })
+	return nil
+}
+
+// thresholds returns the threshold rules for the namespace
+func (ws *webhookSender) thresholds(ns string) ([]threshold, error) {
+	if cached, ok := ws.rules.Get(ns); ok {
+		return cached.([]threshold), nil
+	}
+
+	rules, err := ws.remote.Thresholds(ns)
+	if err != nil {
+		return nil, err
+	}
+
+	ws.rules.Set(ns, rules)
+
+	return rules, nil
+}
+
+// Drop removes the namespace from the cache so the next lookup is from the remote DB
+func (ws *webhookSender) Drop(ns string) {
+	ws.rules.Drop(ns)
+}
+
+// claimed is called from the groupcache getter for each range that is
+// saved, the number is queued so the getter is never held up by the remote
+// DB. A number that can't be queued is dropped, as the threshold is checked
+// again on the next claim.
+func (ws *webhookSender) claimed(ns, keyNo string) {
+	n, err := strconv.ParseUint(keyNo, 10, 64)
+	if err != nil {
+		return
+	}
+
+	select {
+	case ws.claims <- webhookClaim{ns: ns, n: n}:
+	default:
+		log.Printf("[webhook] the claim queue is full, dropped %s %s", ns, keyNo)
+	}
+}
+
+// check takes the queued claims until shutdown, only the highest number
+// claimed in each namespace is checked against its thresholds
+func (ws *webhookSender) check() {
+	for {
+		select {
+		case <-ws.done:
+			return
+		case c := <-ws.claims:
+			var highest = map[string]uint64{c.ns: c.n}
+		drain:
+			for len(highest) < webhookBatch {
+				select {
+				case c := <-ws.claims:
+					if c.n >= highest[c.ns] {
+						highest[c.ns] = c.n
+					}
+				default:
+					break drain
+				}
+			}
+
+			for ns, n := range highest {
+				ws.queue(ns, n)
+			}
+		}
+	}
+}
+
+// queue queues a webhook in the remote DB for each threshold that the number
+// reaches. A failed queue is logged and tried again on the next claim.
+func (ws *webhookSender) queue(ns string, n uint64) {
+	rules, err := ws.thresholds(ns)
+	if err != nil {
+		log.Printf("[webhook] thresholds %s: %v", ns, err)
+		return
+	}
+
+	for _, rule := range rules {
+		if n < rule.Value {
+			continue
+		}
+
+		ws.RLock()
+		_, fired := ws.fired[rule.ID]
+		ws.RUnlock()
+		if fired {
+			continue
+		}
+
+		queued, err := ws.remote.QueueWebhook(rule, n)
+		if err != nil {
+			log.Printf("[webhook] queue %s %d: %v", ns, rule.Value, err)
+			continue
+		}
+
+		ws.Lock()
+		ws.fired[rule.ID] = struct{}{}
+		ws.Unlock()
+
+		if queued {
+			select {
+			case ws.wake <- struct{}{}: // send it now rather than at the next poll
+			default:
+			}
+		}
+	}
+}
+
+// run sends the due webhooks until shutdown
+func (ws *webhookSender) run() {
+	ticker := time.NewTicker(ws.poll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ws.done:
+			return
+		case <-ticker.C:
+		case <-ws.wake:
+		}
+		ws.sendDue()
+	}
+}
+
+// sendDue sends the webhooks that are due. Each one is leased first, by
+// counting the attempt and setting when it's next due, so only one server
+// sends an attempt and a failed attempt is tried again after a backoff.
+func (ws *webhookSender) sendDue() {
+	due, err := ws.remote.DueWebhooks(time.Now(), ws.maxAttempts, webhookBatch)
+	if err != nil {
+		log.Printf("[webhook] due: %v", err)
+		return
+	}
+
+	for _, d := range due {
+		ok, err := ws.remote.LeaseWebhook(d.ID, d.Attempts, time.Now().Add(ws.backoff(d.Attempts)))
+		if err != nil {
+			log.Printf("[webhook] lease %d: %v", d.ID, err)
+			continue
+		}
+		if !ok {
+			continue // another server has it
+		}
+
+		if err := ws.deliver(d); err != nil {
+			log.Printf("[webhook] %d attempt %d of %d to %s: %v", d.ID, d.Attempts+1, ws.maxAttempts, d.URL, err)
+			continue
+		}
+
+		if err := ws.remote.WebhookDelivered(d.ID); err != nil {
+			log.Printf("[webhook] delivered %d: %v", d.ID, err) // it's sent again, which receivers can drop by the id
+		}
+	}
+}
+
+// backoff returns how long to wait after an attempt before the next one,
+// it's always longer than an attempt can take
+func (ws *webhookSender) backoff(attempts int) time.Duration {
+	wait := 3 * ws.timeout
+	for i := 0; i < attempts && wait < webhookMaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > webhookMaxBackoff {
+		wait = webhookMaxBackoff
+	}
+	return wait
+}
+
+// deliver sends a single attempt of the webhook, it's only delivered when
+// the receiver gives back a 2xx status
+func (ws *webhookSender) deliver(d webhookDelivery) error {
+	body, err := json.Marshal(webhookPayload{
+		ID:        strconv.FormatUint(d.ID, 10),
+		Event:     "threshold",
+		Namespace: d.Namespace,
+		Threshold: strconv.FormatUint(d.Threshold, 10),
+		Number:    strconv.FormatUint(d.Value, 10),
+		Timestamp: d.Created.UTC().Format(time.RFC3339Nano),
+		Version:   verSemVer,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatUint(d.ID, 10))
+	req.Header.Set(webhookSignatureHeader, signWebhook(ws.secret, time.Now(), body))
+
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// signWebhook returns the signature header value for the body. The signature
+// is the HMAC-SHA256 of the unix time, a dot and the body, i.e:
+// t=1500000000,v1=<hex>, the time lets receivers turn away old replays.
+func signWebhook(secret []byte, now time.Time, body []byte) string {
+	ts := strconv.FormatInt(now.Unix(), 10)
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(ts + "."))
+	mac.Write(body)
+
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookURL checks that the URL is an absolute HTTP or HTTPS URL
+func webhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return errWebhookURL
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testWebhook is a webhook request seen by the test receiver
+type testWebhook struct {
+	delivery, signature string
+	body                []byte
+}
+
+// testWebhookReceiver starts a receiver that passes on each webhook it gets
+func testWebhookReceiver(t *testing.T) (*httptest.Server, chan testWebhook) {
+	got := make(chan testWebhook, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- testWebhook{
+			delivery:  r.Header.Get(webhookDeliveryHeader),
+			signature: r.Header.Get(webhookSignatureHeader),
+			body:      body,
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, got
+}
+
+func TestWebhookThreshold(t *testing.T) {
+	web, remote := testConfig(t).Web, testRemoteDB(t)
+	srv, got := testWebhookReceiver(t)
+	ns := testNS(t, "pub/")
+
+	if err := remote.SetThreshold(threshold{Namespace: ns, Value: 3, URL: srv.URL}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := web.claim(ns, 5); err != nil { // 0-4 passes the threshold
+		t.Fatal(err)
+	}
+
+	var wh testWebhook
+	select {
+	case wh = <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook was sent")
+	}
+
+	// the signature is the HMAC of the time, a dot and the body
+	parts := strings.Split(wh.signature, ",")
+	if len(parts) != 2 {
+		t.Fatalf("signature: got %q", wh.signature)
+	}
+	mac := hmac.New(sha256.New, []byte("test-webhook-secret"))
+	mac.Write([]byte(strings.TrimPrefix(parts[0], "t=") + "."))
+	mac.Write(wh.body)
+	if parts[1] != "v1="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("signature: got %q, it doesn't match the body", wh.signature)
+	}
+
+	var payload webhookPayload
+	if err := json.Unmarshal(wh.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.ID != wh.delivery || payload.Event != "threshold" || payload.Namespace != ns ||
+		payload.Threshold != "3" || payload.Number != "4" {
+		t.Errorf("payload: got %+v", payload)
+	}
+
+	// a threshold only fires once
+	if _, err := web.claim(ns, 1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case wh = <-got:
+		t.Errorf("a second webhook was sent: %s", wh.body)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestWebhookClaimedQueueFull(t *testing.T) {
+	ws := &webhookSender{claims: make(chan webhookClaim, 1)}
+
+	// the getter is never held up, a claim is dropped once the queue is full
+	done := make(chan struct{})
+	go func() {
+		ws.claimed("pub/webhook/full", "1")
+		ws.claimed("pub/webhook/full", "2")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("claimed blocked on a full queue")
+	}
+	if c := <-ws.claims; c.n != 1 {
+		t.Errorf("queued: got %d, want 1", c.n)
+	}
+}